@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sort"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+// 集約経路. より長い経路が1つでもLoc-RIBにある間だけ生成する
+const LOCALAGGREGATE LocalRouteKind = "aggregate"
+
+type AggregateConfig struct {
+	Prefix netip.Prefix `json:"prefix"`
+	// 集約に含まれる経路を広告しない
+	SummaryOnly bool `json:"summary_only"`
+	// 集約に含まれる経路のASをAS_SETにして付ける
+	// 付けなければAS_PATHを空にし、情報が失われたのでATOMIC_AGGREGATEを付ける
+	ASSet bool `json:"as_set"`
+}
+
+func (a AggregateConfig) validate() error {
+	if !a.Prefix.IsValid() || !a.Prefix.Addr().Is4() {
+		return fmt.Errorf("invalid prefix: %v", a.Prefix)
+	}
+	return nil
+}
+
+// prefixが集約に含まれるより長いプレフィックスか
+func (a AggregateConfig) contains(prefix netip.Prefix) bool {
+	return prefix.Bits() > a.Prefix.Bits() && a.Prefix.Contains(prefix.Addr())
+}
+
+// 集約に含まれる経路のAS_PATHをまとめる (RFC 4271 9.2.2.2)
+// 全ての経路で先頭が同じASはAS_SEQUENCEに残し、残りのASをAS_SETにする
+func aggregateASPath(paths []update.AS_PATH) update.AS_PATH {
+	leading := func(path update.AS_PATH) []uint16 {
+		if len(path) == 0 || path[0].VALUE_SEGMENT != update.VALUE_SEGMENT_AS_SEQUENCE {
+			return nil
+		}
+		return path[0].AS_SEQUENCE
+	}
+	common := leading(paths[0])
+	for _, path := range paths[1:] {
+		sequence := leading(path)
+		n := 0
+		for n < len(common) && n < len(sequence) && common[n] == sequence[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	seen := make(map[uint16]bool)
+	for _, AS := range common {
+		seen[AS] = true
+	}
+	set := make([]uint16, 0)
+	for _, path := range paths {
+		for _, segment := range path.WithoutConfed() {
+			for _, AS := range segment.AS_SEQUENCE {
+				if !seen[AS] {
+					seen[AS] = true
+					set = append(set, AS)
+				}
+			}
+		}
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i] < set[j] })
+	aggregated := update.AS_PATH{}
+	if len(common) != 0 {
+		aggregated = append(aggregated, update.AS_PATH_SEGMENT{
+			VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE,
+			AS_SEQUENCE:   append([]uint16{}, common...),
+		})
+	}
+	if len(set) != 0 {
+		aggregated = append(aggregated, update.AS_PATH_SEGMENT{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SET, AS_SEQUENCE: set})
+	}
+	return aggregated
+}
+
+// 集約に含まれる経路から集約経路を作る
+// ORIGINは最も悪いものにする. 含まれる経路にATOMIC_AGGREGATEがあれば引き継ぐ
+func (a AggregateConfig) route(contributors []RibAdjEntry, aggregator update.AGGREGATOR) RibAdjEntry {
+	entry := RibAdjEntry{
+		ORIGIN:     update.OriginIGP,
+		AS_PATH:    update.AS_PATH{},
+		LOCAL_PREF: DEFAULTLOCALPREF,
+		AGGREGATOR: aggregator,
+		Source:     PathSource{Kind: LOCALAGGREGATE},
+	}
+	paths := make([]update.AS_PATH, 0, len(contributors))
+	for _, contributor := range contributors {
+		if contributor.ORIGIN > entry.ORIGIN {
+			entry.ORIGIN = contributor.ORIGIN
+		}
+		if contributor.ATOMIC_AGGREGATE {
+			entry.ATOMIC_AGGREGATE = true
+		}
+		if !a.ASSet && contributor.AS_PATH.Length() != 0 {
+			entry.ATOMIC_AGGREGATE = true
+		}
+		paths = append(paths, contributor.AS_PATH)
+	}
+	if a.ASSet {
+		entry.AS_PATH = aggregateASPath(paths)
+	}
+	return entry
+}
+
+// 集約に含まれるLoc-RIBの最良経路. 集約経路自身は含めない
+// 集約経路の属性が並び順で変わらないようにプレフィックスの順に並べる
+func (L *LocRib) contributors(a AggregateConfig) ([]netip.Prefix, []RibAdjEntry) {
+	prefixes := make([]netip.Prefix, 0)
+	for prefix, entry := range L.adjBest {
+		if a.contains(prefix) && entry.Source.Kind != LOCALAGGREGATE {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixLess(prefixes[i], prefixes[j]) })
+	entries := make([]RibAdjEntry, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		entries = append(entries, L.adjBest[prefix])
+	}
+	return prefixes, entries
+}
+
+// changedのプレフィックスを含む集約経路を作り直し、最良経路を選び直す
+// 新しく変わった最良経路と、summary-onlyの集約が生成されたか消えたことで広告が変わる経路を返す
+func (L *LocRib) updateAggregates(changed []netip.Prefix) []netip.Prefix {
+	if len(L.aggregates) == 0 || len(changed) == 0 {
+		return nil
+	}
+	if L.adjAggregate == nil {
+		L.adjAggregate = make(RibAdj)
+	}
+	readvertise := make([]netip.Prefix, 0)
+	for _, a := range L.aggregates {
+		affected := false
+		for _, prefix := range changed {
+			if a.contains(prefix) {
+				affected = true
+				break
+			}
+		}
+		if !affected {
+			continue
+		}
+		prefixes, contributors := L.contributors(a)
+		old, active := L.adjAggregate[a.Prefix]
+		if len(contributors) == 0 {
+			if active {
+				delete(L.adjAggregate, a.Prefix)
+				L.markDirty(a.Prefix)
+			}
+			continue
+		}
+		entry := a.route(contributors, update.AGGREGATOR{AS: L.AS, Address: L.routerID})
+		if active && reflect.DeepEqual(old, entry) {
+			continue
+		}
+		L.adjAggregate[a.Prefix] = entry
+		L.markDirty(a.Prefix)
+		// summary-onlyの集約が生成されたら含まれる経路を取り消す
+		if a.SummaryOnly && !active {
+			readvertise = append(readvertise, prefixes...)
+		}
+	}
+	if len(L.dirty) != 0 {
+		readvertise = append(readvertise, L.updateDirty()...)
+	}
+	return readvertise
+}
+
+// summary-onlyの集約経路があるので広告しない経路か
+func (L *LocRib) suppressedByAggregate(prefix netip.Prefix) bool {
+	for _, a := range L.aggregates {
+		if !a.SummaryOnly || !a.contains(prefix) {
+			continue
+		}
+		if _, ok := L.adjAggregate[a.Prefix]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+func TestAggregateASPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []update.AS_PATH
+		want  update.AS_PATH
+	}{
+		{
+			name:  "same path",
+			paths: []update.AS_PATH{path("10.0.0.1", 65001, 65002).AS_PATH, path("10.0.0.1", 65001, 65002).AS_PATH},
+			want:  update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65001, 65002}}},
+		},
+		{
+			name:  "common leading AS",
+			paths: []update.AS_PATH{path("10.0.0.1", 65001, 65003).AS_PATH, path("10.0.0.1", 65001, 65002, 65003).AS_PATH},
+			want: update.AS_PATH{
+				{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65001}},
+				{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SET, AS_SEQUENCE: []uint16{65002, 65003}},
+			},
+		},
+		{
+			name:  "local route",
+			paths: []update.AS_PATH{{}, path("10.0.0.1", 65002, 65001).AS_PATH},
+			want:  update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SET, AS_SEQUENCE: []uint16{65001, 65002}}},
+		},
+		{
+			name:  "empty",
+			paths: []update.AS_PATH{{}},
+			want:  update.AS_PATH{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aggregateASPath(tt.paths); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("aggregateASPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateRoute(t *testing.T) {
+	aggregator := update.AGGREGATOR{AS: 65000, Address: netip.MustParseAddr("10.255.0.1")}
+	incomplete := path("10.0.0.1", 65001)
+	incomplete.ORIGIN = update.OriginINC
+	local := RibAdjEntry{ORIGIN: update.OriginIGP, AS_PATH: update.AS_PATH{}, Source: PathSource{Kind: LOCALNETWORK}}
+
+	entry := AggregateConfig{}.route([]RibAdjEntry{path("10.0.0.1", 65001), incomplete}, aggregator)
+	if entry.ORIGIN != update.OriginINC || entry.AS_PATH.Length() != 0 || !entry.ATOMIC_AGGREGATE {
+		t.Errorf("invalid aggregate: %+v", entry)
+	}
+	if entry.AGGREGATOR != aggregator || !entry.Local() {
+		t.Errorf("aggregator is not set: %+v", entry)
+	}
+	// AS_SETを付ければ情報は失われない
+	if entry := (AggregateConfig{ASSet: true}).route([]RibAdjEntry{path("10.0.0.1", 65001)}, aggregator); entry.ATOMIC_AGGREGATE || entry.AS_PATH.Length() != 1 {
+		t.Errorf("invalid aggregate with as set: %+v", entry)
+	}
+	// 自分で生成した経路だけなら失われるASはない
+	if entry := (AggregateConfig{}).route([]RibAdjEntry{local}, aggregator); entry.ATOMIC_AGGREGATE {
+		t.Errorf("ATOMIC_AGGREGATE is set for local routes: %+v", entry)
+	}
+}
+
+func TestLocRibAggregate(t *testing.T) {
+	aggregate := netip.MustParsePrefix("10.1.0.0/16")
+	first := netip.MustParsePrefix("10.1.1.0/24")
+	second := netip.MustParsePrefix("10.1.2.0/24")
+	ch1 := make(chan RibDelta, 1)
+	ch2 := make(chan RibDelta, 1)
+	L := LocRib{
+		peers: []Peer{
+			{RibAdjInCh: ch1, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}},
+			{RibAdjInCh: ch2, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}},
+		},
+		aggregates: []AggregateConfig{{Prefix: aggregate, SummaryOnly: true}},
+		AS:         65000,
+		routerID:   netip.MustParseAddr("10.255.0.1"),
+	}
+	ch2 <- RibDelta{Request: true, Target: &ExportTarget{LocalInfo: LocalInfo{AS: 65000}, PeerAddr: netip.MustParseAddr("10.0.1.1")}}
+	L.Handle()
+	L.peers[1].LocRibQueue.PopEndOfRIB()
+
+	// 含まれる経路が現れたら集約経路だけを広告する
+	route := path("10.0.0.1", 65001)
+	ch1 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{first: &route}}
+	L.Handle()
+	announce, _ := L.peers[1].LocRibQueue.Pop()
+	entry, ok := announce[aggregate]
+	if len(announce) != 1 || !ok {
+		t.Fatalf("only aggregate should be advertised: %v", announce)
+	}
+	if !entry.ATOMIC_AGGREGATE || entry.AGGREGATOR.AS != 65000 {
+		t.Errorf("invalid aggregate attributes: %+v", entry)
+	}
+	if got := fibNextHops(L.multipaths[aggregate]); len(got) != 1 || got[0].Type != ROUTEBLACKHOLE {
+		t.Errorf("aggregate is not a discard route: %v", got)
+	}
+
+	ch1 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{second: &route}}
+	L.Handle()
+	if announce, withdraw := L.peers[1].LocRibQueue.Pop(); len(announce) != 0 || len(withdraw) != 0 {
+		t.Errorf("suppressed route is advertised: %v %v", announce, withdraw)
+	}
+
+	// 含まれる経路が全て消えたら集約経路も取り消す
+	ch1 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{first: nil, second: nil}}
+	L.Handle()
+	if _, withdraw := L.peers[1].LocRibQueue.Pop(); len(withdraw) != 1 || withdraw[0] != aggregate {
+		t.Errorf("aggregate is not withdrawn: %v", withdraw)
+	}
+	if _, ok := L.adjBest[aggregate]; ok {
+		t.Errorf("aggregate remains in Loc-RIB")
+	}
+}
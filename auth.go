@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// TCP-AO (RFC 5925) の設定
+type TCPAOConfig struct {
+	Key string `json:"key"`
+	// カーネルのcrypto APIでの名前
+	Algorithm string `json:"algorithm"`
+	SendID    uint8  `json:"send_id"`
+	RecvID    uint8  `json:"recv_id"`
+}
+
+const DEFAULTTCPAOALGORITHM string = "hmac(sha1)"
+
+// linux/tcp.h
+const (
+	TCP_AO_ADD_KEY     int = 38
+	TCPMD5SIGMAXKEYLEN int = 80
+	TCPAOMAXKEYLEN     int = 80
+)
+
+// struct sockaddr_storage の先頭にアドレスを書き込む
+func put_sockaddr(b []byte, addr netip.Addr) {
+	if addr.Is4() {
+		binary.NativeEndian.PutUint16(b, unix.AF_INET)
+		a := addr.As4()
+		copy(b[4:], a[:])
+		return
+	}
+	binary.NativeEndian.PutUint16(b, unix.AF_INET6)
+	a := addr.As16()
+	copy(b[8:], a[:])
+}
+
+// struct tcp_md5sig
+// プレフィックスで指定できるようにTCP_MD5SIG_EXTとして使う
+func tcp_md5sig(peer netip.Prefix, key string) ([]byte, error) {
+	if len(key) > TCPMD5SIGMAXKEYLEN {
+		return nil, fmt.Errorf("md5 key is longer than %d bytes", TCPMD5SIGMAXKEYLEN)
+	}
+	b := make([]byte, 216)
+	put_sockaddr(b, peer.Addr())
+	b[128] = unix.TCP_MD5SIG_FLAG_PREFIX
+	b[129] = uint8(peer.Bits())
+	binary.NativeEndian.PutUint16(b[130:], uint16(len(key)))
+	copy(b[136:], key)
+	return b, nil
+}
+
+// struct tcp_ao_add
+// 最初の鍵なのでCurrent_keyとRNext_keyの両方にする
+func tcp_ao_add(peer netip.Prefix, conf TCPAOConfig) ([]byte, error) {
+	if len(conf.Key) > TCPAOMAXKEYLEN {
+		return nil, fmt.Errorf("tcp-ao key is longer than %d bytes", TCPAOMAXKEYLEN)
+	}
+	algorithm := conf.Algorithm
+	if algorithm == "" {
+		algorithm = DEFAULTTCPAOALGORITHM
+	}
+	if len(algorithm) >= 64 {
+		return nil, fmt.Errorf("invalid tcp-ao algorithm: %v", algorithm)
+	}
+	b := make([]byte, 288)
+	put_sockaddr(b, peer.Addr())
+	copy(b[128:], algorithm)
+	binary.NativeEndian.PutUint32(b[196:], 0x3) // set_current, set_rnext
+	b[202] = uint8(peer.Bits())
+	b[203] = conf.SendID
+	b[204] = conf.RecvID
+	b[207] = uint8(len(conf.Key))
+	copy(b[208:], conf.Key)
+	return b, nil
+}
+
+// 認証を設定しているかどうか
+func (conf PeerConfig) Auth() string {
+	if conf.TCPAO != nil {
+		return "tcp-ao"
+	}
+	if conf.MD5Password != "" {
+		return "md5"
+	}
+	return ""
+}
+
+// peerとの通信に使う鍵をソケットに設定する
+func set_tcp_auth(fd int, conf PeerConfig, peer netip.Prefix) error {
+	switch conf.Auth() {
+	case "md5":
+		b, err := tcp_md5sig(peer, conf.MD5Password)
+		if err != nil {
+			return err
+		}
+		if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_MD5SIG_EXT, string(b)); err != nil {
+			return fmt.Errorf("failed to set TCP_MD5SIG for %v: %v", peer, err)
+		}
+	case "tcp-ao":
+		b, err := tcp_ao_add(peer, *conf.TCPAO)
+		if err != nil {
+			return err
+		}
+		if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, TCP_AO_ADD_KEY, string(b)); err != nil {
+			return fmt.Errorf("failed to set TCP-AO for %v (kernel support is needed): %v", peer, err)
+		}
+	}
+	return nil
+}
+
+// reuseportに加えてpeerとの認証の鍵を設定するControl関数を返す
+func auth_control(conf PeerConfig, peers ...netip.Prefix) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if err := reuseport(network, address, c); err != nil {
+			return err
+		}
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			for _, peer := range peers {
+				if serr = set_tcp_auth(int(fd), conf, peer); serr != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// 開いてあるリスナーに鍵を追加する
+func set_listener_auth(l *net.TCPListener, conf PeerConfig, peer netip.Prefix) error {
+	if conf.Auth() == "" {
+		return nil
+	}
+	raw, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return auth_control(conf, peer)("", "", raw)
+}
+
+// /proc/net/netstat のTCP MD5とTCP-AOのカウンタ
+// 認証に失敗したセグメントはカーネルが黙って捨てるので、失敗したことはこれで調べる
+func tcp_auth_counters() map[string]uint64 {
+	counters := make(map[string]uint64)
+	f, err := os.Open("/proc/net/netstat")
+	if err != nil {
+		return counters
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		names := strings.Fields(scanner.Text())
+		if !scanner.Scan() {
+			break
+		}
+		values := strings.Fields(scanner.Text())
+		if len(names) == 0 || names[0] != "TcpExt:" || len(names) != len(values) {
+			continue
+		}
+		for i, name := range names {
+			if !strings.HasPrefix(name, "TCPMD5") && !strings.HasPrefix(name, "TCPAO") {
+				continue
+			}
+			if v, err := strconv.ParseUint(values[i], 10, 64); err == nil {
+				counters[name] = v
+			}
+		}
+	}
+	return counters
+}
+
+// before以降に増えた認証失敗のカウンタを "TCPMD5Failure +3" のように並べる
+func auth_failures(before, after map[string]uint64) string {
+	failures := make([]string, 0)
+	for name, v := range after {
+		if name == "TCPAOGood" || v <= before[name] {
+			continue
+		}
+		failures = append(failures, fmt.Sprintf("%s +%d", name, v-before[name]))
+	}
+	sort.Strings(failures)
+	return strings.Join(failures, ", ")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestTCPMD5Sig(t *testing.T) {
+	b, err := tcp_md5sig(netip.MustParsePrefix("10.0.0.0/24"), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 216 || b[4] != 10 || b[128] != 1 || b[129] != 24 || b[130] != 6 || string(b[136:142]) != "secret" {
+		t.Errorf("invalid tcp_md5sig: %v", b)
+	}
+	if _, err := tcp_md5sig(netip.MustParsePrefix("10.0.0.0/24"), string(make([]byte, 81))); err == nil {
+		t.Error("too long key should be rejected")
+	}
+}
+
+func TestAuthFailures(t *testing.T) {
+	before := map[string]uint64{"TCPMD5Failure": 1, "TCPAOGood": 1}
+	after := map[string]uint64{"TCPMD5Failure": 3, "TCPMD5NotFound": 1, "TCPAOGood": 5}
+	if got := auth_failures(before, after); got != "TCPMD5Failure +2, TCPMD5NotFound +1" {
+		t.Errorf("auth_failures() = %q", got)
+	}
+}
+
+// カーネルが対応していればループバックで実際に接続してみる
+func TestTCPAuthLoopback(t *testing.T) {
+	loopback := netip.MustParsePrefix("127.0.0.1/32")
+	tests := []struct {
+		name   string
+		server PeerConfig
+		client PeerConfig
+		wantOK bool
+	}{
+		{name: "md5", server: PeerConfig{MD5Password: "secret"}, client: PeerConfig{MD5Password: "secret"}, wantOK: true},
+		{name: "md5_mismatch", server: PeerConfig{MD5Password: "secret"}, client: PeerConfig{MD5Password: "wrong"}, wantOK: false},
+		{name: "tcp_ao", server: PeerConfig{TCPAO: &TCPAOConfig{Key: "secret"}}, client: PeerConfig{TCPAO: &TCPAOConfig{Key: "secret"}}, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := net.ListenConfig{Control: auth_control(tt.server, loopback)}
+			l, err := lc.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Skipf("kernel does not support %v: %v", tt.server.Auth(), err)
+			}
+			defer l.Close()
+			dialer := net.Dialer{Control: auth_control(tt.client, loopback), Timeout: 500 * time.Millisecond}
+			conn, err := dialer.Dial("tcp4", l.Addr().String())
+			if err == nil {
+				conn.Close()
+			}
+			if (err == nil) != tt.wantOK {
+				t.Errorf("Dial() error = %v, wantOK %v", err, tt.wantOK)
+			}
+		})
+	}
+}
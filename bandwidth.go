@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+// Link Bandwidthから決めるネクストホップの重みの最大値. ip routeのweightは256まで
+const MAXNEXTHOPWEIGHT int = 255
+
+// Mbit/sをLink Bandwidthで使うbyte/sにする
+func mbpsToBandwidth(mbps uint32) float32 {
+	return float32(mbps) * 1e6 / 8
+}
+
+// /sys/class/net/<ifname>/speed からインターフェースの速度を読む
+// vethなど速度のないインターフェースではfalseを返す
+func interface_bandwidth(ifname string) (float32, bool) {
+	b, err := os.ReadFile("/sys/class/net/" + ifname + "/speed")
+	if err != nil {
+		return 0, false
+	}
+	mbps, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || mbps <= 0 {
+		return 0, false
+	}
+	return mbpsToBandwidth(uint32(mbps)), true
+}
+
+// eBGPピアに広告する経路に付けるLink Bandwidth. 付けなければ0
+// 設定されていなければインターフェースの速度を使う
+func (s *Session) linkBandwidth() float32 {
+	if !s.Config.SendLinkBandwidth {
+		return 0
+	}
+	if s.Config.Bandwidth != 0 {
+		return mbpsToBandwidth(s.Config.Bandwidth)
+	}
+	bandwidth, ok := interface_bandwidth(s.Ifi.Name)
+	if !ok {
+		log.Printf("%v: link bandwidth is unknown. set bandwidth in the config", s.Ifi.Name)
+		return 0
+	}
+	return bandwidth
+}
+
+// マルチパスの経路のLink Bandwidthの合計
+// 1つでもLink Bandwidthのない経路があればfalseを返す
+func aggregateBandwidth(paths []RibAdjEntry) (float32, bool) {
+	var total float32
+	for _, path := range paths {
+		bandwidth, ok := path.EXTENDED_COMMUNITIES.LinkBandwidth()
+		if !ok || bandwidth <= 0 {
+			return 0, false
+		}
+		total += bandwidth
+	}
+	return total, true
+}
+
+// マルチパスの最良経路にはまとめたLink Bandwidthを付けて広告する
+// 合計がわからなければ受け取ったLink Bandwidthを外し、広告するときにリンクの速度を付ける
+func aggregatedBest(best RibAdjEntry, multipaths []RibAdjEntry) RibAdjEntry {
+	if len(multipaths) <= 1 {
+		return best
+	}
+	bandwidth, ok := aggregateBandwidth(multipaths)
+	if !ok {
+		best.EXTENDED_COMMUNITIES = best.EXTENDED_COMMUNITIES.WithoutLinkBandwidth()
+		return best
+	}
+	best.EXTENDED_COMMUNITIES = best.EXTENDED_COMMUNITIES.WithLinkBandwidth(best.Source.PeerAS, bandwidth)
+	return best
+}
+
+// Link Bandwidthに比例したネクストホップの重み
+// 全ての経路にLink Bandwidthがなければ等しい重みにする
+func nextHopWeights(paths []RibAdjEntry) []int {
+	weights := make([]int, len(paths))
+	var max float32
+	for _, path := range paths {
+		bandwidth, ok := path.EXTENDED_COMMUNITIES.LinkBandwidth()
+		if !ok || bandwidth <= 0 {
+			max = 0
+			break
+		}
+		if bandwidth > max {
+			max = bandwidth
+		}
+	}
+	for i, path := range paths {
+		if max == 0 {
+			weights[i] = 1
+			continue
+		}
+		bandwidth, _ := path.EXTENDED_COMMUNITIES.LinkBandwidth()
+		weights[i] = int(math.Round(float64(bandwidth / max * float32(MAXNEXTHOPWEIGHT))))
+		if weights[i] < 1 {
+			weights[i] = 1
+		}
+	}
+	return weights
+}
+
+// eBGPピアにはASの外に伝えないExtended Communityを送らない
+// Link Bandwidthを送る場合はまとめた値か、なければリンクの速度を付ける
+func exportExtCommunities(entry RibAdjEntry, t ExportTarget) update.EXTENDED_COMMUNITIES {
+	if t.Internal() {
+		return entry.EXTENDED_COMMUNITIES
+	}
+	communities := entry.EXTENDED_COMMUNITIES.TransitiveOnly()
+	if t.LinkBandwidth <= 0 {
+		return communities
+	}
+	bandwidth, ok := entry.EXTENDED_COMMUNITIES.LinkBandwidth()
+	if !ok || entry.Local() {
+		bandwidth = t.LinkBandwidth
+	}
+	return communities.WithLinkBandwidth(t.ExternalAS(), bandwidth)
+}
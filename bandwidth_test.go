@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+func withBandwidth(e RibAdjEntry, mbps uint32) RibAdjEntry {
+	e.EXTENDED_COMMUNITIES = update.EXTENDED_COMMUNITIES{update.NewLinkBandwidth(e.Source.PeerAS, mbpsToBandwidth(mbps))}
+	return e
+}
+
+func TestNextHopWeights(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []RibAdjEntry
+		want  []int
+	}{
+		{
+			name:  "no bandwidth",
+			paths: []RibAdjEntry{path("10.0.0.1", 65001), path("10.0.1.1", 65002)},
+			want:  []int{1, 1},
+		},
+		{
+			name: "proportional to bandwidth",
+			paths: []RibAdjEntry{
+				withBandwidth(path("10.0.0.1", 65001), 10000),
+				withBandwidth(path("10.0.1.1", 65002), 40000),
+			},
+			want: []int{64, 255},
+		},
+		{
+			name: "equal weights unless every path has bandwidth",
+			paths: []RibAdjEntry{
+				withBandwidth(path("10.0.0.1", 65001), 10000),
+				path("10.0.1.1", 65002),
+			},
+			want: []int{1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextHopWeights(tt.paths); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nextHopWeights() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregatedBest(t *testing.T) {
+	spine1 := withBandwidth(path("10.0.0.1", 65001), 10000)
+	spine2 := withBandwidth(path("10.0.1.1", 65002), 25000)
+	best := aggregatedBest(spine1, []RibAdjEntry{spine1, spine2})
+	if bandwidth, _ := best.EXTENDED_COMMUNITIES.LinkBandwidth(); bandwidth != mbpsToBandwidth(35000) {
+		t.Errorf("aggregated bandwidth = %v, want %v", bandwidth, mbpsToBandwidth(35000))
+	}
+	if bandwidth, _ := spine1.EXTENDED_COMMUNITIES.LinkBandwidth(); bandwidth != mbpsToBandwidth(10000) {
+		t.Errorf("received path is modified")
+	}
+	// 合計がわからなければ受け取った値は広告しない
+	best = aggregatedBest(spine1, []RibAdjEntry{spine1, path("10.0.1.1", 65002)})
+	if _, ok := best.EXTENDED_COMMUNITIES.LinkBandwidth(); ok {
+		t.Errorf("partial bandwidth should be removed: %v", best.EXTENDED_COMMUNITIES)
+	}
+}
+
+func TestExportLinkBandwidth(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.1.0.0/24")
+	local := RibAdjEntry{LOCAL_PREF: DEFAULTLOCALPREF}
+	learned := withBandwidth(path("10.0.0.1", 65001), 35000)
+	target := ExportTarget{LocalInfo: LocalInfo{AS: 65000}, LinkBandwidth: mbpsToBandwidth(10000)}
+	tests := []struct {
+		name   string
+		entry  RibAdjEntry
+		target ExportTarget
+		want   float32
+		wantOK bool
+	}{
+		{name: "local route uses the link", entry: local, target: target, want: mbpsToBandwidth(10000), wantOK: true},
+		{name: "learned route keeps the received bandwidth", entry: learned, target: target, want: mbpsToBandwidth(35000), wantOK: true},
+		{name: "not sent without send_link_bandwidth", entry: learned, target: ExportTarget{LocalInfo: LocalInfo{AS: 65000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exported := RibAdj{prefix: tt.entry}.Export(tt.target)[prefix]
+			bandwidth, ok := exported.EXTENDED_COMMUNITIES.LinkBandwidth()
+			if ok != tt.wantOK || bandwidth != tt.want {
+				t.Errorf("link bandwidth = %v %v, want %v %v", bandwidth, ok, tt.want, tt.wantOK)
+			}
+			if ok {
+				AS, _, _ := exported.EXTENDED_COMMUNITIES[0].LinkBandwidth()
+				if AS != 65000 {
+					t.Errorf("link bandwidth AS = %v, want 65000", AS)
+				}
+			}
+		})
+	}
+}
+
+func TestInterfaceBandwidth(t *testing.T) {
+	// loopbackには速度がない
+	if _, ok := interface_bandwidth("lo"); ok {
+		t.Errorf("loopback should not have bandwidth")
+	}
+	if _, ok := interface_bandwidth("no-such-interface"); ok {
+		t.Errorf("unknown interface should not have bandwidth")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// "30s" のような文字列で書ける time.Duration
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ピアごとの設定
+// Interface が一致するピアに適用される
+type PeerConfig struct {
+	Interface string `json:"interface"`
+	// neighborsで使う. インターフェースではなくアドレスでピアを指定する
+	Address netip.Addr `json:"address"`
+	// 接続に使うインターフェース名かアドレス. 指定しなければ経路から決める
+	UpdateSource string `json:"update_source"`
+	// eBGP multihopのTTL. 0ならOSのデフォルト値
+	EBGPMultihop uint8 `json:"ebgp_multihop"`
+	// GTSM (RFC 5082). TTL 255で送り、254未満で届いたパケットを捨てる
+	// ebgp_multihopを指定した場合は255-ebgp_multihopまで許す
+	TTLSecurity bool `json:"ttl_security"`
+	// TCP MD5署名 (RFC 2385) の鍵
+	MD5Password string `json:"md5_password"`
+	// TCP-AO (RFC 5925). md5_passwordとは同時に使えない
+	TCPAO *TCPAOConfig `json:"tcp_ao"`
+	// 受け取る経路数の上限. 0なら無制限
+	MaxPrefix int `json:"max_prefix"`
+	// 上限の何%を超えたら警告を出すか
+	MaxPrefixWarning int `json:"max_prefix_warning"`
+	// 上限を超えて切断した後に再接続するまでの時間
+	// 0ならSIGUSR1で解除されるまで切断したままにする
+	MaxPrefixRestart Duration `json:"max_prefix_restart"`
+	// iBGPピアに広告する経路のNEXT_HOPを自分のアドレスに書き換える
+	NextHopSelf bool `json:"next_hop_self"`
+	// ルートリフレクタのクライアントとして扱う
+	RouteReflectorClient bool `json:"route_reflector_client"`
+	// ピアのAS. 指定した場合はOPENのASと一致しなければ切断する
+	// コンフェデレーションの外のピアにはこれを指定するとOPENでコンフェデレーションIDを名乗る
+	RemoteAS uint16 `json:"remote_as"`
+	// 受け入れるピアのASの範囲. remote_asより優先度は低い
+	RemoteASRange *ASRange `json:"remote_as_range"`
+	// 送信待ちの経路の変更をいくつまでためるか
+	OutQueueLimit int `json:"out_queue_limit"`
+	// この時間書き込めなければセッションを切断する (RFC 9687)
+	SendHoldTime Duration `json:"send_hold_time"`
+	// MinRouteAdvertisementInterval. 指定しなければeBGPとiBGPで別のデフォルト値を使う
+	MRAI *Duration `json:"mrai"`
+	// withdrawはMRAIを待たずに送る
+	MRAIWithdrawExempt bool `json:"mrai_withdraw_exempt"`
+	// eBGPピアに広告する経路にLink Bandwidthを付ける
+	SendLinkBandwidth bool `json:"send_link_bandwidth"`
+	// リンクの速度 (Mbit/s). 0ならインターフェースから調べる
+	Bandwidth uint32 `json:"bandwidth"`
+	// 受け取った経路に適用するルートマップ
+	ImportPolicy string `json:"import_policy"`
+	// 広告する経路に適用するルートマップ
+	ExportPolicy string `json:"export_policy"`
+}
+
+type ASRange struct {
+	Min uint16 `json:"min"`
+	Max uint16 `json:"max"`
+}
+
+// OPENで受け取ったASを受け入れるかどうか
+func (conf PeerConfig) AcceptAS(AS uint16) bool {
+	if conf.RemoteAS != 0 {
+		return AS == conf.RemoteAS
+	}
+	if conf.RemoteASRange != nil {
+		return conf.RemoteASRange.Min <= AS && AS <= conf.RemoteASRange.Max
+	}
+	return true
+}
+
+type Config struct {
+	// ルートリフレクタのクラスタID. 指定しなければrouter-idを使う
+	ClusterID netip.Addr `json:"cluster_id"`
+	// コンフェデレーションID. 0ならコンフェデレーションを使わない
+	ConfederationID uint16 `json:"confederation_id"`
+	// 同じコンフェデレーションの他のメンバーAS
+	ConfederationPeers []uint16 `json:"confederation_peers"`
+	// Adj-RIB-Inの変更を受け取ってからこの時間に届いた変更をまとめて最良経路を計算する
+	UpdateBatchInterval Duration `json:"update_batch_interval"`
+	// 起動してから全てのピアのEnd-of-RIBを待ってFIBを更新する最大時間. 0なら待たない
+	InitialSyncTimeout Duration `json:"initial_sync_timeout"`
+	// 最良経路の選択の設定
+	BestPath BestPathConfig `json:"best_path"`
+	// 全てのピアに適用するフラップダンピングの設定. 指定しなければダンピングしない
+	Damping *DampingConfig `json:"damping"`
+	// Graceful Restartの設定. 指定しなければCapabilityを送らない
+	GracefulRestart *GracefulRestartConfig `json:"graceful_restart"`
+	// 接続しているサブネットの他に広告するプレフィックス. ループバックのアドレスなど
+	Networks []NetworkConfig `json:"networks"`
+	// 自分で生成した経路として広告するカーネルの経路
+	Redistribute []RedistributeConfig `json:"redistribute"`
+	// 集約経路
+	Aggregates []AggregateConfig `json:"aggregates"`
+	// ROUTINGTABLEに入れる静的経路
+	StaticRoutes []StaticRouteConfig `json:"static_routes"`
+	// ピアとのリンクのサブネットを広告する. 指定しなければtrue
+	AdvertiseLinkSubnets *bool `json:"advertise_link_subnets"`
+	// ピアのimport_policyとexport_policyで使うルートマップなど
+	Policy PolicyConfig `json:"policy"`
+	// 指定した範囲からの接続を受け付けてセッションを作る
+	DynamicNeighbors []DynamicNeighborConfig `json:"dynamic_neighbors"`
+	// アドレスで指定するピア
+	Neighbors []PeerConfig `json:"neighbors"`
+	Peers     []PeerConfig `json:"peers"`
+}
+
+const (
+	DEFAULTMAXPREFIXWARNING int      = 75
+	DEFAULTOUTQUEUELIMIT    int      = 10000
+	DEFAULTSENDHOLDTIME     Duration = Duration(8 * time.Minute)
+	DEFAULTEBGPMRAI         Duration = 0
+	DEFAULTIBGPMRAI         Duration = Duration(5 * time.Second)
+)
+
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	if path == "" {
+		return config, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return config, fmt.Errorf("failed to parse %v: %v", path, err)
+	}
+	if config.ClusterID.IsValid() && !config.ClusterID.Is4() {
+		return config, fmt.Errorf("invalid cluster_id: %v", config.ClusterID)
+	}
+	if config.Damping != nil {
+		if err := config.Damping.withDefaults().validate(); err != nil {
+			return config, fmt.Errorf("invalid damping: %v", err)
+		}
+	}
+	if config.InitialSyncTimeout < 0 {
+		return config, fmt.Errorf("invalid initial_sync_timeout: %v", time.Duration(config.InitialSyncTimeout))
+	}
+	if config.GracefulRestart != nil {
+		if err := config.GracefulRestart.withDefaults().validate(); err != nil {
+			return config, fmt.Errorf("invalid graceful_restart: %v", err)
+		}
+	}
+	for _, network := range config.Networks {
+		if !network.Prefix.IsValid() || !network.Prefix.Addr().Is4() {
+			return config, fmt.Errorf("invalid network: %v", network.Prefix)
+		}
+	}
+	for _, a := range config.Aggregates {
+		if err := a.validate(); err != nil {
+			return config, fmt.Errorf("invalid aggregate: %v", err)
+		}
+	}
+	for _, r := range config.Redistribute {
+		if err := r.validate(); err != nil {
+			return config, fmt.Errorf("invalid redistribute: %v", err)
+		}
+	}
+	for _, static := range config.StaticRoutes {
+		if !static.Prefix.IsValid() || !static.Prefix.Addr().Is4() {
+			return config, fmt.Errorf("invalid static route: %v", static.Prefix)
+		}
+		if !static.NextHop.Is4() {
+			return config, fmt.Errorf("invalid next_hop for static route %v: %v", static.Prefix, static.NextHop)
+		}
+	}
+	routeMaps, err := CompileRouteMaps(config.Policy)
+	if err != nil {
+		return config, fmt.Errorf("invalid policy: %v", err)
+	}
+	peers := append([]PeerConfig{}, config.Peers...)
+	for _, neighbor := range config.Neighbors {
+		if !neighbor.Address.IsValid() {
+			return config, fmt.Errorf("neighbors needs address")
+		}
+		peers = append(peers, neighbor)
+	}
+	for _, dynamic := range config.DynamicNeighbors {
+		if len(dynamic.Prefixes) == 0 {
+			return config, fmt.Errorf("dynamic_neighbors needs prefixes")
+		}
+		peers = append(peers, dynamic.PeerGroup)
+	}
+	for _, peer := range peers {
+		if peer.MaxPrefix < 0 {
+			return config, fmt.Errorf("invalid max_prefix for %v: %v", peer.Interface, peer.MaxPrefix)
+		}
+		if peer.MRAI != nil && *peer.MRAI < 0 {
+			return config, fmt.Errorf("invalid mrai for %v: %v", peer.Interface, time.Duration(*peer.MRAI))
+		}
+		if peer.OutQueueLimit < 0 {
+			return config, fmt.Errorf("invalid out_queue_limit for %v: %v", peer.Interface, peer.OutQueueLimit)
+		}
+		if peer.MaxPrefixWarning < 0 || peer.MaxPrefixWarning > 100 {
+			return config, fmt.Errorf("invalid max_prefix_warning for %v: %v", peer.Interface, peer.MaxPrefixWarning)
+		}
+		if peer.MD5Password != "" && peer.TCPAO != nil {
+			return config, fmt.Errorf("md5_password and tcp_ao cannot be used together for %v", peer.Interface)
+		}
+		if r := peer.RemoteASRange; r != nil && r.Min > r.Max {
+			return config, fmt.Errorf("invalid remote_as_range for %v: %v-%v", peer.Interface, r.Min, r.Max)
+		}
+		for _, name := range []string{peer.ImportPolicy, peer.ExportPolicy} {
+			if _, ok := routeMaps[name]; name != "" && !ok {
+				return config, fmt.Errorf("undefined route map for %v: %v", peer.Interface, name)
+			}
+		}
+	}
+	return config, nil
+}
+
+// ifnameに対する設定を返す. 設定がなければデフォルト値を返す
+func (c *Config) Peer(ifname string) PeerConfig {
+	conf := PeerConfig{Interface: ifname}
+	for _, peer := range c.Peers {
+		if peer.Interface == ifname {
+			conf = peer
+			break
+		}
+	}
+	return conf.withDefaults()
+}
+
+func (conf PeerConfig) withDefaults() PeerConfig {
+	if conf.MaxPrefixWarning == 0 {
+		conf.MaxPrefixWarning = DEFAULTMAXPREFIXWARNING
+	}
+	if conf.OutQueueLimit == 0 {
+		conf.OutQueueLimit = DEFAULTOUTQUEUELIMIT
+	}
+	if conf.SendHoldTime == 0 {
+		conf.SendHoldTime = DEFAULTSENDHOLDTIME
+	}
+	return conf
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"peers": [
+			{"interface": "veth-s1-l1-s", "max_prefix": 100, "max_prefix_restart": "30s", "mrai": "0s"}
+		]
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := config.Peer("veth-s1-l1-s")
+	if peer.MaxPrefix != 100 {
+		t.Errorf("invalid max_prefix: %v", peer.MaxPrefix)
+	}
+	if peer.MaxPrefixWarning != DEFAULTMAXPREFIXWARNING {
+		t.Errorf("invalid max_prefix_warning: %v", peer.MaxPrefixWarning)
+	}
+	if time.Duration(peer.MaxPrefixRestart) != 30*time.Second {
+		t.Errorf("invalid max_prefix_restart: %v", peer.MaxPrefixRestart)
+	}
+	if peer.MRAI == nil || *peer.MRAI != 0 {
+		t.Errorf("explicit mrai 0 should be kept: %v", peer.MRAI)
+	}
+	other := config.Peer("veth-s1-l2-s")
+	if other.Interface != "veth-s1-l2-s" || other.MaxPrefix != 0 {
+		t.Errorf("invalid default config: %+v", other)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"peers": [{"interface": "eth0", "max_prefix_warning": 150}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("max_prefix_warning over 100 should be rejected")
+	}
+}
+
+func TestDefaultMRAI(t *testing.T) {
+	thirty := Duration(30 * time.Second)
+	tests := []struct {
+		name   string
+		peerAS uint16
+		mrai   *Duration
+		want   time.Duration
+	}{
+		{name: "ebgp", peerAS: 65001, want: 0},
+		{name: "ibgp", peerAS: 65000, want: 5 * time.Second},
+		{name: "confederation", peerAS: 65010, want: 5 * time.Second},
+		{name: "explicit", peerAS: 65001, mrai: &thirty, want: 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Session{
+				LocalInfo: LocalInfo{AS: 65000, ConfedID: 64512, ConfedPeers: []uint16{65010}},
+				PeerAS:    tt.peerAS,
+				Config:    PeerConfig{MRAI: tt.mrai},
+			}
+			if got := s.mrai(); got != tt.want {
+				t.Errorf("mrai() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 経路フラップダンピング (RFC 2439) の設定
+// 閾値のデフォルト値はRFC 7196の推奨に従う
+type DampingConfig struct {
+	HalfLife        Duration `json:"half_life"`
+	Suppress        float64  `json:"suppress"`
+	Reuse           float64  `json:"reuse"`
+	MaxSuppressTime Duration `json:"max_suppress_time"`
+}
+
+const (
+	DEFAULTDAMPINGHALFLIFE    Duration = Duration(15 * time.Minute)
+	DEFAULTDAMPINGSUPPRESS    float64  = 6000
+	DEFAULTDAMPINGREUSE       float64  = 750
+	DEFAULTDAMPINGMAXSUPPRESS Duration = Duration(60 * time.Minute)
+)
+
+// フラップ1回あたりのペナルティ
+const (
+	WITHDRAWPENALTY   float64 = 1000
+	ATTRCHANGEPENALTY float64 = 500
+)
+
+// 抑制している経路を再利用できるか確認する間隔
+const DAMPINGREUSEINTERVAL time.Duration = time.Second
+
+func (c DampingConfig) withDefaults() DampingConfig {
+	if c.HalfLife == 0 {
+		c.HalfLife = DEFAULTDAMPINGHALFLIFE
+	}
+	if c.Suppress == 0 {
+		c.Suppress = DEFAULTDAMPINGSUPPRESS
+	}
+	if c.Reuse == 0 {
+		c.Reuse = DEFAULTDAMPINGREUSE
+	}
+	if c.MaxSuppressTime == 0 {
+		c.MaxSuppressTime = DEFAULTDAMPINGMAXSUPPRESS
+	}
+	return c
+}
+
+func (c DampingConfig) validate() error {
+	if c.HalfLife < 0 || c.MaxSuppressTime < 0 {
+		return fmt.Errorf("half_life and max_suppress_time must be positive")
+	}
+	if c.Reuse < 0 || c.Suppress < 0 {
+		return fmt.Errorf("suppress and reuse must be positive")
+	}
+	if c.Reuse >= c.Suppress {
+		return fmt.Errorf("reuse (%v) must be less than suppress (%v)", c.Reuse, c.Suppress)
+	}
+	return nil
+}
+
+// プレフィックスごとのフラップの履歴
+type dampingHistory struct {
+	penalty float64
+	updated time.Time
+	// 抑制していなければゼロ値
+	suppressedAt time.Time
+}
+
+// 1つのピアから受け取った経路のペナルティを管理する
+// セッションが張り直されても履歴が残るようにNeighborが持つ
+// シグナルハンドラから一覧を読むのでmutexで守る
+type Damper struct {
+	mu      sync.Mutex
+	config  DampingConfig
+	history map[netip.Prefix]*dampingHistory
+	now     func() time.Time
+}
+
+func NewDamper(config DampingConfig) *Damper {
+	return &Damper{
+		config:  config.withDefaults(),
+		history: make(map[netip.Prefix]*dampingHistory),
+		now:     time.Now,
+	}
+}
+
+// ペナルティの上限
+// これより大きくしてもmax_suppress_time以内にreuseまで下がらなくなるだけなので抑える
+func (d *Damper) ceiling() float64 {
+	return d.config.Reuse * math.Exp2(float64(d.config.MaxSuppressTime)/float64(d.config.HalfLife))
+}
+
+// 経過時間に応じて半減させた現在のペナルティ
+func (d *Damper) decay(h *dampingHistory, now time.Time) float64 {
+	elapsed := now.Sub(h.updated)
+	return h.penalty * math.Exp2(-float64(elapsed)/float64(d.config.HalfLife))
+}
+
+// フラップしたprefixにペナルティを加え、suppressを超えたら抑制する
+func (d *Damper) penalize(prefix netip.Prefix, penalty float64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	h, ok := d.history[prefix]
+	if !ok {
+		h = &dampingHistory{updated: now}
+		d.history[prefix] = h
+	}
+	h.penalty = math.Min(d.decay(h, now)+penalty, d.ceiling())
+	h.updated = now
+	if h.suppressedAt.IsZero() && h.penalty > d.config.Suppress {
+		h.suppressedAt = now
+	}
+}
+
+// prefixの経路を抑制しているかどうか
+func (d *Damper) Suppressed(prefix netip.Prefix) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.history[prefix]
+	return ok && !h.suppressedAt.IsZero()
+}
+
+// ペナルティがreuseまで下がったかmax_suppress_timeを過ぎた経路の抑制を解除する
+// 抑制を解除したAdj-RIB-Inの経路のプレフィックスを返す
+func (d *Damper) Reuse(R RibAdj) []netip.Prefix {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	reused := make([]netip.Prefix, 0)
+	for prefix, h := range d.history {
+		penalty := d.decay(h, now)
+		if h.suppressedAt.IsZero() {
+			// 十分小さくなった履歴は忘れる
+			if penalty < d.config.Reuse/2 {
+				delete(d.history, prefix)
+			}
+			continue
+		}
+		if penalty >= d.config.Reuse && now.Sub(h.suppressedAt) < time.Duration(d.config.MaxSuppressTime) {
+			continue
+		}
+		h.suppressedAt = time.Time{}
+		if entry, ok := R[prefix]; ok && entry.Suppressed {
+			entry.Suppressed = false
+			R[prefix] = entry
+			reused = append(reused, prefix)
+		}
+	}
+	return reused
+}
+
+// 表示用の抑制中の経路
+type DampedPrefix struct {
+	Prefix     netip.Prefix
+	Penalty    float64
+	Suppressed time.Duration
+}
+
+func (p DampedPrefix) String() string {
+	return fmt.Sprintf("%v penalty %.0f suppressed for %v", p.Prefix, p.Penalty, p.Suppressed.Truncate(time.Second))
+}
+
+// 抑制中の経路を現在のペナルティとともに返す
+func (d *Damper) Damped() []DampedPrefix {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	damped := make([]DampedPrefix, 0)
+	for prefix, h := range d.history {
+		if h.suppressedAt.IsZero() {
+			continue
+		}
+		damped = append(damped, DampedPrefix{
+			Prefix:     prefix,
+			Penalty:    d.decay(h, now),
+			Suppressed: now.Sub(h.suppressedAt),
+		})
+	}
+	sort.Slice(damped, func(i, j int) bool {
+		return damped[i].Prefix.String() < damped[j].Prefix.String()
+	})
+	return damped
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+func TestDamping(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := NewDamper(DampingConfig{
+		HalfLife:        Duration(time.Minute),
+		Suppress:        2500,
+		Reuse:           750,
+		MaxSuppressTime: Duration(10 * time.Minute),
+	})
+	d.now = func() time.Time { return now }
+
+	prefix := netip.MustParsePrefix("192.168.0.0/24")
+	announce := update.Update{
+		PathAttrOrigin:                      update.Origin(0),
+		PathAttrASPath:                      update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65001}}},
+		PathAttrNextHop:                     update.NEXT_HOP(netip.MustParseAddr("192.168.0.1")),
+		NetworkLayerReachabilityInformation: []netip.Prefix{prefix},
+	}
+	withdraw := update.Update{WithdrawnRoutes: []netip.Prefix{prefix}}
+	src := PathSource{PeerAS: 65001, PeerAddr: netip.MustParseAddr("192.168.0.1")}
+	local := LocalInfo{AS: 65000}
+
+	rib := RibAdj{}
+	// 3回フラップすると2500を超えて抑制される
+	for i := 0; i < 3; i++ {
+		rib.Update(announce, local, src, d)
+		rib.Update(withdraw, local, src, d)
+	}
+	rib.Update(announce, local, src, d)
+	entry, ok := rib[prefix]
+	if !ok || !entry.Suppressed {
+		t.Fatalf("flapping route should be kept in Adj-RIB-In and suppressed: %v", rib)
+	}
+	damped := d.Damped()
+	if len(damped) != 1 || damped[0].Prefix != prefix || damped[0].Penalty != 3000 {
+		t.Fatalf("Damped() = %v", damped)
+	}
+
+	L := LocRib{adjConnected: RibAdj{}, peers: []Peer{{RibAdjIn: rib}}}
+	L.updateBestPath()
+	if _, ok := L.adjBest[prefix]; ok {
+		t.Error("suppressed route should not be selected")
+	}
+
+	// 半減期1回では1500でまだreuseより大きい
+	now = now.Add(time.Minute)
+	if len(d.Reuse(rib)) != 0 || !rib[prefix].Suppressed {
+		t.Error("route should stay suppressed above the reuse threshold")
+	}
+	// 3000 -> 750より小さくなるので再利用される
+	now = now.Add(time.Minute + time.Second)
+	if reused := d.Reuse(rib); len(reused) != 1 || reused[0] != prefix || rib[prefix].Suppressed {
+		t.Error("route should be reused below the reuse threshold")
+	}
+	if len(d.Damped()) != 0 {
+		t.Errorf("no prefix should be damped: %v", d.Damped())
+	}
+}
+
+func TestDampingMaxSuppressTime(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := NewDamper(DampingConfig{
+		HalfLife:        Duration(time.Minute),
+		Suppress:        2000,
+		Reuse:           750,
+		MaxSuppressTime: Duration(2 * time.Minute),
+	})
+	d.now = func() time.Time { return now }
+	prefix := netip.MustParsePrefix("192.168.0.0/24")
+	for i := 0; i < 100; i++ {
+		d.penalize(prefix, WITHDRAWPENALTY)
+	}
+	if penalty := d.Damped()[0].Penalty; penalty != d.ceiling() {
+		t.Errorf("penalty should be capped at %v: %v", d.ceiling(), penalty)
+	}
+	now = now.Add(2 * time.Minute)
+	d.Reuse(RibAdj{})
+	if d.Suppressed(prefix) {
+		t.Error("route should be reused after max_suppress_time")
+	}
+}
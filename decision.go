@@ -0,0 +1,255 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+// 最良経路の選択の設定
+type BestPathConfig struct {
+	// 隣接ASが違う経路の間でもMEDを比べる
+	AlwaysCompareMED bool `json:"always_compare_med"`
+	// 全ての経路をまとめて比べる (RFC 4271 9.1.2.2). 指定しなければtrue
+	// falseなら古い経路から順に2つずつ比べるので、MEDの比較が経路の届いた順に依存する
+	DeterministicMED *bool `json:"deterministic_med"`
+	// FIBに入れる等コストの経路の最大数. 0か1ならマルチパスを使わない
+	MaximumPaths int `json:"maximum_paths"`
+	// AS_PATHの長さが同じなら隣接ASが違っても等コストとする (RFC 7938 6.3)
+	MultipathRelax bool `json:"as_path_multipath_relax"`
+}
+
+func (c BestPathConfig) deterministicMED() bool {
+	return c.DeterministicMED == nil || *c.DeterministicMED
+}
+
+// 最良経路が選ばれた理由. 候補が1つに絞られた段階を表す
+type BestPathReason string
+
+const (
+	REASONONLYPATH    BestPathReason = "only path"
+	REASONLOCALPREF   BestPathReason = "local-pref"
+	REASONLOCAL       BestPathReason = "locally originated"
+	REASONASPATH      BestPathReason = "as-path length"
+	REASONORIGIN      BestPathReason = "origin"
+	REASONMED         BestPathReason = "med"
+	REASONEBGP        BestPathReason = "ebgp over ibgp"
+	REASONIGPCOST     BestPathReason = "igp cost"
+	REASONOLDEST      BestPathReason = "oldest path"
+	REASONROUTERID    BestPathReason = "router-id"
+	REASONCLUSTERLIST BestPathReason = "cluster-list length"
+	REASONPEERADDR    BestPathReason = "peer address"
+)
+
+// 経路の比較. aが良ければ負, bが良ければ正, 決まらなければ0を返す
+type pathCompare func(a, b *RibAdjEntry) int
+
+type decisionStep struct {
+	reason  BestPathReason
+	compare pathCompare
+}
+
+type decision struct {
+	config BestPathConfig
+}
+
+func compareUint(a, b uint64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareBool(a, b bool) int {
+	if a == b {
+		return 0
+	} else if a {
+		return -1
+	}
+	return 1
+}
+
+// 経路を広告した隣接AS. AS内の経路は0
+// 経路ごとに何度も呼ばれるのでWithoutConfedで新しいAS_PATHを作らずに探す
+func (e RibAdjEntry) neighborAS() uint16 {
+	for _, segment := range e.AS_PATH {
+		if segment.VALUE_SEGMENT == update.VALUE_SEGMENT_AS_CONFED_SEQUENCE || segment.VALUE_SEGMENT == update.VALUE_SEGMENT_AS_CONFED_SET {
+			continue
+		}
+		if len(segment.AS_SEQUENCE) != 0 {
+			return segment.AS_SEQUENCE[0]
+		}
+	}
+	return 0
+}
+
+// AS外のピアから学習したか. コンフェデレーションの別のメンバーASはAS内として扱う (RFC 5065 5.3)
+func (e RibAdjEntry) external() bool {
+	return !e.Local() && !e.Source.IBGP && !e.Source.ConfedEBGP
+}
+
+// 比べる順に並べた段階
+func (d decision) steps() []decisionStep {
+	return []decisionStep{
+		{REASONLOCALPREF, func(a, b *RibAdjEntry) int {
+			return compareUint(uint64(b.LOCAL_PREF), uint64(a.LOCAL_PREF))
+		}},
+		{REASONLOCAL, func(a, b *RibAdjEntry) int {
+			return compareBool(a.Local(), b.Local())
+		}},
+		{REASONASPATH, func(a, b *RibAdjEntry) int {
+			return compareUint(uint64(a.AS_PATH.Length()), uint64(b.AS_PATH.Length()))
+		}},
+		{REASONORIGIN, func(a, b *RibAdjEntry) int {
+			return compareUint(uint64(a.ORIGIN), uint64(b.ORIGIN))
+		}},
+		// MEDは同じ隣接ASから来た経路の間でだけ比べる. MEDがなければ0とする
+		{REASONMED, func(a, b *RibAdjEntry) int {
+			if !d.config.AlwaysCompareMED && a.neighborAS() != b.neighborAS() {
+				return 0
+			}
+			return compareUint(uint64(a.MULTI_EXIT_DISC), uint64(b.MULTI_EXIT_DISC))
+		}},
+		{REASONEBGP, func(a, b *RibAdjEntry) int {
+			return compareBool(a.external(), b.external())
+		}},
+		{REASONIGPCOST, func(a, b *RibAdjEntry) int {
+			return compareUint(uint64(a.IGPCost), uint64(b.IGPCost))
+		}},
+		// eBGPの経路は安定している古い方を選ぶ
+		{REASONOLDEST, func(a, b *RibAdjEntry) int {
+			if !a.external() || !b.external() {
+				return 0
+			}
+			if a.Received.Before(b.Received) {
+				return -1
+			} else if b.Received.Before(a.Received) {
+				return 1
+			}
+			return 0
+		}},
+		{REASONROUTERID, func(a, b *RibAdjEntry) int {
+			return a.routerID().Compare(b.routerID())
+		}},
+		{REASONCLUSTERLIST, func(a, b *RibAdjEntry) int {
+			return compareUint(uint64(len(a.CLUSTER_LIST)), uint64(len(b.CLUSTER_LIST)))
+		}},
+		{REASONPEERADDR, func(a, b *RibAdjEntry) int {
+			return a.Source.PeerAddr.Compare(b.Source.PeerAddr)
+		}},
+	}
+}
+
+// 候補から最良経路を選び、選んだ理由と一緒に返す
+func (d decision) best(paths []RibAdjEntry) (RibAdjEntry, BestPathReason) {
+	if len(paths) == 1 {
+		return paths[0], REASONONLYPATH
+	}
+	if !d.config.deterministicMED() {
+		return d.bestPairwise(paths)
+	}
+	candidates := paths
+	var reason BestPathReason
+	for _, step := range d.steps() {
+		candidates = eliminate(candidates, step.compare)
+		if len(candidates) == 1 {
+			return candidates[0], step.reason
+		}
+		reason = step.reason
+	}
+	// 全ての段階で同じなら最初の候補を選ぶ
+	return candidates[0], reason
+}
+
+// 他のどれかより悪い候補を取り除く
+// MED以外の段階では最も良いものだけが残る
+// 多くの段階では何も取り除かれないので、その場合は新しいスライスを作らない
+func eliminate(candidates []RibAdjEntry, compare pathCompare) []RibAdjEntry {
+	var remaining []RibAdjEntry
+	eliminated := false
+	for i := range candidates {
+		worse := false
+		for j := range candidates {
+			if i != j && compare(&candidates[j], &candidates[i]) < 0 {
+				worse = true
+				break
+			}
+		}
+		if worse && !eliminated {
+			remaining = append(make([]RibAdjEntry, 0, len(candidates)-1), candidates[:i]...)
+			eliminated = true
+		} else if !worse && eliminated {
+			remaining = append(remaining, candidates[i])
+		}
+	}
+	if !eliminated {
+		return candidates
+	}
+	return remaining
+}
+
+// 古い経路から順に、それまでの最良経路と2つずつ比べる
+func (d decision) bestPairwise(paths []RibAdjEntry) (RibAdjEntry, BestPathReason) {
+	sorted := append([]RibAdjEntry{}, paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Received.Before(sorted[j].Received)
+	})
+	best := sorted[0]
+	var reason BestPathReason
+	for _, path := range sorted[1:] {
+		for _, step := range d.steps() {
+			c := step.compare(&path, &best)
+			if c == 0 {
+				continue
+			}
+			if c < 0 {
+				best = path
+			}
+			reason = step.reason
+			break
+		}
+	}
+	return best, reason
+}
+
+// IGPコストまでの段階で最良経路と並ぶ経路
+// マルチパスを緩めなければAS_PATHも同じものに限る
+func (d decision) equalCost(best, path RibAdjEntry) bool {
+	for _, step := range d.steps() {
+		if step.reason == REASONOLDEST {
+			break
+		}
+		if step.compare(&best, &path) != 0 {
+			return false
+		}
+	}
+	return d.config.MultipathRelax || reflect.DeepEqual(best.AS_PATH, path.AS_PATH)
+}
+
+// 最良経路と等コストでネクストホップが違う経路をMaximumPathsまで選ぶ
+// 先頭は最良経路で、残りはピアのアドレス順
+func (d decision) multipath(best RibAdjEntry, paths []RibAdjEntry) []RibAdjEntry {
+	multipaths := []RibAdjEntry{best}
+	if d.config.MaximumPaths <= 1 {
+		return multipaths
+	}
+	others := append([]RibAdjEntry{}, paths...)
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].Source.PeerAddr.Less(others[j].Source.PeerAddr)
+	})
+	nextHops := map[update.NEXT_HOP]bool{best.NEXT_HOP: true}
+	for _, path := range others {
+		if len(multipaths) >= d.config.MaximumPaths {
+			break
+		}
+		if nextHops[path.NEXT_HOP] || !d.equalCost(best, path) {
+			continue
+		}
+		nextHops[path.NEXT_HOP] = true
+		multipaths = append(multipaths, path)
+	}
+	return multipaths
+}
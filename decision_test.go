@@ -0,0 +1,314 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+func path(peer string, AS ...uint16) RibAdjEntry {
+	return RibAdjEntry{
+		AS_PATH:    update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: AS}},
+		NEXT_HOP:   update.NEXT_HOP(netip.MustParseAddr(peer)),
+		LOCAL_PREF: DEFAULTLOCALPREF,
+		Source: PathSource{
+			PeerAS:       AS[0],
+			PeerAddr:     netip.MustParseAddr(peer),
+			PeerRouterID: netip.MustParseAddr(peer),
+		},
+	}
+}
+
+func TestBestPath(t *testing.T) {
+	now := time.Now()
+	with := func(e RibAdjEntry, f func(*RibAdjEntry)) RibAdjEntry {
+		f(&e)
+		return e
+	}
+	connected := netip.MustParsePrefix("10.0.0.0/24")
+	igpCost := func(nextHop netip.Addr) uint32 {
+		if connected.Contains(nextHop) {
+			return 0
+		}
+		return 1
+	}
+	tests := []struct {
+		name       string
+		config     BestPathConfig
+		paths      []RibAdjEntry
+		wantPeer   string
+		wantReason BestPathReason
+	}{
+		{
+			name:       "only path",
+			paths:      []RibAdjEntry{path("10.0.0.1", 65001)},
+			wantPeer:   "10.0.0.1",
+			wantReason: REASONONLYPATH,
+		},
+		{
+			name: "local pref",
+			paths: []RibAdjEntry{
+				path("10.0.0.1", 65001),
+				with(path("10.0.0.2", 65002, 65003), func(e *RibAdjEntry) { e.LOCAL_PREF = 200 }),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONLOCALPREF,
+		},
+		{
+			name: "as path length",
+			paths: []RibAdjEntry{
+				path("10.0.0.1", 65001, 65003),
+				path("10.0.0.2", 65002),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONASPATH,
+		},
+		{
+			name: "origin",
+			paths: []RibAdjEntry{
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.ORIGIN = update.OriginINC }),
+				path("10.0.0.2", 65002),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONORIGIN,
+		},
+		{
+			name: "med from the same neighbor as",
+			paths: []RibAdjEntry{
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.MULTI_EXIT_DISC = 20 }),
+				with(path("10.0.0.2", 65001), func(e *RibAdjEntry) { e.MULTI_EXIT_DISC = 10 }),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONMED,
+		},
+		{
+			name: "med is not compared between different neighbor as",
+			paths: []RibAdjEntry{
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.MULTI_EXIT_DISC = 20 }),
+				with(path("10.0.0.2", 65002), func(e *RibAdjEntry) { e.MULTI_EXIT_DISC = 10 }),
+			},
+			wantPeer:   "10.0.0.1",
+			wantReason: REASONROUTERID,
+		},
+		{
+			name:   "always compare med",
+			config: BestPathConfig{AlwaysCompareMED: true},
+			paths: []RibAdjEntry{
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.MULTI_EXIT_DISC = 20 }),
+				with(path("10.0.0.2", 65002), func(e *RibAdjEntry) { e.MULTI_EXIT_DISC = 10 }),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONMED,
+		},
+		{
+			name: "ebgp over ibgp",
+			paths: []RibAdjEntry{
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.Source.IBGP = true }),
+				path("10.0.0.2", 65002),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONEBGP,
+		},
+		{
+			name: "igp cost",
+			paths: []RibAdjEntry{
+				with(path("10.1.0.1", 65001), func(e *RibAdjEntry) { e.Source.IBGP = true }),
+				with(path("10.0.0.2", 65002), func(e *RibAdjEntry) { e.Source.IBGP = true }),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONIGPCOST,
+		},
+		{
+			name: "oldest path",
+			paths: []RibAdjEntry{
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.Received = now }),
+				with(path("10.0.0.2", 65002), func(e *RibAdjEntry) { e.Received = now.Add(-time.Minute) }),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONOLDEST,
+		},
+		{
+			name: "originator id is used instead of router id",
+			paths: []RibAdjEntry{
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) {
+					e.Source.IBGP = true
+					e.ORIGINATOR_ID = update.ORIGINATOR_ID(netip.MustParseAddr("10.255.0.9"))
+				}),
+				with(path("10.0.0.2", 65002), func(e *RibAdjEntry) { e.Source.IBGP = true }),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONROUTERID,
+		},
+		{
+			name: "cluster list length",
+			paths: []RibAdjEntry{
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) {
+					e.Source.IBGP = true
+					e.ORIGINATOR_ID = update.ORIGINATOR_ID(netip.MustParseAddr("10.255.0.1"))
+					e.CLUSTER_LIST = update.CLUSTER_LIST{netip.MustParseAddr("10.255.1.1"), netip.MustParseAddr("10.255.1.2")}
+				}),
+				with(path("10.0.0.2", 65001), func(e *RibAdjEntry) {
+					e.Source.IBGP = true
+					e.ORIGINATOR_ID = update.ORIGINATOR_ID(netip.MustParseAddr("10.255.0.1"))
+					e.CLUSTER_LIST = update.CLUSTER_LIST{netip.MustParseAddr("10.255.1.3")}
+				}),
+			},
+			wantPeer:   "10.0.0.2",
+			wantReason: REASONCLUSTERLIST,
+		},
+		{
+			name: "peer address",
+			paths: []RibAdjEntry{
+				with(path("10.0.0.2", 65001), func(e *RibAdjEntry) { e.Source.PeerRouterID = netip.MustParseAddr("10.255.0.1") }),
+				with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.Source.PeerRouterID = netip.MustParseAddr("10.255.0.1") }),
+			},
+			wantPeer:   "10.0.0.1",
+			wantReason: REASONPEERADDR,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := decision{config: tt.config}
+			for i := range tt.paths {
+				tt.paths[i].IGPCost = igpCost(netip.Addr(tt.paths[i].NEXT_HOP))
+			}
+			// 候補の順番によらず同じ経路を選ぶ
+			for i := range tt.paths {
+				paths := append(append([]RibAdjEntry{}, tt.paths[i:]...), tt.paths[:i]...)
+				got, reason := d.best(paths)
+				if got.Source.PeerAddr != netip.MustParseAddr(tt.wantPeer) || reason != tt.wantReason {
+					t.Errorf("best() = %v (%v), want %v (%v)", got.Source.PeerAddr, reason, tt.wantPeer, tt.wantReason)
+				}
+			}
+		})
+	}
+}
+
+func TestDeterministicMED(t *testing.T) {
+	now := time.Now()
+	// b1とa2は隣接ASが違うのでMEDを比べず、a1とa2はMEDでa2が勝つ
+	a1 := path("10.0.0.1", 65001)
+	a1.MULTI_EXIT_DISC = 20
+	a1.Received = now.Add(-3 * time.Minute)
+	b1 := path("10.0.0.3", 65002)
+	b1.Received = now.Add(-2 * time.Minute)
+	a2 := path("10.0.0.2", 65001)
+	a2.MULTI_EXIT_DISC = 10
+	a2.Received = now.Add(-1 * time.Minute)
+	paths := []RibAdjEntry{a1, b1, a2}
+
+	// まとめて比べるとa1はMEDで落ち、残ったb1とa2では古いb1を選ぶ
+	got, reason := decision{}.best(paths)
+	if got.Source.PeerAddr != b1.Source.PeerAddr || reason != REASONOLDEST {
+		t.Errorf("deterministic med: best() = %v (%v)", got.Source.PeerAddr, reason)
+	}
+	// 古い順に比べるとa1がb1に勝ち、そのa1はa2にMEDで負ける
+	deterministic := false
+	got, reason = decision{config: BestPathConfig{DeterministicMED: &deterministic}}.best(paths)
+	if got.Source.PeerAddr != a2.Source.PeerAddr || reason != REASONMED {
+		t.Errorf("non-deterministic med: best() = %v (%v)", got.Source.PeerAddr, reason)
+	}
+}
+
+func TestUpdateBestPathKeepsConnected(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+	other := netip.MustParsePrefix("10.1.0.0/24")
+	connected := RibAdj{prefix: {LOCAL_PREF: DEFAULTLOCALPREF}}
+	L := LocRib{
+		adjConnected: connected,
+		peers:        []Peer{{RibAdjIn: RibAdj{prefix: path("10.0.0.2", 65002), other: path("10.0.0.2", 65002)}}},
+	}
+	L.updateBestPath()
+	if !L.adjBest[prefix].Local() || L.reasons[prefix] != REASONLOCAL {
+		t.Errorf("connected route should be preferred: %v (%v)", L.adjBest[prefix], L.reasons[prefix])
+	}
+	// ピアの経路が消えたら最良経路からも消え、接続している経路は変わらない
+	L.peers[0].RibAdjIn = RibAdj{}
+	L.updateBestPath()
+	if _, ok := L.adjBest[other]; ok {
+		t.Errorf("withdrawn route remains in the best paths")
+	}
+	if len(connected) != 1 {
+		t.Errorf("connected routes are modified: %v", connected)
+	}
+}
+
+// IGPコストは経路を入れたときと接続しているネットワークが変わったときに決める
+func TestIGPCost(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.2.0.0/24")
+	connected := RibAdj{netip.MustParsePrefix("10.0.0.0/24"): {Source: PathSource{Kind: LOCALCONNECTED}}}
+	L := LocRib{adjConnected: connected, peers: []Peer{{Status: &PeerStatus{}}, {Status: &PeerStatus{}}}}
+	near := path("10.0.0.2", 65002)
+	near.Source.IBGP = true
+	far := path("10.1.0.1", 65001)
+	far.Source.IBGP = true
+	L.apply(&L.peers[0], RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{prefix: &far}})
+	L.apply(&L.peers[1], RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{prefix: &near}})
+	if cost := L.peers[1].RibAdjIn[prefix].IGPCost; cost != 0 {
+		t.Errorf("igp cost of a connected next hop = %v, want 0", cost)
+	}
+	L.updateBestPath()
+	if L.adjBest[prefix].Source.PeerAddr != near.Source.PeerAddr || L.reasons[prefix] != REASONIGPCOST {
+		t.Errorf("best() = %v (%v)", L.adjBest[prefix].Source.PeerAddr, L.reasons[prefix])
+	}
+
+	// 接続しているネットワークがなくなれば決め直す
+	L.setLocalRoutes(RibAdj{})
+	if cost := L.peers[1].RibAdjIn[prefix].IGPCost; cost != 1 {
+		t.Errorf("igp cost after the network is gone = %v, want 1", cost)
+	}
+	if _, ok := L.dirty[prefix]; !ok {
+		t.Errorf("%v is not marked dirty", prefix)
+	}
+}
+
+func TestMultipath(t *testing.T) {
+	spine1 := path("10.0.0.1", 65001, 65100)
+	spine2 := path("10.0.1.1", 65002, 65100)
+	spine3 := path("10.0.2.1", 65001, 65100)
+	longer := path("10.0.3.1", 65003, 65004, 65100)
+	ibgp := path("10.0.4.1", 65001, 65100)
+	ibgp.Source.IBGP = true
+	paths := []RibAdjEntry{longer, ibgp, spine3, spine2, spine1}
+	tests := []struct {
+		name   string
+		config BestPathConfig
+		want   []string
+	}{
+		{
+			name: "disabled",
+			want: []string{"10.0.0.1"},
+		},
+		{
+			name:   "same as path",
+			config: BestPathConfig{MaximumPaths: 4},
+			want:   []string{"10.0.0.1", "10.0.2.1"},
+		},
+		{
+			name:   "multipath relax",
+			config: BestPathConfig{MaximumPaths: 4, MultipathRelax: true},
+			want:   []string{"10.0.0.1", "10.0.1.1", "10.0.2.1"},
+		},
+		{
+			name:   "maximum paths",
+			config: BestPathConfig{MaximumPaths: 2, MultipathRelax: true},
+			want:   []string{"10.0.0.1", "10.0.1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := decision{config: tt.config}
+			best, _ := d.best(paths)
+			got := make([]string, 0)
+			for _, path := range d.multipath(best, paths) {
+				got = append(got, path.Source.PeerAddr.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("multipath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// ダイナミックネイバーの設定
+// prefixesからの接続を受け付け、peer_groupの設定でセッションを作る
+type DynamicNeighborConfig struct {
+	Prefixes []netip.Prefix `json:"prefixes"`
+	// 同時に受け付けるセッション数の上限. 0なら無制限
+	Limit int `json:"limit"`
+	// セッションに適用する設定. interfaceは使わない
+	PeerGroup PeerConfig `json:"peer_group"`
+}
+
+func (c DynamicNeighborConfig) Contains(addr netip.Addr) bool {
+	for _, prefix := range c.Prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ifiのサブネットがダイナミックネイバーの範囲に含まれるかどうか
+func (c Config) dynamicIfi(ifi net.Interface) bool {
+	subnet, err := IfiToPrefix(ifi)
+	if err != nil {
+		return false
+	}
+	subnet = subnet.Masked()
+	for _, dynamic := range c.DynamicNeighbors {
+		for _, prefix := range dynamic.Prefixes {
+			if prefix.Bits() <= subnet.Bits() && prefix.Contains(subnet.Addr()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ダイナミックネイバーの待ち受けと、そこから作ったセッションの管理
+type DynamicNeighbors struct {
+	mu       sync.Mutex
+	local    LocalInfo
+	config   Config
+	sessions map[netip.Addr]int // ピアのアドレスと使っている設定の添字
+	counts   []int
+	// LocRibにピアの追加と削除を知らせる
+	addPeerCh chan<- Peer
+	delPeerCh chan<- Peer
+}
+
+func NewDynamicNeighbors(local LocalInfo, config Config, addPeerCh, delPeerCh chan<- Peer) *DynamicNeighbors {
+	return &DynamicNeighbors{
+		local:     local,
+		config:    config,
+		sessions:  make(map[netip.Addr]int),
+		counts:    make([]int, len(config.DynamicNeighbors)),
+		addPeerCh: addPeerCh,
+		delPeerCh: delPeerCh,
+	}
+}
+
+// 設定された範囲のアドレスファミリーごとに1つずつソケットを開いて待ち受ける
+func (d *DynamicNeighbors) Listen() error {
+	var v4, v6 bool
+	for _, dynamic := range d.config.DynamicNeighbors {
+		for _, prefix := range dynamic.Prefixes {
+			if prefix.Addr().Is4() {
+				v4 = true
+			} else {
+				v6 = true
+			}
+		}
+	}
+	listen := func(network, address string) error {
+		// 同じアドレスファミリーの範囲全てで共有するので、一番遠い範囲に合わせてGTSMを設定する
+		hops := make([]int, 0)
+		for _, dynamic := range d.config.DynamicNeighbors {
+			for _, prefix := range dynamic.Prefixes {
+				if prefix.Addr().Is4() == (network == "tcp4") {
+					hops = append(hops, dynamic.PeerGroup.withDefaults().listenerGTSMHops())
+				}
+			}
+		}
+		lc := net.ListenConfig{Control: shared_listen_control(hops)}
+		l, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %v: %v", address, err)
+		}
+		// 範囲ごとにpeer_groupの鍵を設定する
+		for _, dynamic := range d.config.DynamicNeighbors {
+			for _, prefix := range dynamic.Prefixes {
+				if prefix.Addr().Is4() != (network == "tcp4") {
+					continue
+				}
+				if err := set_listener_auth(l.(*net.TCPListener), dynamic.PeerGroup, prefix); err != nil {
+					l.Close()
+					return err
+				}
+			}
+		}
+		log.Printf("listening for dynamic neighbors on %v", l.Addr())
+		go d.serve(l)
+		return nil
+	}
+	if v4 {
+		if err := listen("tcp4", "0.0.0.0:179"); err != nil {
+			return err
+		}
+	}
+	if v6 {
+		if err := listen("tcp6", "[::]:179"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DynamicNeighbors) serve(l net.Listener) {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("failed to accept: %v", err)
+			return
+		}
+		d.accept(conn)
+	}
+}
+
+// 範囲に入っているピアならセッションを作る
+func (d *DynamicNeighbors) accept(conn net.Conn) {
+	addrport, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("invalid remote address: %v", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	remote := addrport.Addr().Unmap()
+	group, ok := d.register(remote)
+	if !ok {
+		conn.Close()
+		return
+	}
+	conf := d.config.DynamicNeighbors[group].PeerGroup.withDefaults()
+	if conf.TTLSecurity {
+		// 待ち受けるソケットは全ての範囲で共有していて一番遠い範囲に合わせているので、接続ごとに設定し直す
+		if err := set_conn_gtsm(conn.(*net.TCPConn), conf.gtsmHops()); err != nil {
+			log.Printf("failed to set GTSM for %v: %v", remote, err)
+			d.unregister(remote)
+			conn.Close()
+			return
+		}
+	}
+	localAddr, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+	ifi, err := ifi_by_addr(localAddr.Addr())
+	if err != nil {
+		log.Printf("failed to find the interface for %v: %v", remote, err)
+	}
+	n := NewNeighbor(ifi, PASSIVE, d.local, conf, d.config.Damping)
+	n.Conn = conn
+	n.Status.Name = fmt.Sprintf("dynamic %v", remote)
+	log.Printf("accepted dynamic neighbor %v on %v", remote, ifi.Name)
+
+	done := make(chan struct{})
+	peer := n.Peer(done)
+	d.addPeerCh <- peer
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := handle_bgp(ctx, cancel, n)
+		log.Printf("dynamic neighbor %v finished: %v", remote, err)
+		conn.Close()
+		close(done)
+		d.unregister(remote)
+		// 相手が再接続してくれば新しいセッションを作るので、ここでは削除するだけ
+		d.delPeerCh <- peer
+	}()
+}
+
+// 受け付けるかどうかを決めて記録する
+// 同じアドレスのセッションがすでにあるか上限に達していれば受け付けない
+func (d *DynamicNeighbors) register(remote netip.Addr) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.sessions[remote]; ok {
+		log.Printf("dynamic neighbor %v already has a session", remote)
+		return 0, false
+	}
+	for i, dynamic := range d.config.DynamicNeighbors {
+		if !dynamic.Contains(remote) {
+			continue
+		}
+		if dynamic.Limit != 0 && d.counts[i] >= dynamic.Limit {
+			log.Printf("rejected %v: dynamic neighbor limit %d reached", remote, dynamic.Limit)
+			return 0, false
+		}
+		d.sessions[remote] = i
+		d.counts[i]++
+		return i, true
+	}
+	log.Printf("rejected %v: not in any dynamic neighbor range", remote)
+	return 0, false
+}
+
+func (d *DynamicNeighbors) unregister(remote netip.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if i, ok := d.sessions[remote]; ok {
+		d.counts[i]--
+		delete(d.sessions, remote)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDynamicNeighborsRegister(t *testing.T) {
+	config := Config{
+		DynamicNeighbors: []DynamicNeighborConfig{
+			{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, Limit: 1},
+			{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")}},
+		},
+	}
+	d := NewDynamicNeighbors(LocalInfo{AS: 65000}, config, nil, nil)
+	tests := []struct {
+		name      string
+		remote    string
+		wantGroup int
+		wantOK    bool
+	}{
+		{name: "first_group", remote: "10.0.0.1", wantGroup: 0, wantOK: true},
+		{name: "duplicate", remote: "10.0.0.1", wantOK: false},
+		{name: "limit_reached", remote: "10.0.0.2", wantOK: false},
+		{name: "second_group", remote: "10.0.1.1", wantGroup: 1, wantOK: true},
+		{name: "out_of_range", remote: "192.168.0.1", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group, ok := d.register(netip.MustParseAddr(tt.remote))
+			if ok != tt.wantOK || ok && group != tt.wantGroup {
+				t.Errorf("register(%v) = %v, %v, want %v, %v", tt.remote, group, ok, tt.wantGroup, tt.wantOK)
+			}
+		})
+	}
+	d.unregister(netip.MustParseAddr("10.0.0.1"))
+	if group, ok := d.register(netip.MustParseAddr("10.0.0.2")); !ok || group != 0 {
+		t.Errorf("a session should be accepted after unregister: %v, %v", group, ok)
+	}
+}
+
+func TestAcceptAS(t *testing.T) {
+	tests := []struct {
+		name string
+		conf PeerConfig
+		AS   uint16
+		want bool
+	}{
+		{name: "any", conf: PeerConfig{}, AS: 65001, want: true},
+		{name: "remote_as", conf: PeerConfig{RemoteAS: 65001}, AS: 65002, want: false},
+		{name: "in_range", conf: PeerConfig{RemoteASRange: &ASRange{Min: 65100, Max: 65199}}, AS: 65150, want: true},
+		{name: "out_of_range", conf: PeerConfig{RemoteASRange: &ASRange{Min: 65100, Max: 65199}}, AS: 65200, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.conf.AcceptAS(tt.AS); got != tt.want {
+				t.Errorf("AcceptAS(%v) = %v, want %v", tt.AS, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/netip"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ネクストホップのない経路の種類
+const (
+	// 集約経路のように、より長い経路がなければ捨てる
+	ROUTEBLACKHOLE string = "blackhole"
+	// ROUTINGTABLEを引くのをやめて次のルール(mainテーブル)を引かせる
+	ROUTETHROW string = "throw"
+)
+
+// マルチパス経路のネクストホップ. 1つだけの経路ではWeightは0
+// Typeがあればネクストホップのない経路で、Addrは使わない
+type FIBNextHop struct {
+	Addr   netip.Addr
+	Weight int
+	Type   string
+}
+
+// ROUTINGTABLEに入れる経路. 複数のネクストホップがあればマルチパス経路にする
+type FIB map[netip.Prefix][]FIBNextHop
+
+func parse_route_prefix(s string) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(s)
+	if err == nil {
+		return prefix, true
+	}
+	// /32の経路はプレフィックス長なしで表示される
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// ip route show の出力から経路を読む
+// "10.0.0.0/24 via 192.168.0.1 dev eth0 proto ..." の形式と、
+// 次の行から "nexthop via 192.168.0.1 dev eth0 weight 1" が続くマルチパスの形式がある
+func parse_route_show(out string) FIB {
+	routes := make(FIB)
+	var current netip.Prefix
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "nexthop" {
+			if len(fields) < 3 || fields[1] != "via" || !current.IsValid() {
+				continue
+			}
+			addr, err := netip.ParseAddr(fields[2])
+			if err != nil {
+				continue
+			}
+			// weightが表示されなければ1
+			nextHop := FIBNextHop{Addr: addr, Weight: 1}
+			for i := 3; i+1 < len(fields); i++ {
+				if fields[i] == "weight" {
+					if weight, err := strconv.Atoi(fields[i+1]); err == nil {
+						nextHop.Weight = weight
+					}
+				}
+			}
+			routes[current] = append(routes[current], nextHop)
+			continue
+		}
+		current = netip.Prefix{}
+		if (fields[0] == ROUTEBLACKHOLE || fields[0] == ROUTETHROW) && len(fields) >= 2 {
+			if prefix, ok := parse_route_prefix(fields[1]); ok {
+				routes[prefix] = []FIBNextHop{{Type: fields[0]}}
+			}
+			continue
+		}
+		prefix, ok := parse_route_prefix(fields[0])
+		if !ok {
+			continue
+		}
+		if len(fields) >= 3 && fields[1] == "via" {
+			if addr, err := netip.ParseAddr(fields[2]); err == nil {
+				routes[prefix] = []FIBNextHop{{Addr: addr}}
+			}
+			continue
+		}
+		current = prefix
+	}
+	for _, nextHops := range routes {
+		sortNextHops(nextHops)
+	}
+	return routes
+}
+
+// 前回のプロセスが残したROUTINGTABLEの経路
+func read_routing_table() (FIB, error) {
+	out, err := exec.Command("ip", "route", "show", "table", ROUTINGTABLE).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parse_route_show(string(out)), nil
+}
+
+func sortNextHops(nextHops []FIBNextHop) {
+	sort.Slice(nextHops, func(i, j int) bool { return nextHops[i].Addr.Less(nextHops[j].Addr) })
+}
+
+func sameNextHops(a, b []FIBNextHop) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ip route replace に渡す引数
+func route_replace_args(prefix netip.Prefix, nextHops []FIBNextHop) []string {
+	if len(nextHops) == 1 && nextHops[0].Type != "" {
+		return []string{"route", "replace", nextHops[0].Type, prefix.String(), "table", ROUTINGTABLE}
+	}
+	args := []string{"route", "replace", prefix.String(), "table", ROUTINGTABLE}
+	if len(nextHops) == 1 {
+		return append(args, "via", nextHops[0].Addr.String())
+	}
+	for _, nextHop := range nextHops {
+		args = append(args, "nexthop", "via", nextHop.Addr.String(), "weight", strconv.Itoa(nextHop.Weight))
+	}
+	return args
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseRouteShow(t *testing.T) {
+	out := `10.0.0.0/24 via 192.168.0.1 dev eth0 proto static
+10.0.1.1 via 192.168.0.2 dev eth1
+10.0.2.0/24 proto static
+	nexthop via 192.168.1.1 dev eth1 weight 3
+	nexthop via 192.168.0.1 dev eth0
+192.168.0.0/24 dev eth0 scope link
+blackhole 10.1.0.0/16 proto static
+throw 10.255.0.1
+`
+	want := FIB{
+		netip.MustParsePrefix("10.0.0.0/24"): {{Addr: netip.MustParseAddr("192.168.0.1")}},
+		netip.MustParsePrefix("10.0.1.1/32"): {{Addr: netip.MustParseAddr("192.168.0.2")}},
+		netip.MustParsePrefix("10.0.2.0/24"): {
+			{Addr: netip.MustParseAddr("192.168.0.1"), Weight: 1},
+			{Addr: netip.MustParseAddr("192.168.1.1"), Weight: 3},
+		},
+		netip.MustParsePrefix("10.1.0.0/16"):   {{Type: ROUTEBLACKHOLE}},
+		netip.MustParsePrefix("10.255.0.1/32"): {{Type: ROUTETHROW}},
+	}
+	if got := parse_route_show(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parse_route_show() = %v, want %v", got, want)
+	}
+}
+
+func TestRouteReplaceArgs(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+	tests := []struct {
+		name     string
+		nextHops []FIBNextHop
+		want     []string
+	}{
+		{
+			name:     "single path",
+			nextHops: []FIBNextHop{{Addr: netip.MustParseAddr("192.168.0.1")}},
+			want:     []string{"route", "replace", "10.0.0.0/24", "table", ROUTINGTABLE, "via", "192.168.0.1"},
+		},
+		{
+			name:     "blackhole",
+			nextHops: []FIBNextHop{{Type: ROUTEBLACKHOLE}},
+			want:     []string{"route", "replace", "blackhole", "10.0.0.0/24", "table", ROUTINGTABLE},
+		},
+		{
+			name: "multipath",
+			nextHops: []FIBNextHop{
+				{Addr: netip.MustParseAddr("192.168.0.1"), Weight: 1},
+				{Addr: netip.MustParseAddr("192.168.1.1"), Weight: 4},
+			},
+			want: []string{"route", "replace", "10.0.0.0/24", "table", ROUTINGTABLE,
+				"nexthop", "via", "192.168.0.1", "weight", "1", "nexthop", "via", "192.168.1.1", "weight", "4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := route_replace_args(prefix, tt.nextHops); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("route_replace_args() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,13 +2,16 @@ module github.com/81ueman/local-clos
 
 go 1.21.3
 
+require (
+	github.com/mdlayher/arp v0.0.0-20220512170110-6706a2966875
+	golang.org/x/sys v0.0.0-20220209214540-3681064d5158
+)
+
 require (
 	github.com/josharian/native v1.0.0 // indirect
-	github.com/mdlayher/arp v0.0.0-20220512170110-6706a2966875 // indirect
 	github.com/mdlayher/ethernet v0.0.0-20220221185849-529eae5b6118 // indirect
 	github.com/mdlayher/packet v1.0.0 // indirect
 	github.com/mdlayher/socket v0.2.1 // indirect
 	golang.org/x/net v0.0.0-20190603091049-60506f45cf65 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
-	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
 )
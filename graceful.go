@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"time"
+
+	"github.com/81ueman/local-clos/message/open"
+	"github.com/81ueman/local-clos/message/update"
+)
+
+// Graceful Restart (RFC 4724) の設定
+type GracefulRestartConfig struct {
+	// ピアにこの時間以内に再接続すると伝える
+	RestartTime Duration `json:"restart_time"`
+	// 再接続したピアからEnd-of-RIBが届くまでstaleな経路を残しておく最大時間
+	StalePathTime Duration `json:"stale_path_time"`
+	// 再起動の間もROUTINGTABLEの経路を残して転送を続ける
+	ForwardingState bool `json:"forwarding_state"`
+}
+
+const (
+	DEFAULTRESTARTTIME   Duration = Duration(120 * time.Second)
+	DEFAULTSTALEPATHTIME Duration = Duration(360 * time.Second)
+)
+
+// 再接続を試みるまでの時間
+const CONNECTRETRYTIME time.Duration = 5 * time.Second
+
+func (c GracefulRestartConfig) withDefaults() GracefulRestartConfig {
+	if c.RestartTime == 0 {
+		c.RestartTime = DEFAULTRESTARTTIME
+	}
+	if c.StalePathTime == 0 {
+		c.StalePathTime = DEFAULTSTALEPATHTIME
+	}
+	return c
+}
+
+func (c GracefulRestartConfig) validate() error {
+	if c.RestartTime < 0 || time.Duration(c.RestartTime) > time.Duration(open.MaxRestartTime)*time.Second {
+		return fmt.Errorf("restart_time must be between 0 and %vs", open.MaxRestartTime)
+	}
+	if c.StalePathTime < 0 {
+		return fmt.Errorf("invalid stale_path_time: %v", time.Duration(c.StalePathTime))
+	}
+	return nil
+}
+
+// プロセス全体のGraceful Restartの状態
+type GracefulRestartState struct {
+	Config GracefulRestartConfig
+	// 転送状態を残したまま再起動したところか
+	Restarting bool
+	StartedAt  time.Time
+}
+
+// OPENで送るGraceful Restart Capability
+// 再起動してからRestartTimeの間はRestart Stateを立てる
+func (g *GracefulRestartState) Capability() open.Capability {
+	return open.GracefulRestart{
+		Restarting:  g.Restarting && time.Since(g.StartedAt) < time.Duration(g.Config.RestartTime),
+		RestartTime: uint16(time.Duration(g.Config.RestartTime) / time.Second),
+		Families: []open.GracefulRestartFamily{
+			{AFI: update.AFIIPv4, SAFI: update.SAFIUnicast, ForwardingState: g.Config.ForwardingState},
+		},
+	}.Capability()
+}
+
+// 両方がGraceful Restart Capabilityを送ったかどうか
+func (s *Session) grNegotiated() bool {
+	return s.GR != nil && s.PeerGR != nil
+}
+
+// 切れたセッションの経路をstaleとして残す
+func (R RibAdj) markStale() RibAdj {
+	stale := make(RibAdj)
+	for prefix, entry := range R {
+		entry.Stale = true
+		stale[prefix] = entry
+	}
+	return stale
+}
+
+// End-of-RIBかstale path timerの満了で、再接続後に更新されなかった経路を消す
+// 消したプレフィックスを返す
+func (R RibAdj) deleteStale() []netip.Prefix {
+	deleted := make([]netip.Prefix, 0)
+	for prefix, entry := range R {
+		if entry.Stale {
+			delete(R, prefix)
+			deleted = append(deleted, prefix)
+		}
+	}
+	return deleted
+}
+
+// 再起動中のピアの経路を残す (helper)
+// LocRibには取り消しを送らないので経路はそのまま使われ続ける
+// 新しいセッションがrestartの間に取りに来なければ取り消す
+func (n *Neighbor) keepStale(stale RibAdj, restart time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stale = stale
+	n.staleGen++
+	gen := n.staleGen
+	log.Printf("%v: keeping %d routes as stale for %v", n.Status.Name, len(stale), restart)
+	time.AfterFunc(restart, func() {
+		n.mu.Lock()
+		if n.stale == nil || n.staleGen != gen {
+			n.mu.Unlock()
+			return
+		}
+		log.Printf("%v: restart timer expired. deleting stale routes", n.Status.Name)
+		n.stale = nil
+		// 新しいセッションの経路より後に届かないよう、送り終わるまでtakeStaleに待たせる
+		resetting := make(chan struct{})
+		n.resetting = resetting
+		n.mu.Unlock()
+		defer close(resetting)
+		// ロックを持ったまま送るとLocRibが受け取らないときに止まる
+		select {
+		case n.RibAdjInCh <- RibDelta{Reset: true}:
+		case <-n.done:
+		}
+	})
+}
+
+// 新しいセッションがstaleな経路を引き継ぐ
+func (n *Neighbor) takeStale() RibAdj {
+	n.mu.Lock()
+	stale := n.stale
+	n.stale = nil
+	resetting := n.resetting
+	n.mu.Unlock()
+	if resetting != nil {
+		select {
+		case <-resetting:
+		case <-n.done:
+		}
+	}
+	return stale
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/81ueman/local-clos/message/open"
+	"github.com/81ueman/local-clos/message/update"
+)
+
+func TestStale(t *testing.T) {
+	kept := netip.MustParsePrefix("10.0.0.0/24")
+	gone := netip.MustParsePrefix("10.0.1.0/24")
+	R := RibAdj{kept: {LOCAL_PREF: 100}, gone: {LOCAL_PREF: 100}}
+	stale := R.markStale()
+	if R[kept].Stale {
+		t.Fatal("markStale should not modify the original RibAdj")
+	}
+	if !stale[kept].Stale || !stale[gone].Stale {
+		t.Fatalf("routes are not marked as stale: %v", stale)
+	}
+	// 再接続後に広告し直された経路は残る
+	entry := stale[kept]
+	entry.Stale = false
+	stale[kept] = entry
+	if deleted := stale.deleteStale(); len(deleted) != 1 || deleted[0] != gone {
+		t.Errorf("deleteStale() = %v, want [%v]", deleted, gone)
+	}
+	if _, ok := stale[kept]; !ok {
+		t.Error("refreshed route is deleted")
+	}
+	if _, ok := stale[gone]; ok {
+		t.Error("stale route is not deleted")
+	}
+}
+
+func TestGracefulRestartCapability(t *testing.T) {
+	gr := &GracefulRestartState{
+		Config:     GracefulRestartConfig{RestartTime: Duration(120 * time.Second), ForwardingState: true},
+		Restarting: true,
+		StartedAt:  time.Now(),
+	}
+	got, err := open.ParseGracefulRestart(gr.Capability())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Restarting || got.RestartTime != 120 || !got.ForwardingState(1, 1) {
+		t.Errorf("invalid capability: %+v", got)
+	}
+	// restart timeを過ぎたらRestart Stateを下ろす
+	gr.StartedAt = time.Now().Add(-121 * time.Second)
+	got, _ = open.ParseGracefulRestart(gr.Capability())
+	if got.Restarting {
+		t.Errorf("restart state should be cleared after restart time: %+v", got)
+	}
+}
+
+func TestGracefulRestartConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  GracefulRestartConfig
+		wantErr bool
+	}{
+		{name: "default", config: GracefulRestartConfig{}.withDefaults()},
+		{name: "max restart time", config: GracefulRestartConfig{RestartTime: Duration(4095 * time.Second)}},
+		{name: "too long restart time", config: GracefulRestartConfig{RestartTime: Duration(4096 * time.Second)}, wantErr: true},
+		{name: "negative stale path time", config: GracefulRestartConfig{StalePathTime: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpdateRefreshesStale(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+	msg := update.Update{
+		PathAttrASPath:                      update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65001}}},
+		PathAttrNextHop:                     update.NEXT_HOP(netip.MustParseAddr("192.168.0.1")),
+		NetworkLayerReachabilityInformation: []netip.Prefix{prefix},
+	}
+	src := PathSource{PeerAS: 65001, PeerAddr: netip.MustParseAddr("192.168.0.1")}
+	R := RibAdj{}
+	R.Update(msg, LocalInfo{AS: 65000}, src, nil)
+	received := R[prefix].Received
+	R = R.markStale()
+	// 同じ経路が届いたらstaleでなくなり、受け取った時刻は変わらない
+	// LocRibから見た経路は変わらないので変更としては返さない
+	if changed := R.Update(msg, LocalInfo{AS: 65000}, src, nil); len(changed) != 0 {
+		t.Errorf("refreshed route is reported as changed: %v", changed)
+	}
+	if R[prefix].Stale || !R[prefix].Received.Equal(received) {
+		t.Errorf("refreshed route: %+v", R[prefix])
+	}
+	if len(R.deleteStale()) != 0 {
+		t.Errorf("refreshed route is deleted")
+	}
+}
+
+// restart timerは取り消しを送る間ロックを持たず、新しいセッションは送り終わるまで待つ
+func TestKeepStaleExpire(t *testing.T) {
+	n := &Neighbor{RibAdjInCh: make(chan RibDelta), Status: &PeerStatus{}}
+	done := make(chan struct{})
+	n.Peer(done)
+	n.keepStale(RibAdj{netip.MustParsePrefix("10.0.0.0/24"): {}}, time.Millisecond)
+	for n.hasStale() {
+		time.Sleep(time.Millisecond)
+	}
+	taken := make(chan RibAdj)
+	go func() {
+		taken <- n.takeStale()
+	}()
+	select {
+	case <-taken:
+		t.Fatal("takeStale returned before the reset is sent")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if delta := <-n.RibAdjInCh; !delta.Reset {
+		t.Errorf("expected reset: %+v", delta)
+	}
+	if stale := <-taken; stale != nil {
+		t.Errorf("takeStale() = %v, want nil", stale)
+	}
+
+	// LocRibが受け取らなくてもピアが終われば止まらない
+	n.keepStale(RibAdj{}, time.Millisecond)
+	for n.hasStale() {
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	if stale := n.takeStale(); stale != nil {
+		t.Errorf("takeStale() = %v, want nil", stale)
+	}
+}
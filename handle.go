@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"time"
 
 	"github.com/81ueman/local-clos/message"
 	"github.com/81ueman/local-clos/message/keepalive"
+	notifiacation "github.com/81ueman/local-clos/message/notification"
 	"github.com/81ueman/local-clos/message/open"
 	"github.com/81ueman/local-clos/message/update"
 )
@@ -17,6 +21,13 @@ func (s *Session) receiveMessage() {
 		msg, err := message.UnMarshal(s.Conn)
 		if err != nil {
 			log.Printf("failed to UnMarshal: %v", err)
+			if errors.Is(err, update.ErrMalformedAttributeList) {
+				notification := notifiacation.New(notifiacation.ErrorCodeUpdateMessage, notifiacation.UpdateErrorMalformedAttributeList, nil)
+				if err := s.send(notification); err != nil {
+					log.Printf("failed to send notification: %v", err)
+				}
+				s.Status.SetLastError(err.Error())
+			}
 			s.Cancel()
 			return
 		}
@@ -25,16 +36,78 @@ func (s *Session) receiveMessage() {
 	}
 }
 
+// OpenSent以降であればCease NOTIFICATIONを送ってからセッションを閉じる
+func (s *Session) Shutdown(communication string) {
+	log.Printf("shutting down session on %v: %v", s.Ifi.Name, communication)
+	if s.Conn != nil {
+		if s.State == OpenSent || s.State == OpenConfirm || s.State == Established {
+			notification := notifiacation.NewShutdown(notifiacation.CeaseAdministrativeShutdown, communication)
+			err := s.send(notification)
+			if err != nil {
+				log.Printf("failed to send notification: %v", err)
+			}
+		}
+		s.Conn.Close()
+	}
+	s.Err = errShutdown
+	s.Cancel()
+}
+
+// 受け取った経路数がmax-prefixを超えていたらCeaseを送って切断する
+// 切断した場合はtrueを返す
+func (s *Session) checkMaxPrefix() bool {
+	limit := s.Config.MaxPrefix
+	if limit == 0 {
+		return false
+	}
+	count := s.PrefixCount()
+	if count > limit {
+		log.Printf("%v: max-prefix %d exceeded: %d prefixes", s.Ifi.Name, limit, count)
+		notification := notifiacation.NewMaxPrefix(update.AFIIPv4, update.SAFIUnicast, uint32(limit))
+		err := s.send(notification)
+		if err != nil {
+			log.Printf("failed to send notification: %v", err)
+		}
+		s.Conn.Close()
+		s.Status.SetLastError(fmt.Sprintf("max-prefix %d exceeded", limit))
+		s.Err = errMaxPrefix
+		s.Cancel()
+		return true
+	}
+	if !s.maxPrefixWarned && count*100 >= limit*s.Config.MaxPrefixWarning {
+		log.Printf("%v: received %d prefixes, %d%% of max-prefix %d", s.Ifi.Name, count, s.Config.MaxPrefixWarning, limit)
+		s.maxPrefixWarned = true
+	}
+	return false
+}
+
 func (s *Session) Idle() {
 	var conn net.Conn
 	var err error
-	if s.ActiveMode {
-		conn, err = start_tcp(s.Ifi)
+	counters := tcp_auth_counters()
+	if s.Conn != nil {
+		// ダイナミックネイバーとして受け付けた接続
+		conn = s.Conn
+	} else if s.Config.Address.IsValid() {
+		conn, err = s.connectAddr()
+	} else if s.ActiveMode {
+		conn, err = start_tcp(s.Ifi, s.Config)
 	} else {
-		conn, err = wait_tcp(s.Ifi)
+		conn, err = wait_tcp(s.Ifi, s.Config)
+	}
+	if err == errShutdown {
+		// Shutdownで終わらせている
+		return
 	}
 	if err != nil {
 		log.Printf("failed to handle tcp connection: %v", err)
+		lastError := fmt.Sprintf("tcp connection failed: %v", err)
+		if auth := s.Config.Auth(); auth != "" {
+			if failures := auth_failures(counters, tcp_auth_counters()); failures != "" {
+				lastError = fmt.Sprintf("%s authentication failed? %s (%s)", auth, failures, lastError)
+			}
+		}
+		s.Status.SetLastError(lastError)
 		s.Cancel()
 		s.Events <- TcpConnectionFails
 		return
@@ -51,12 +124,19 @@ func (s *Session) Idle() {
 	}
 }
 
+func (s *Session) openMsg() *open.Open {
+	open_msg := open.New(4, s.openAS(), 180, routerIDToUint32(s.RouterID))
+	if s.GR != nil {
+		open_msg.Capabilities = append(open_msg.Capabilities, s.GR.Capability())
+	}
+	return open_msg
+}
+
 func (s *Session) Connect() {
 	event := <-s.Events
 	switch event {
 	case Tcp_CR_Acked:
-		open_msg := open.New(4, s.AS, 180, 0)
-		err := message.Send_message(s.Conn, open_msg)
+		err := s.send(s.openMsg())
 		if err != nil {
 			s.Cancel()
 			log.Printf("failed to write: %v", err)
@@ -76,8 +156,7 @@ func (s *Session) Active() {
 	event := <-s.Events
 	switch event {
 	case Tcp_CR_Acked:
-		open_msg := open.New(4, 65000, 180, 0)
-		err := message.Send_message(s.Conn, open_msg)
+		err := s.send(s.openMsg())
 		if err != nil {
 			log.Fatalf("failed to send message: %v", err)
 		}
@@ -93,7 +172,13 @@ func (s *Session) Active() {
 
 func (s *Session) OpenSent() {
 	log.Println("s conn: ", s.Conn.RemoteAddr().String())
-	msg := <-s.MsgCh
+	var msg message.Message
+	select {
+	case msg = <-s.MsgCh:
+	case communication := <-s.ShutdownCh:
+		s.Shutdown(communication)
+		return
+	}
 	msgtype, err := message.Type(msg)
 	if err != nil {
 		log.Printf("failed to get type: %v", err)
@@ -101,6 +186,41 @@ func (s *Session) OpenSent() {
 	}
 	if msgtype != message.MsgTypeOpen {
 		log.Printf("expected an open message, but got: %v", msgtype)
+	} else {
+		open_msg := msg.(*open.Open)
+		s.PeerRouterID = uint32ToRouterID(open_msg.Id)
+		if s.PeerRouterID == s.RouterID {
+			log.Printf("peer has the same router-id as ours: %v", s.PeerRouterID)
+			notification := notifiacation.New(notifiacation.ErrorCodeOpenMessage, notifiacation.OpenErrorBadBGPIdentifier, nil)
+			if err := s.send(notification); err != nil {
+				log.Printf("failed to send notification: %v", err)
+			}
+			s.Status.SetLastError(fmt.Sprintf("bad BGP identifier %v", s.PeerRouterID))
+			s.Conn.Close()
+			s.Cancel()
+			return
+		}
+		s.PeerAS = open_msg.AS
+		if !s.Config.AcceptAS(s.PeerAS) {
+			log.Printf("peer AS %v is not accepted by the config", s.PeerAS)
+			notification := notifiacation.New(notifiacation.ErrorCodeOpenMessage, notifiacation.OpenErrorBadPeerAS, nil)
+			if err := s.send(notification); err != nil {
+				log.Printf("failed to send notification: %v", err)
+			}
+			s.Status.SetLastError(fmt.Sprintf("bad peer AS %v", s.PeerAS))
+			s.Conn.Close()
+			s.Cancel()
+			return
+		}
+		if addrport, err := netip.ParseAddrPort(s.Conn.RemoteAddr().String()); err == nil {
+			s.PeerAddr = addrport.Addr()
+		}
+		if gr, ok := open_msg.GracefulRestart(); ok {
+			log.Printf("peer supports graceful restart: %+v", gr)
+			s.PeerGR = &gr
+		}
+		s.Status.SetPeer(s.PeerAS, s.PeerRouterID, s.IBGP())
+		log.Printf("peer AS %v (ibgp: %v)", s.PeerAS, s.IBGP())
 	}
 	log.Printf("msg: %v", msg)
 	s.State = OpenConfirm
@@ -108,13 +228,19 @@ func (s *Session) OpenSent() {
 
 func (s *Session) OpenConfirm() {
 	keepalive := keepalive.New()
-	err := message.Send_message(s.Conn, keepalive)
+	err := s.send(keepalive)
 	if err != nil {
 		log.Fatalf("failed to write: %v", err)
 		s.Cancel()
 		return
 	}
-	msg := <-s.MsgCh
+	var msg message.Message
+	select {
+	case msg = <-s.MsgCh:
+	case communication := <-s.ShutdownCh:
+		s.Shutdown(communication)
+		return
+	}
 	msgtype, err := message.Type(msg)
 	if err != nil {
 		log.Printf("failed to get type: %v", err)
@@ -127,34 +253,186 @@ func (s *Session) OpenConfirm() {
 		return
 	}
 	log.Printf("msg: %v", msg)
-	s.AdjRibCh <- s.AdjRIBsIn
+	s.takeStale()
+	s.LinkBandwidth = s.linkBandwidth()
+	// 前のセッションの間にたまった変更は捨て、このセッション向けのAdj-RIB-Outを作ってもらう
+	s.LocRibQueue.Clear()
+	target := s.exportTarget()
+	s.AdjRibCh <- RibDelta{Request: true, Target: &target}
+	s.OutQueue = NewOutQueue(s.Config.OutQueueLimit)
+	go s.writer()
 	s.State = Established
 }
 
-func (s *Session) Established() {
-	select {
-	case locrib := <-s.LocRibCh:
-		log.Println("locrib")
-		log.Print(locrib)
-		//compare locrib with adjribout and send update message
-		msgs := locrib.ToUpdateMsg(s.AdjRIBsOut, s.NetipAddr)
-		s.AdjRIBsOut = make(RibAdj)
-		for k, v := range locrib {
-			s.AdjRIBsOut[k] = v
-		}
-		if len(msgs) == 0 {
-			log.Printf("no update message")
-		} else {
-			log.Printf("updated adjribout: %v", s.AdjRIBsOut)
-			for _, msg := range msgs {
-				err := message.Send_message(s.Conn, &msg) //TODO:pointerなの変だな
-				if err != nil {
-					log.Printf("failed to write: %v", err)
-					s.Cancel()
+// 前のセッションの経路を引き継ぐ (Graceful Restart helper)
+// ピアが転送状態を保持していなければすぐに消す
+func (s *Session) takeStale() {
+	if s.neighbor == nil {
+		return
+	}
+	stale := s.neighbor.takeStale()
+	if stale == nil {
+		return
+	}
+	if !s.grNegotiated() || !s.PeerGR.ForwardingState(update.AFIIPv4, update.SAFIUnicast) {
+		log.Printf("%v: peer did not preserve forwarding state. deleting stale routes", s.Ifi.Name)
+		s.AdjRibCh <- RibDelta{Reset: true}
+		return
+	}
+	s.AdjRIBsIn = stale
+	s.StaleTimer = time.After(time.Duration(s.GR.Config.StalePathTime))
+}
+
+// End-of-RIBを受け取ったら最初の経路を受け取り終わったとし、更新されなかったstaleな経路を消す
+func (s *Session) receiveEndOfRIB(afi uint16, safi uint8) {
+	log.Printf("%v: received End-of-RIB for afi %v safi %v", s.Ifi.Name, afi, safi)
+	if afi != update.AFIIPv4 || safi != update.SAFIUnicast {
+		return
+	}
+	deleted := s.AdjRIBsIn.deleteStale()
+	if len(deleted) != 0 {
+		log.Printf("%v: deleted %d stale routes", s.Ifi.Name, len(deleted))
+	}
+	s.StaleTimer = nil
+	s.Status.SetSynced(true)
+	s.Status.SetPrefixCount(s.PrefixCount())
+	// 消した経路がなくても送り、FIBの更新を待っているLocRibに知らせる
+	s.AdjRibCh <- s.AdjRIBsIn.delta(deleted)
+}
+
+// Established中にOutQueueから変更を取り出してUPDATEを送る
+// 遅いピアの書き込み待ちが他のピアやLocRibを止めないように別のgoroutineで動かす
+// 一度送ったらMRAIが経つまで次の変更はキューの中でまとめておく
+func (s *Session) writer() {
+	defer s.OutQueue.Close()
+	mrai := s.mrai()
+	log.Printf("%v: MinRouteAdvertisementInterval %v", s.Ifi.Name, mrai)
+	var mraiTimer <-chan time.Time
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return
+		case <-s.OutQueue.notify:
+			if mraiTimer != nil {
+				// withdrawはMRAIを待たずに送る設定
+				if s.Config.MRAIWithdrawExempt {
+					withdraw := s.OutQueue.PopWithdrawn()
+					if !s.flush(RibAdj{}, withdraw) {
+						return
+					}
+				}
+				if !s.sendEndOfRIB() {
 					return
 				}
+				continue
+			}
+		case <-mraiTimer:
+			mraiTimer = nil
+			if s.OutQueue.Len() == 0 {
+				continue
 			}
 		}
+		announce, withdraw := s.OutQueue.Pop()
+		if !s.flush(announce, withdraw) {
+			return
+		}
+		if !s.sendEndOfRIB() {
+			return
+		}
+		if mrai > 0 {
+			mraiTimer = time.After(mrai)
+		}
+	}
+}
+
+// 最初の経路を送り終わっていればEnd-of-RIBを送る. セッションを切断した場合はfalseを返す
+func (s *Session) sendEndOfRIB() bool {
+	if !s.OutQueue.PopEndOfRIB() {
+		return true
+	}
+	for _, family := range FAMILIES {
+		log.Printf("%v: sending End-of-RIB for afi %v safi %v", s.Ifi.Name, family.AFI, family.SAFI)
+		if err := s.send(update.NewEndOfRIB(family.AFI, family.SAFI)); err != nil {
+			log.Printf("failed to write: %v", err)
+			s.Cancel()
+			return false
+		}
+	}
+	return true
+}
+
+// 変更をUPDATEにして書き込む. セッションを切断した場合はfalseを返す
+func (s *Session) flush(announce RibAdj, withdraw []netip.Prefix) bool {
+	s.Status.SetQueueDepth(s.OutQueue.Len())
+	if len(announce) == 0 && len(withdraw) == 0 {
+		return true
+	}
+	msgs := updateMsgs(announce, withdraw, s.exportTarget().Internal())
+	for _, msg := range msgs {
+		err := s.send(&msg) //TODO:pointerなの変だな
+		if err == errSendHoldTimer {
+			log.Printf("%v: send hold timer expired", s.Ifi.Name)
+			s.Status.SetLastError("send hold timer expired")
+			s.Conn.Close()
+			s.Cancel()
+			return false
+		}
+		if err != nil {
+			log.Printf("failed to write: %v", err)
+			s.Cancel()
+			return false
+		}
+	}
+	return true
+}
+
+// LocRibQueueからOutQueueに空きがある分だけ変更を移す
+// OutQueueが上限に達しても待たずに残りはLocRibQueueに置いておき、writerが取り出して空きができてから移す
+// ここで待つとMsgChも読めなくなり、互いに書き込めないピア同士が止まってしまう
+func (s *Session) pullChanges() {
+	announce, withdraw := s.LocRibQueue.PopN(s.OutQueue.Room())
+	s.queueChanges(announce, withdraw)
+	// 最初のLoc-RIBを全て移したらEnd-of-RIBを送って、送り終わったことを知らせる
+	if s.LocRibQueue.PopEndOfRIB() {
+		s.OutQueue.PushEndOfRIB()
+	}
+}
+
+// LocRibがAdj-RIB-Outと比べて決めた広告の変更をwriterに渡す
+func (s *Session) queueChanges(announce RibAdj, withdraw []netip.Prefix) {
+	for prefix, entry := range announce {
+		entry := entry
+		if err := s.OutQueue.Push(prefix, &entry); err != nil {
+			return
+		}
+	}
+	for _, prefix := range withdraw {
+		if err := s.OutQueue.Push(prefix, nil); err != nil {
+			return
+		}
+	}
+	s.Status.SetQueueDepth(s.OutQueue.Len())
+}
+
+func (s *Session) Established() {
+	select {
+	case <-s.LocRibQueue.notify:
+		s.pullChanges()
+	case <-s.OutQueue.space:
+		s.pullChanges()
+	case communication := <-s.ShutdownCh:
+		s.Shutdown(communication)
+	case <-s.StaleTimer:
+		deleted := s.AdjRIBsIn.deleteStale()
+		log.Printf("%v: stale path timer expired. deleted %d stale routes", s.Ifi.Name, len(deleted))
+		s.StaleTimer = nil
+		s.Status.SetPrefixCount(s.PrefixCount())
+		s.AdjRibCh <- s.AdjRIBsIn.delta(deleted)
+	case <-s.DampingTick:
+		if reused := s.Damper.Reuse(s.AdjRIBsIn); len(reused) != 0 {
+			log.Printf("%v: reusing %d damped routes", s.Ifi.Name, len(reused))
+			s.AdjRibCh <- s.AdjRIBsIn.delta(reused)
+		}
 	case msg := <-s.MsgCh:
 		msgtype, err := message.Type(msg)
 		if err != nil {
@@ -162,25 +440,41 @@ func (s *Session) Established() {
 			s.Cancel()
 			return
 		}
+		if msgtype == message.MsgTypeNotification {
+			log.Printf("received notification: %v", msg)
+			s.Err = errNotification
+			s.Cancel()
+			return
+		}
 		if msgtype != message.MsgTypeUpdate {
 			log.Printf("expected an update message, but got: %v", msgtype)
 			s.Cancel()
 			return
 		}
 		update_msg := msg.(*update.Update)
-		s.AdjRIBsIn.Update(*update_msg, s.AS)
-		s.AdjRibCh <- s.AdjRIBsIn
+		if afi, safi, ok := update_msg.EndOfRIB(); ok {
+			s.receiveEndOfRIB(afi, safi)
+			return
+		}
+		changed := s.AdjRIBsIn.Update(*update_msg, s.LocalInfo, s.pathSource(), s.Damper)
+		s.Status.SetPrefixCount(s.PrefixCount())
+		if s.checkMaxPrefix() {
+			return
+		}
 		log.Printf("received msg: %v", msg)
+		// 変わったプレフィックスだけをLocRibに送る
+		if len(changed) != 0 {
+			s.AdjRibCh <- s.AdjRIBsIn.delta(changed)
+		}
 	}
 }
 
-// TODO:引数増えてきたからまとめるか何かしたい
-func handle_bgp(ctx context.Context, cancel context.CancelFunc, ifi net.Interface, active bool, AS uint16, RibAdjInCh chan RibAdj, LocRibCh chan RibAdj) {
-	netipIp, err := localNetipIp(ifi)
+func handle_bgp(ctx context.Context, cancel context.CancelFunc, n *Neighbor) error {
+	netipIp, err := n.localAddr()
 	if err != nil {
 		log.Fatalf("failed to get local netip ip: %v", err)
 		cancel()
-		return
+		return err
 	}
 	s := Session{
 		State:               Idle,
@@ -188,27 +482,53 @@ func handle_bgp(ctx context.Context, cancel context.CancelFunc, ifi net.Interfac
 		ConnectRetryTime:    120 * time.Second,
 		HoldTime:            180 * time.Second,
 		KeepaliveTime:       60 * time.Second,
+		SendHoldTime:        time.Duration(n.Config.SendHoldTime),
 		Events:              make(chan Event, 2),
-		ActiveMode:          active,
-		Ifi:                 ifi,
+		ActiveMode:          n.ActiveMode,
+		Ifi:                 n.Ifi,
 		NetipAddr:           netipIp,
-		AS:                  AS,
+		LocalInfo:           n.Local,
+		Config:              n.Config,
+		Status:              n.Status,
+		Damper:              n.Damper,
 		MsgCh:               make(chan message.Message, 10), //magic number to be determined
 		AdjRIBsIn:           make(RibAdj),
-		AdjRIBsOut:          make(RibAdj),
-		AdjRibCh:            RibAdjInCh,
-		LocRibCh:            LocRibCh,
+		AdjRibCh:            n.RibAdjInCh,
+		LocRibQueue:         n.LocRibQueue,
+		ShutdownCh:          n.ShutdownCh,
 		Ctx:                 ctx,
 		Cancel:              cancel,
+		Conn:                n.Conn,
+		neighbor:            n,
+	}
+	if n.Damper != nil {
+		ticker := time.NewTicker(DAMPINGREUSEINTERVAL)
+		defer ticker.Stop()
+		s.DampingTick = ticker.C
 	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("handle_bgp finished")
-			return
+			if s.Conn != nil {
+				s.Conn.Close()
+			}
+			// NOTIFICATIONなしで切れた場合は再起動中とみなして経路を残す (RFC 4724 4.2)
+			if s.grNegotiated() && s.State == Established && s.Err == nil {
+				n.keepStale(s.AdjRIBsIn.markStale(), time.Duration(s.PeerGR.RestartTime)*time.Second)
+				return s.Err
+			}
+			// セッションが切れて経路が消えるのもフラップとして数える
+			for prefix := range s.AdjRIBsIn {
+				s.Damper.penalize(prefix, WITHDRAWPENALTY)
+			}
+			return s.Err
+		case communication := <-n.ShutdownCh:
+			s.Shutdown(communication)
 		default:
-			log.Println("session state: ", s.State)
+			log.Printf("router-id %v: session state: %v", s.RouterID, s.State)
+			s.Status.SetState(s.State)
 			switch s.State {
 			case Idle:
 				s.Idle()
@@ -229,7 +549,92 @@ func handle_bgp(ctx context.Context, cancel context.CancelFunc, ifi net.Interfac
 	}
 }
 
-func peers_ifi(active bool, AS uint16) []Peer {
+// セッションが終わったら理由に応じて再接続するかどうかを決める
+// max-prefixで切断した場合は設定された時間かSIGUSR1で解除されるまで待つ
+func run_neighbor(n *Neighbor, done chan struct{}) {
+	defer close(done)
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := handle_bgp(ctx, cancel, n)
+		n.Status.SetState(Idle)
+		n.Status.SetSynced(false)
+		if err == errShutdown {
+			return
+		}
+		// このピアから受け取った経路を取り消す
+		// Graceful Restartで残している場合はrestart timerが切れたときに取り消す
+		if !n.hasStale() {
+			n.RibAdjInCh <- RibDelta{Reset: true}
+		}
+		if err == errMaxPrefix {
+			if !n.holdDown() {
+				return
+			}
+			continue
+		}
+		log.Printf("%v: reconnecting in %v", n.Status.Name, CONNECTRETRYTIME)
+		if !n.wait(time.After(CONNECTRETRYTIME)) {
+			return
+		}
+	}
+}
+
+func (n *Neighbor) hasStale() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stale != nil
+}
+
+// max-prefixで切断した後の待機
+// シャットダウンが要求された場合はfalseを返す
+func (n *Neighbor) holdDown() bool {
+	// 切断前に届いていたSIGUSR1は無視する
+	select {
+	case <-n.ClearCh:
+	default:
+	}
+	var restart <-chan time.Time
+	if n.Config.MaxPrefixRestart > 0 {
+		log.Printf("%v: restarting session in %v", n.Ifi.Name, time.Duration(n.Config.MaxPrefixRestart))
+		restart = time.After(time.Duration(n.Config.MaxPrefixRestart))
+	} else {
+		log.Printf("%v: session is held down until cleared by SIGUSR1", n.Ifi.Name)
+	}
+	return n.wait(restart)
+}
+
+// restartかSIGUSR1まで待つ
+// LocRibからの変更はキューにたまり、次のセッションの最初に捨てる
+// シャットダウンが要求された場合はfalseを返す
+func (n *Neighbor) wait(restart <-chan time.Time) bool {
+	for {
+		select {
+		case <-restart:
+			return true
+		case <-n.ClearCh:
+			log.Printf("%v: cleared", n.Ifi.Name)
+			return true
+		case <-n.ShutdownCh:
+			return false
+		}
+	}
+}
+
+// アドレスで設定したピアのセッションを始める
+func peers_addr(active bool, local LocalInfo, config Config) []Peer {
+	peers := make([]Peer, 0, len(config.Neighbors))
+	for _, conf := range config.Neighbors {
+		log.Printf("sending bgp to %v", conf.Address)
+		n := NewNeighbor(net.Interface{}, active, local, conf.withDefaults(), config.Damping)
+		n.Status.Name = conf.Address.String()
+		done := make(chan struct{})
+		peers = append(peers, n.Peer(done))
+		go run_neighbor(n, done)
+	}
+	return peers
+}
+
+func peers_ifi(active bool, local LocalInfo, config Config) []Peer {
 	ifis, err := net.Interfaces()
 	peers := make([]Peer, 0, len(ifis))
 	if err != nil {
@@ -239,18 +644,17 @@ func peers_ifi(active bool, AS uint16) []Peer {
 		if is_loopback(ifi) {
 			continue
 		}
-		log.Printf("sending bgp from %v", ifi.Name)
-		ctx, cancel := context.WithCancel(context.Background())
-		RibAdjInCh := make(chan RibAdj, 10)
-		LocRibCh := make(chan RibAdj, 10)
-
-		peer := Peer{
-			RibAdjIn:   make(RibAdj),
-			RibAdjInCh: RibAdjInCh,
-			LocRibCh:   LocRibCh,
+		// ダイナミックネイバーの範囲に入っているリンクは待ち受け側に任せる
+		if !active && config.dynamicIfi(ifi) {
+			log.Printf("%v is served by dynamic neighbors", ifi.Name)
+			continue
 		}
-		peers = append(peers, peer)
-		go handle_bgp(ctx, cancel, ifi, active, AS, RibAdjInCh, LocRibCh)
+		log.Printf("sending bgp from %v", ifi.Name)
+		n := NewNeighbor(ifi, active, local, config.Peer(ifi.Name), config.Damping)
+		n.Status.Name = ifi.Name
+		done := make(chan struct{})
+		peers = append(peers, n.Peer(done))
+		go run_neighbor(n, done)
 	}
 	return peers
 }
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/netip"
 	"os/exec"
 	"strings"
+	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 var errArptableNotFound = errors.New("no arp table found")
@@ -117,7 +123,7 @@ func remote_addr_loop(ifi net.Interface) (*net.TCPAddr, error) {
 	return raddr, nil
 }
 
-func start_tcp(ifi net.Interface) (*net.TCPConn, error) {
+func start_tcp(ifi net.Interface, conf PeerConfig) (*net.TCPConn, error) {
 	laddr, err := local_tcpaddr(ifi)
 	if err != nil {
 		log.Printf("failed to get local addr: %v", err)
@@ -128,29 +134,284 @@ func start_tcp(ifi net.Interface) (*net.TCPConn, error) {
 		log.Printf("failed to get remote addr: %v", err)
 		return nil, err
 	}
-	conn, err := net.DialTCP("tcp", laddr, raddr)
+	peer := netip.PrefixFrom(raddr.AddrPort().Addr().Unmap(), 32)
+	dialer := net.Dialer{LocalAddr: laddr, Control: peer_control(conf, peer)}
+	conn, err := dialer.Dial("tcp", raddr.String())
 	if err != nil {
 		log.Printf("failed to dial: %v", err)
 		return nil, err
 	}
-	return conn, nil
+	return conn.(*net.TCPConn), nil
 }
 
-func wait_tcp(ifi net.Interface) (*net.TCPConn, error) {
+// 接続してくるピアのアドレスは分からないのでインターフェースのサブネットに鍵を設定する
+func wait_tcp(ifi net.Interface, conf PeerConfig) (*net.TCPConn, error) {
 	laddr, err := local_tcpaddr(ifi)
 	if err != nil {
 		log.Printf("failed to get local addr: %v", err)
 		return nil, err
 	}
-	l, err := net.ListenTCP("tcp", laddr)
+	subnet, err := IfiToPrefix(ifi)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{Control: peer_control(conf, subnet.Masked())}
+	l, err := lc.Listen(context.Background(), "tcp", laddr.String())
 	if err != nil {
 		log.Printf("failed to listen: %v", err)
 		return nil, err
 	}
-	conn, err := l.AcceptTCP()
+	// 再接続時に同じアドレスでListenし直せるように閉じておく
+	defer l.Close()
+	conn, err := l.(*net.TCPListener).AcceptTCP()
 	if err != nil {
 		log.Printf("failed to accept: %v", err)
 		return nil, err
 	}
 	return conn, nil
 }
+
+// ダイナミックネイバーの待ち受けと同じポートを使えるようにする
+// Linuxではアドレスを指定したソケットの方が優先されるので、個別のピアの接続はそちらに届く
+func reuseport(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if serr == nil {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// GTSM (RFC 5082)
+// TTLを255で送り、255-hopsより小さいTTLで届いたパケットはカーネルに捨てさせる
+func set_gtsm(fd int, v6 bool, hops int) error {
+	if v6 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, 255); err != nil {
+			return err
+		}
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_MINHOPCOUNT, 255-hops)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, 255); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MINTTL, 255-hops)
+}
+
+// GTSMで許すホップ数. 直接つながったピアなら1
+func (conf PeerConfig) gtsmHops() int {
+	if conf.EBGPMultihop > 1 {
+		return int(conf.EBGPMultihop)
+	}
+	return 1
+}
+
+// 待ち受けるソケットを共有するピアのGTSMのホップ数. GTSMを使わなければ0
+func (conf PeerConfig) listenerGTSMHops() int {
+	if !conf.TTLSecurity {
+		return 0
+	}
+	return conf.gtsmHops()
+}
+
+// 複数のピアで共有して待ち受けるソケットにGTSMを設定し、遠くからのSYNをacceptの前に捨てさせる
+// hopsはピアごとのlistenerGTSMHops. 一番遠いピアに合わせ、GTSMを使わないピアもいればMINTTLは設定しない
+// ピアごとのホップ数は受け付けた接続にset_conn_gtsmで設定し直す
+func set_shared_gtsm(fd int, v6 bool, hops []int) error {
+	max := 0
+	all := true
+	for _, h := range hops {
+		if h == 0 {
+			all = false
+		} else if h > max {
+			max = h
+		}
+	}
+	if max == 0 {
+		return nil
+	}
+	minTTL := 0
+	if all {
+		minTTL = 255 - max
+	}
+	level, ttlOpt, minTTLOpt := unix.IPPROTO_IP, unix.IP_TTL, unix.IP_MINTTL
+	if v6 {
+		level, ttlOpt, minTTLOpt = unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, unix.IPV6_MINHOPCOUNT
+	}
+	if err := unix.SetsockoptInt(fd, level, ttlOpt, 255); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(fd, level, minTTLOpt, minTTL)
+}
+
+// reuseportに加えて共有するソケットのGTSMを設定するControl関数を返す
+func shared_listen_control(hops []int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if err := reuseport(network, address, c); err != nil {
+			return err
+		}
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = set_shared_gtsm(int(fd), network == "tcp6", hops)
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("failed to set GTSM: %v", serr)
+		}
+		return nil
+	}
+}
+
+// 接続済みのソケットにGTSMを設定する
+func set_conn_gtsm(conn *net.TCPConn, hops int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v6 := !conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap().Is4()
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = set_gtsm(int(fd), v6, hops)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// セッションに使うソケットの設定をまとめたControl関数を返す
+// listenしたソケットに設定したGTSMと鍵は受け付けた接続に引き継がれる
+func peer_control(conf PeerConfig, peers ...netip.Prefix) func(network, address string, c syscall.RawConn) error {
+	auth := auth_control(conf, peers...)
+	return func(network, address string, c syscall.RawConn) error {
+		if err := auth(network, address, c); err != nil {
+			return err
+		}
+		if !conf.TTLSecurity {
+			return nil
+		}
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = set_gtsm(int(fd), network == "tcp6", conf.gtsmHops())
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("failed to set GTSM: %v", serr)
+		}
+		return nil
+	}
+}
+
+// addrを持つインターフェースを探す
+func ifi_by_addr(addr netip.Addr) (net.Interface, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return net.Interface{}, err
+	}
+	for _, ifi := range ifis {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			prefix, err := netip.ParsePrefix(a.String())
+			if err == nil && prefix.Addr() == addr.Unmap() {
+				return ifi, nil
+			}
+		}
+	}
+	return net.Interface{}, fmt.Errorf("no interface has %v", addr)
+}
+
+// -router-idで指定されたrouter-id. 指定がなければ自動で選ぶ
+func router_id(flag string) (netip.Addr, error) {
+	if flag == "" {
+		return select_router_id()
+	}
+	id, err := netip.ParseAddr(flag)
+	if err != nil || !id.Is4() {
+		return netip.Addr{}, fmt.Errorf("invalid router-id: %v", flag)
+	}
+	return id, nil
+}
+
+// router-idを選ぶためのインターフェースのアドレス
+type ifiAddrs struct {
+	loopback bool
+	addrs    []netip.Addr
+}
+
+// router-idを自動で選ぶ
+func select_router_id() (netip.Addr, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	candidates := make([]ifiAddrs, 0, len(ifis))
+	for _, ifi := range ifis {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			log.Printf("failed to get addrs of %v: %v", ifi.Name, err)
+			continue
+		}
+		candidate := ifiAddrs{loopback: is_loopback(ifi)}
+		for _, addr := range addrs {
+			prefix, err := netip.ParsePrefix(addr.String())
+			if err != nil {
+				continue
+			}
+			candidate.addrs = append(candidate.addrs, prefix.Addr())
+		}
+		candidates = append(candidates, candidate)
+	}
+	return choose_router_id(candidates)
+}
+
+// ループバックに127.0.0.0/8以外のIPv4アドレスがあればそれを優先し、
+// なければ全インターフェースの中で最大のIPv4アドレスを使う
+func choose_router_id(ifis []ifiAddrs) (netip.Addr, error) {
+	var loopbackID, highestID netip.Addr
+	for _, ifi := range ifis {
+		for _, ip := range ifi.addrs {
+			if !ip.Is4() || ip.IsLoopback() {
+				continue
+			}
+			if ifi.loopback {
+				if !loopbackID.IsValid() || loopbackID.Less(ip) {
+					loopbackID = ip
+				}
+				continue
+			}
+			if !highestID.IsValid() || highestID.Less(ip) {
+				highestID = ip
+			}
+		}
+	}
+	if loopbackID.IsValid() {
+		return loopbackID, nil
+	}
+	if highestID.IsValid() {
+		return highestID, nil
+	}
+	return netip.Addr{}, errIpv4NotFound
+}
+
+// OPENメッセージのBGP Identifierとnetip.Addrの相互変換
+func routerIDToUint32(id netip.Addr) uint32 {
+	b := id.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func uint32ToRouterID(id uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	return netip.AddrFrom4(b)
+}
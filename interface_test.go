@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func getsockoptInt(t *testing.T, raw syscall.RawConn, level, opt int) int {
+	t.Helper()
+	var v int
+	var serr error
+	err := raw.Control(func(fd uintptr) {
+		v, serr = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil || serr != nil {
+		t.Fatalf("getsockopt failed: %v %v", err, serr)
+	}
+	return v
+}
+
+func TestGTSM(t *testing.T) {
+	tests := []struct {
+		name       string
+		network    string
+		address    string
+		conf       PeerConfig
+		level      int
+		ttlOpt     int
+		minTTLOpt  int
+		wantMinTTL int
+	}{
+		{
+			name:       "ipv4",
+			network:    "tcp4",
+			address:    "127.0.0.1:0",
+			conf:       PeerConfig{TTLSecurity: true},
+			level:      unix.IPPROTO_IP,
+			ttlOpt:     unix.IP_TTL,
+			minTTLOpt:  unix.IP_MINTTL,
+			wantMinTTL: 254,
+		},
+		{
+			name:       "ipv4_multihop",
+			network:    "tcp4",
+			address:    "127.0.0.1:0",
+			conf:       PeerConfig{TTLSecurity: true, EBGPMultihop: 3},
+			level:      unix.IPPROTO_IP,
+			ttlOpt:     unix.IP_TTL,
+			minTTLOpt:  unix.IP_MINTTL,
+			wantMinTTL: 252,
+		},
+		{
+			name:       "ipv6",
+			network:    "tcp6",
+			address:    "[::1]:0",
+			conf:       PeerConfig{TTLSecurity: true},
+			level:      unix.IPPROTO_IPV6,
+			ttlOpt:     unix.IPV6_UNICAST_HOPS,
+			minTTLOpt:  unix.IPV6_MINHOPCOUNT,
+			wantMinTTL: 254,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := net.ListenConfig{Control: peer_control(tt.conf)}
+			l, err := lc.Listen(context.Background(), tt.network, tt.address)
+			if err != nil {
+				t.Skipf("cannot listen on %v: %v", tt.address, err)
+			}
+			defer l.Close()
+			raw, err := l.(*net.TCPListener).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl := getsockoptInt(t, raw, tt.level, tt.ttlOpt); ttl != 255 {
+				t.Errorf("listener ttl = %v, want 255", ttl)
+			}
+			if minTTL := getsockoptInt(t, raw, tt.level, tt.minTTLOpt); minTTL != tt.wantMinTTL {
+				t.Errorf("listener min ttl = %v, want %v", minTTL, tt.wantMinTTL)
+			}
+
+			// 直接つながったピアとしてつながり、受け付けた接続にも引き継がれる
+			dialer := net.Dialer{Control: peer_control(tt.conf)}
+			conn, err := dialer.Dial(tt.network, l.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial with GTSM: %v", err)
+			}
+			defer conn.Close()
+			accepted, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer accepted.Close()
+			raw, err = accepted.(*net.TCPConn).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if minTTL := getsockoptInt(t, raw, tt.level, tt.minTTLOpt); minTTL != tt.wantMinTTL {
+				t.Errorf("accepted min ttl = %v, want %v", minTTL, tt.wantMinTTL)
+			}
+		})
+	}
+}
+
+func TestSetConnGTSM(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := set_conn_gtsm(conn.(*net.TCPConn), 1); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := conn.(*net.TCPConn).SyscallConn()
+	if ttl := getsockoptInt(t, raw, unix.IPPROTO_IP, unix.IP_TTL); ttl != 255 {
+		t.Errorf("ttl = %v, want 255", ttl)
+	}
+	if minTTL := getsockoptInt(t, raw, unix.IPPROTO_IP, unix.IP_MINTTL); minTTL != 254 {
+		t.Errorf("min ttl = %v, want 254", minTTL)
+	}
+}
+
+// 共有するソケットは一番遠いピアに合わせ、GTSMを使わないピアがいればMINTTLを設定しない
+func TestSharedGTSM(t *testing.T) {
+	tests := []struct {
+		name       string
+		hops       []int
+		gtsm       bool
+		wantMinTTL int
+	}{
+		{"all gtsm", []int{1, 3}, true, 252},
+		{"mixed", []int{1, 0}, true, 0},
+		{"no gtsm", []int{0}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := net.ListenConfig{Control: shared_listen_control(tt.hops)}
+			l, err := lc.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Skipf("cannot listen: %v", err)
+			}
+			defer l.Close()
+			raw, err := l.(*net.TCPListener).SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl := getsockoptInt(t, raw, unix.IPPROTO_IP, unix.IP_TTL); tt.gtsm && ttl != 255 {
+				t.Errorf("listener ttl = %v, want 255", ttl)
+			}
+			if minTTL := getsockoptInt(t, raw, unix.IPPROTO_IP, unix.IP_MINTTL); minTTL != tt.wantMinTTL {
+				t.Errorf("listener min ttl = %v, want %v", minTTL, tt.wantMinTTL)
+			}
+		})
+	}
+}
+
+func TestRouterID(t *testing.T) {
+	if id, err := router_id("192.0.2.1"); err != nil || id != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("router_id() = %v %v", id, err)
+	}
+	for _, invalid := range []string{"2001:db8::1", "router1"} {
+		if _, err := router_id(invalid); err == nil {
+			t.Errorf("%v should be rejected", invalid)
+		}
+	}
+
+	addrs := func(s ...string) []netip.Addr {
+		a := make([]netip.Addr, 0, len(s))
+		for _, addr := range s {
+			a = append(a, netip.MustParseAddr(addr))
+		}
+		return a
+	}
+	tests := []struct {
+		name    string
+		ifis    []ifiAddrs
+		want    netip.Addr
+		wantErr error
+	}{
+		{
+			name: "loopback",
+			ifis: []ifiAddrs{
+				{loopback: true, addrs: addrs("127.0.0.1", "10.255.0.1", "::1")},
+				{addrs: addrs("192.168.0.1")},
+			},
+			want: netip.MustParseAddr("10.255.0.1"),
+		},
+		{
+			name: "highest interface address",
+			ifis: []ifiAddrs{
+				{loopback: true, addrs: addrs("127.0.0.1")},
+				{addrs: addrs("10.0.0.1", "fe80::1")},
+				{addrs: addrs("10.0.1.1", "10.0.0.254")},
+			},
+			want: netip.MustParseAddr("10.0.1.1"),
+		},
+		{
+			name: "none available",
+			ifis: []ifiAddrs{
+				{loopback: true, addrs: addrs("127.0.0.1", "::1")},
+				{addrs: addrs("fe80::1")},
+			},
+			wantErr: errIpv4NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := choose_router_id(tt.ifis)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("choose_router_id() = %v %v, want %v %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	id := netip.MustParseAddr("10.255.0.1")
+	if n := routerIDToUint32(id); n != 0x0AFF0001 || uint32ToRouterID(n) != id {
+		t.Errorf("routerIDToUint32() = %#x", n)
+	}
+}
+
+func TestPeerStatusRouterID(t *testing.T) {
+	status := PeerStatus{Name: "eth0", State: Established, RouterID: netip.MustParseAddr("10.255.0.1")}
+	status.SetPeer(65001, netip.MustParseAddr("10.255.0.2"), false)
+	want := "eth0: Established local router-id 10.255.0.1 AS 65001 (ebgp) router-id 10.255.0.2"
+	if s := status.String(); !strings.HasPrefix(s, want) {
+		t.Errorf("String() = %q, want prefix %q", s, want)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+)
+
+// ROUTINGTABLE を参照する ip rule を全て削除する
+// ip rule del は一致するルールを1つずつしか消さないので失敗するまで繰り返す
+func delete_ip_rules() {
+	for {
+		err := exec.Command("ip", "rule", "del", "table", ROUTINGTABLE).Run()
+		if err != nil {
+			return
+		}
+		log.Printf("deleted ip rule for table %s", ROUTINGTABLE)
+	}
+}
+
+func flush_routing_table() error {
+	return exec.Command("ip", "route", "flush", "table", ROUTINGTABLE).Run()
+}
+
+// 前回異常終了したときに残ったルールや経路を片付けてからルールを1つだけ追加する
+// keepならGraceful Restartのために経路を残し、残っていた経路を返す
+func reconcile_kernel_state(keep bool) (FIB, error) {
+	delete_ip_rules()
+	routes := make(FIB)
+	if keep {
+		kept, err := read_routing_table()
+		if err != nil {
+			log.Printf("failed to read routing table: %v", err)
+		} else {
+			routes = kept
+		}
+	} else if err := flush_routing_table(); err != nil {
+		log.Printf("failed to flush routing table: %v", err)
+	}
+	return routes, exec.Command("ip", "rule", "add", "table", ROUTINGTABLE).Run()
+}
+
+// 終了時に自分が追加した経路とルールを削除する
+func cleanup_kernel_state() {
+	if err := flush_routing_table(); err != nil {
+		log.Printf("failed to flush routing table: %v", err)
+	}
+	delete_ip_rules()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/81ueman/local-clos/message/update"
+	"golang.org/x/sys/unix"
+)
+
+// 自分で生成した経路の種類
+type LocalRouteKind string
+
+const (
+	LOCALCONNECTED LocalRouteKind = "connected"
+	LOCALNETWORK   LocalRouteKind = "network"
+	LOCALSTATIC    LocalRouteKind = "static"
+	// redistributeで取り込んだカーネルの経路. カーネルにあるのでFIBではmainテーブルを引かせる
+	LOCALKERNEL LocalRouteKind = "kernel"
+)
+
+// networksで広告するプレフィックス
+type NetworkConfig struct {
+	Prefix netip.Prefix `json:"prefix"`
+	// カーネルにこのプレフィックスのアドレスか経路がある間だけ広告する
+	Conditional bool `json:"conditional"`
+}
+
+// ROUTINGTABLEに入れる静的経路
+type StaticRouteConfig struct {
+	Prefix  netip.Prefix `json:"prefix"`
+	NextHop netip.Addr   `json:"next_hop"`
+	// ピアにも広告する
+	Redistribute bool `json:"redistribute"`
+}
+
+// カーネルの経路を取り込む条件
+// typeのconnectedはインターフェースのサブネット(proto kernel), kernelはip route addで入れた経路(proto boot),
+// staticはproto staticの経路
+type RedistributeConfig struct {
+	Type string `json:"type"`
+	// 経路を読むテーブル. 指定しなければmain
+	Table uint32 `json:"table"`
+	// /etc/iproute2/rt_protosのプロトコルの番号. 指定しなければtypeで決まる
+	Protocol uint8 `json:"protocol"`
+}
+
+var redistributeProtocols = map[string]uint8{
+	"connected": unix.RTPROT_KERNEL,
+	"kernel":    unix.RTPROT_BOOT,
+	"static":    unix.RTPROT_STATIC,
+}
+
+func (r RedistributeConfig) validate() error {
+	if _, ok := redistributeProtocols[r.Type]; !ok {
+		return fmt.Errorf("invalid type: %q", r.Type)
+	}
+	// 自分が入れた経路を広告し直さない
+	if strconv.Itoa(int(r.Table)) == ROUTINGTABLE {
+		return fmt.Errorf("table %v is used by local-clos", r.Table)
+	}
+	return nil
+}
+
+func (r RedistributeConfig) match(route kernelRoute) bool {
+	table := r.Table
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	protocol := r.Protocol
+	if protocol == 0 {
+		protocol = redistributeProtocols[r.Type]
+	}
+	return route.Type == unix.RTN_UNICAST && route.Table == table && route.Protocol == protocol
+}
+
+// カーネルのアドレスと経路. 変更のたびに読み直す
+type kernelState struct {
+	addrs  []netip.Prefix
+	routes []kernelRoute
+}
+
+func read_kernel_state() (kernelState, error) {
+	var state kernelState
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return state, err
+	}
+	for _, addr := range addrs {
+		prefix, err := netip.ParsePrefix(addr.String())
+		if err != nil || !prefix.Addr().Is4() {
+			continue
+		}
+		state.addrs = append(state.addrs, prefix)
+	}
+	state.routes, err = kernel_routes()
+	return state, err
+}
+
+// インターフェースのアドレス(/32とサブネット)かmainテーブルの経路にprefixがあるか
+func (k kernelState) has(prefix netip.Prefix) bool {
+	for _, addr := range k.addrs {
+		if prefix == netip.PrefixFrom(addr.Addr(), 32) || prefix == addr.Masked() {
+			return true
+		}
+	}
+	for _, route := range k.routes {
+		if route.Table == unix.RT_TABLE_MAIN && route.Prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// 続けて届くカーネルの変更をまとめる時間
+const LOCALROUTEDELAY time.Duration = 500 * time.Millisecond
+
+// netlinkで変更を受け取れない場合に自分で生成する経路を作り直す間隔
+const LOCALROUTEINTERVAL time.Duration = 10 * time.Second
+
+func (c Config) advertiseLinkSubnets() bool {
+	return c.AdvertiseLinkSubnets == nil || *c.AdvertiseLinkSubnets
+}
+
+// 接続しているサブネットにredistributeで取り込んだ経路, networks, 静的経路を加える
+// 同じプレフィックスは後のもので上書きする
+func buildLocalRoutes(config Config, connected RibAdj, kernel kernelState) RibAdj {
+	adj := make(RibAdj, len(connected)+len(config.Networks)+len(config.StaticRoutes))
+	for prefix, entry := range connected {
+		entry.Source.Kind = LOCALCONNECTED
+		// RFC 7938 5.2.3. FIBと最良経路の選択には使う
+		entry.Source.NoAdvertise = !config.advertiseLinkSubnets()
+		adj[prefix] = entry
+	}
+	for _, route := range kernel.routes {
+		for _, r := range config.Redistribute {
+			if !r.match(route) {
+				continue
+			}
+			kind := LOCALKERNEL
+			origin := update.OriginINC
+			if r.Type == "connected" {
+				kind = LOCALCONNECTED
+				origin = update.OriginIGP
+			}
+			adj[route.Prefix] = RibAdjEntry{
+				ORIGIN:     origin,
+				AS_PATH:    update.AS_PATH{},
+				NEXT_HOP:   update.NEXT_HOP(route.Gateway),
+				LOCAL_PREF: DEFAULTLOCALPREF,
+				Source:     PathSource{Kind: kind},
+			}
+			break
+		}
+	}
+	for _, network := range config.Networks {
+		prefix := network.Prefix.Masked()
+		if network.Conditional && !kernel.has(prefix) {
+			continue
+		}
+		adj[prefix] = RibAdjEntry{
+			ORIGIN:     update.OriginIGP,
+			AS_PATH:    update.AS_PATH{},
+			LOCAL_PREF: DEFAULTLOCALPREF,
+			Source:     PathSource{Kind: LOCALNETWORK},
+		}
+	}
+	for _, static := range config.StaticRoutes {
+		adj[static.Prefix.Masked()] = RibAdjEntry{
+			ORIGIN:     update.OriginINC,
+			AS_PATH:    update.AS_PATH{},
+			NEXT_HOP:   update.NEXT_HOP(static.NextHop),
+			LOCAL_PREF: DEFAULTLOCALPREF,
+			Source:     PathSource{Kind: LOCALSTATIC, NoAdvertise: !static.Redistribute},
+		}
+	}
+	return adj
+}
+
+// 自分で生成する経路
+func localRoutes(config Config) (RibAdj, error) {
+	connected, err := AdjFromLocal()
+	if err != nil {
+		return nil, err
+	}
+	var kernel kernelState
+	if config.needsKernelState() {
+		kernel, err = read_kernel_state()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buildLocalRoutes(config, connected, kernel), nil
+}
+
+func (c Config) needsKernelState() bool {
+	if len(c.Redistribute) != 0 {
+		return true
+	}
+	for _, network := range c.Networks {
+		if network.Conditional {
+			return true
+		}
+	}
+	return false
+}
+
+// インターフェースやアドレスやカーネルの経路が変わるたびに自分で生成する経路を作り直し、変わったらchに送る
+// netlinkで変更を受け取れなければLOCALROUTEINTERVALごとに作り直す
+func watch_local_routes(config Config, current RibAdj, ch chan<- RibAdj) {
+	changes := make(chan struct{}, 1)
+	fd, err := subscribe_kernel_changes()
+	if err != nil {
+		log.Printf("failed to subscribe to kernel changes: %v", err)
+		close(changes)
+	} else {
+		go receive_kernel_changes(fd, changes)
+	}
+	ticker := time.NewTicker(LOCALROUTEINTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				log.Printf("polling local routes every %v", LOCALROUTEINTERVAL)
+				changes = nil
+				continue
+			}
+			// 続けて届く変更を待ってからまとめて読み直す
+			time.Sleep(LOCALROUTEDELAY)
+			select {
+			case <-changes:
+			default:
+			}
+		case <-ticker.C:
+			if changes != nil {
+				continue
+			}
+		}
+		adj, err := localRoutes(config)
+		if err != nil {
+			log.Printf("failed to get local routes: %v", err)
+			continue
+		}
+		if reflect.DeepEqual(adj, current) {
+			continue
+		}
+		current = adj
+		ch <- adj
+	}
+}
+
+// 自分で生成する経路を置き換え、変わったプレフィックスを覚えておく
+func (L *LocRib) setLocalRoutes(adj RibAdj) {
+	// 接続しているネットワークが変わればピアの経路のIGPコストも変わる
+	connectedChanged := false
+	for prefix, entry := range L.adjConnected {
+		if changed, ok := adj[prefix]; !ok || !reflect.DeepEqual(entry, changed) {
+			L.markDirty(prefix)
+			connectedChanged = connectedChanged || entry.Source.Kind == LOCALCONNECTED || changed.Source.Kind == LOCALCONNECTED
+		}
+	}
+	for prefix, entry := range adj {
+		if _, ok := L.adjConnected[prefix]; !ok {
+			L.markDirty(prefix)
+			connectedChanged = connectedChanged || entry.Source.Kind == LOCALCONNECTED
+		}
+	}
+	L.adjConnected = adj
+	if connectedChanged {
+		L.updateIGPCost()
+	}
+}
+
+// ピアの経路のIGPコストを決め直す
+func (L *LocRib) updateIGPCost() {
+	for _, peer := range L.peers {
+		for prefix, entry := range peer.RibAdjIn {
+			if cost := L.igpCost(netip.Addr(entry.NEXT_HOP)); cost != entry.IGPCost {
+				entry.IGPCost = cost
+				peer.RibAdjIn[prefix] = entry
+				L.markDirty(prefix)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/81ueman/local-clos/message/update"
+	"golang.org/x/sys/unix"
+)
+
+func TestBuildLocalRoutes(t *testing.T) {
+	link := netip.MustParsePrefix("10.0.0.0/31")
+	loopback := netip.MustParsePrefix("10.255.0.1/32")
+	anycast := netip.MustParsePrefix("10.254.0.1/32")
+	static := netip.MustParsePrefix("192.168.0.0/24")
+	connected := RibAdj{link: {ORIGIN: update.OriginIGP, AS_PATH: update.AS_PATH{}, NEXT_HOP: update.NEXT_HOP(netip.MustParseAddr("10.0.0.0"))}}
+	kernel := kernelState{addrs: []netip.Prefix{netip.MustParsePrefix("10.255.0.1/32")}}
+	advertise := false
+	config := Config{
+		AdvertiseLinkSubnets: &advertise,
+		Networks: []NetworkConfig{
+			{Prefix: loopback, Conditional: true},
+			{Prefix: anycast, Conditional: true},
+			{Prefix: netip.MustParsePrefix("10.1.0.1/24")},
+		},
+		StaticRoutes: []StaticRouteConfig{
+			{Prefix: static, NextHop: netip.MustParseAddr("10.0.0.1"), Redistribute: true},
+		},
+	}
+	adj := buildLocalRoutes(config, connected, kernel)
+	tests := []struct {
+		prefix      netip.Prefix
+		kind        LocalRouteKind
+		noAdvertise bool
+	}{
+		{link, LOCALCONNECTED, true},
+		{loopback, LOCALNETWORK, false},
+		{netip.MustParsePrefix("10.1.0.0/24"), LOCALNETWORK, false},
+		{static, LOCALSTATIC, false},
+	}
+	for _, tt := range tests {
+		entry, ok := adj[tt.prefix]
+		if !ok {
+			t.Errorf("%v is not originated", tt.prefix)
+			continue
+		}
+		if entry.Source.Kind != tt.kind || entry.Source.NoAdvertise != tt.noAdvertise || !entry.Local() {
+			t.Errorf("%v: %+v", tt.prefix, entry.Source)
+		}
+	}
+	// カーネルにないプレフィックスは広告しない
+	if _, ok := adj[anycast]; ok || len(adj) != len(tests) {
+		t.Errorf("unexpected routes: %v", adj)
+	}
+	// 静的経路以外はmainテーブルを引かせる
+	if got := fibNextHops([]RibAdjEntry{adj[static]}); got[0].Addr != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("static route is not installed via next hop: %v", got)
+	}
+	for _, prefix := range []netip.Prefix{loopback, link} {
+		if got := fibNextHops([]RibAdjEntry{adj[prefix]}); got[0].Type != ROUTETHROW {
+			t.Errorf("%v: %v, want throw route", prefix, got)
+		}
+	}
+	if _, ok := exportEntry(adj[link], ExportTarget{}); ok {
+		t.Errorf("link subnet is advertised")
+	}
+	if _, ok := exportEntry(adj[static], ExportTarget{}); !ok {
+		t.Errorf("redistributed static route is not advertised")
+	}
+}
+
+func TestLocRibLocalRoutes(t *testing.T) {
+	loopback := netip.MustParsePrefix("10.255.0.1/32")
+	ch := make(chan RibDelta, 1)
+	localCh := make(chan RibAdj, 1)
+	L := LocRib{
+		peers:   []Peer{{RibAdjInCh: ch, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}}},
+		localCh: localCh,
+	}
+	ch <- RibDelta{Request: true, Target: &ExportTarget{LocalInfo: LocalInfo{AS: 65000}}}
+	L.Handle()
+	L.peers[0].LocRibQueue.PopEndOfRIB()
+
+	// 現れたプレフィックスを広告し、消えたら取り消す
+	localCh <- buildLocalRoutes(Config{Networks: []NetworkConfig{{Prefix: loopback}}}, nil, kernelState{})
+	L.Handle()
+	if announce, _ := L.peers[0].LocRibQueue.Pop(); len(announce) != 1 {
+		t.Errorf("network is not advertised: %v", announce)
+	}
+	localCh <- RibAdj{}
+	L.Handle()
+	if _, withdraw := L.peers[0].LocRibQueue.Pop(); len(withdraw) != 1 || withdraw[0] != loopback {
+		t.Errorf("network is not withdrawn: %v", withdraw)
+	}
+}
+
+func TestRedistribute(t *testing.T) {
+	route := func(prefix string, table uint32, protocol uint8) kernelRoute {
+		return kernelRoute{Prefix: netip.MustParsePrefix(prefix), Table: table, Protocol: protocol, Type: unix.RTN_UNICAST}
+	}
+	kernel := kernelState{routes: []kernelRoute{
+		route("10.1.0.0/24", unix.RT_TABLE_MAIN, unix.RTPROT_KERNEL),
+		route("10.2.0.0/24", unix.RT_TABLE_MAIN, unix.RTPROT_BOOT),
+		route("10.3.0.0/24", unix.RT_TABLE_MAIN, unix.RTPROT_STATIC),
+		route("10.4.0.0/24", 100, unix.RTPROT_STATIC),
+		route("10.5.0.0/24", unix.RT_TABLE_MAIN, 186),
+		{Prefix: netip.MustParsePrefix("10.6.0.0/24"), Table: unix.RT_TABLE_MAIN, Protocol: unix.RTPROT_BOOT, Type: unix.RTN_BLACKHOLE},
+	}}
+	tests := []struct {
+		name   string
+		config []RedistributeConfig
+		want   map[string]LocalRouteKind
+	}{
+		{
+			name: "none",
+			want: map[string]LocalRouteKind{},
+		},
+		{
+			name:   "connected",
+			config: []RedistributeConfig{{Type: "connected"}},
+			want:   map[string]LocalRouteKind{"10.1.0.0/24": LOCALCONNECTED},
+		},
+		{
+			name:   "kernel and static",
+			config: []RedistributeConfig{{Type: "kernel"}, {Type: "static"}},
+			want:   map[string]LocalRouteKind{"10.2.0.0/24": LOCALKERNEL, "10.3.0.0/24": LOCALKERNEL},
+		},
+		{
+			name:   "table",
+			config: []RedistributeConfig{{Type: "static", Table: 100}},
+			want:   map[string]LocalRouteKind{"10.4.0.0/24": LOCALKERNEL},
+		},
+		{
+			name:   "protocol",
+			config: []RedistributeConfig{{Type: "kernel", Protocol: 186}},
+			want:   map[string]LocalRouteKind{"10.5.0.0/24": LOCALKERNEL},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adj := buildLocalRoutes(Config{Redistribute: tt.config}, nil, kernel)
+			got := make(map[string]LocalRouteKind)
+			for prefix, entry := range adj {
+				got[prefix.String()] = entry.Source.Kind
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			for prefix, kind := range tt.want {
+				if got[prefix] != kind {
+					t.Errorf("%v: got %v, want %v", prefix, got[prefix], kind)
+				}
+			}
+		})
+	}
+	if err := (RedistributeConfig{Type: "static", Table: 10}).validate(); err == nil {
+		t.Errorf("table used by local-clos should be rejected")
+	}
+	if err := (RedistributeConfig{Type: "bgp"}).validate(); err == nil {
+		t.Errorf("unknown type should be rejected")
+	}
+}
+
+func TestParseRouteMessage(t *testing.T) {
+	attr := func(attrType uint16, value []byte) []byte {
+		b := binary.NativeEndian.AppendUint16(nil, uint16(4+len(value)))
+		b = binary.NativeEndian.AppendUint16(b, attrType)
+		return append(b, value...)
+	}
+	rtmsg := []byte{unix.AF_INET, 24, 0, 0, unix.RT_TABLE_UNSPEC, unix.RTPROT_STATIC, unix.RT_SCOPE_UNIVERSE, unix.RTN_UNICAST, 0, 0, 0, 0}
+	data := append(rtmsg, attr(unix.RTA_TABLE, binary.NativeEndian.AppendUint32(nil, 1000))...)
+	data = append(data, attr(unix.RTA_DST, []byte{10, 1, 2, 0})...)
+	data = append(data, attr(unix.RTA_GATEWAY, []byte{10, 0, 0, 1})...)
+	m := syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: unix.RTM_NEWROUTE}, Data: data}
+	got, ok := parse_route_message(m)
+	want := kernelRoute{
+		Prefix:   netip.MustParsePrefix("10.1.2.0/24"),
+		Gateway:  netip.MustParseAddr("10.0.0.1"),
+		Table:    1000,
+		Protocol: unix.RTPROT_STATIC,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNICAST,
+	}
+	if !ok || got != want {
+		t.Errorf("parse_route_message() = %+v %v, want %+v", got, ok, want)
+	}
+	// デフォルト経路にはRTA_DSTがない
+	rtmsg[1] = 0
+	got, ok = parse_route_message(syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: unix.RTM_NEWROUTE}, Data: rtmsg})
+	if !ok || got.Prefix != netip.MustParsePrefix("0.0.0.0/0") {
+		t.Errorf("default route: %+v %v", got, ok)
+	}
+	m.Header.Type = unix.RTM_NEWADDR
+	if _, ok := parse_route_message(m); ok {
+		t.Errorf("address message is parsed as a route")
+	}
+}
+
+func TestOwnRouteChanges(t *testing.T) {
+	// nlmsghdrを付けたメッセージ
+	message := func(msgType uint16, table uint8) []byte {
+		data := []byte{unix.AF_INET, 24, 0, 0, table, unix.RTPROT_BOOT, unix.RT_SCOPE_UNIVERSE, unix.RTN_UNICAST, 0, 0, 0, 0}
+		data = append(data, 8, 0, unix.RTA_DST, 0, 10, 1, 2, 0)
+		b := binary.NativeEndian.AppendUint32(nil, uint32(unix.NLMSG_HDRLEN+len(data)))
+		b = binary.NativeEndian.AppendUint16(b, msgType)
+		b = append(b, make([]byte, 10)...)
+		return append(b, data...)
+	}
+	own, err := strconv.Atoi(ROUTINGTABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"add to our table", message(unix.RTM_NEWROUTE, uint8(own)), true},
+		{"delete from our table", append(message(unix.RTM_DELROUTE, uint8(own)), message(unix.RTM_NEWROUTE, uint8(own))...), true},
+		{"main table", message(unix.RTM_NEWROUTE, unix.RT_TABLE_MAIN), false},
+		{"mixed", append(message(unix.RTM_NEWROUTE, uint8(own)), message(unix.RTM_DELROUTE, unix.RT_TABLE_MAIN)...), false},
+		{"address", message(unix.RTM_NEWADDR, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := own_route_changes(tt.b); got != tt.want {
+				t.Errorf("own_route_changes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
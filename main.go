@@ -5,7 +5,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os/exec"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 const ACTIVE bool = true
@@ -17,48 +20,121 @@ func main() {
 	mode := flag.String("mode", "active", "active or passive")
 	//TODO: modeのvalidation欲しいな
 	AS := flag.Uint("as", 65000, "AS number")
+	routerIDStr := flag.String("router-id", "", "router id (IPv4 address). chosen from the interfaces if empty")
+	configPath := flag.String("config", "", "path to the config file (json)")
 
 	flag.Parse()
+
+	routerID, err := router_id(*routerIDStr)
+	if err != nil {
+		log.Fatalf("failed to select router-id: %v", err)
+	}
+	log.Printf("router-id: %v", routerID)
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	if !config.ClusterID.IsValid() {
+		config.ClusterID = routerID
+	}
+	local := LocalInfo{
+		AS:          uint16(*AS),
+		RouterID:    routerID,
+		ClusterID:   config.ClusterID,
+		ConfedID:    config.ConfederationID,
+		ConfedPeers: config.ConfederationPeers,
+	}
+	if config.GracefulRestart != nil {
+		local.GR = &GracefulRestartState{Config: config.GracefulRestart.withDefaults(), StartedAt: time.Now()}
+	}
+	// 前回の経路を残す場合はOPENを送る前に再起動中かどうかを決める
+	fib, err := reconcile_kernel_state(local.GR != nil && local.GR.Config.ForwardingState)
+	if err != nil {
+		log.Fatalf("failed to add ip rule: %v", err)
+	}
+	if local.GR != nil && len(fib) > 0 {
+		log.Printf("restarting with %d routes preserved in table %s", len(fib), ROUTINGTABLE)
+		local.GR.Restarting = true
+	}
 	// using the ipv6 link-local address will be interesting
 	go maintain_arptable()
 
 	var peers []Peer
 	if *mode == "active" {
-		peers = peers_ifi(ACTIVE, uint16(*AS))
+		peers = peers_ifi(ACTIVE, local, config)
 	} else if *mode == "passive" {
-		peers = peers_ifi(PASSIVE, uint16(*AS))
+		peers = peers_ifi(PASSIVE, local, config)
 	} else {
 		log.Fatal("usage: ./local-clos [active|passive]")
 	}
+	peers = append(peers, peers_addr(*mode == "active", local, config)...)
 	for _, peer := range peers {
-		fmt.Printf("%v\n", peer)
+		log.Printf("peer: %v", peer)
 	}
-	adjConnected, err := AdjFromLocal(uint16(*AS))
+	adjConnected, err := localRoutes(config)
 	log.Printf("adjConnected: %v", adjConnected)
 	if err != nil {
-		log.Fatalf("failed to get adj from local: %v", err)
+		log.Fatalf("failed to get local routes: %v", err)
+	}
+	localCh := make(chan RibAdj)
+	go watch_local_routes(config, adjConnected, localCh)
+	// LoadConfigで確かめてあるのでエラーにはならない
+	routeMaps, err := CompileRouteMaps(config.Policy)
+	if err != nil {
+		log.Fatalf("failed to compile policy: %v", err)
 	}
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	addPeerCh := make(chan Peer)
+	delPeerCh := make(chan Peer, 1)
 	LocRib := LocRib{
-		adjBest:      adjConnected,
-		adjConnected: adjConnected,
-		peers:        peers,
+		adjConnected:  adjConnected,
+		localCh:       localCh,
+		peers:         peers,
+		routerID:      routerID,
+		stopCh:        stopCh,
+		batchInterval: time.Duration(config.UpdateBatchInterval),
+		addPeerCh:     addPeerCh,
+		delPeerCh:     delPeerCh,
+		fib:           fib,
+		bestPath:      config.BestPath,
+		routeMaps:     routeMaps,
+		aggregates:    config.Aggregates,
+		AS:            local.ExternalAS(),
+		queryCh:       make(chan chan *LocRibSnapshot),
 	}
-
-	for {
-		err = exec.Command("ip", "route", "del", "table", ROUTINGTABLE).Run()
-		if err != nil {
-			break
-		}
+	LocRib.updateBestPath()
+	// 全てのピアから最初の経路を受け取るまでFIBを更新しない
+	syncTimeout := time.Duration(config.InitialSyncTimeout)
+	if local.GR != nil && local.GR.Restarting && time.Duration(local.GR.Config.RestartTime) > syncTimeout {
+		syncTimeout = time.Duration(local.GR.Config.RestartTime)
+	}
+	if syncTimeout > 0 {
+		LocRib.syncTimer = time.After(syncTimeout)
 	}
 
-	err = exec.Command("ip", "rule", "add", "table", ROUTINGTABLE).Run()
-	if err != nil {
-		log.Fatalf("failed to add ip rule: %v", err)
+	if len(config.DynamicNeighbors) != 0 {
+		dynamic := NewDynamicNeighbors(local, config, addPeerCh, delPeerCh)
+		if err := dynamic.Listen(); err != nil {
+			log.Fatalf("failed to start dynamic neighbors: %v", err)
+		}
 	}
 
 	go LocRib.Sig()
-	for {
-		LocRib.Handle()
+	for LocRib.Handle() {
 		LocRib.UpdateRoutingTable()
 	}
+	// SIGUSR2ではNOTIFICATIONを送らずに終了し、ピアに経路を残してもらう
+	if LocRib.stopSignal == syscall.SIGUSR2 && local.GR != nil {
+		if local.GR.Config.ForwardingState {
+			log.Printf("graceful restart: keeping routes in table %s", ROUTINGTABLE)
+			return
+		}
+		log.Printf("graceful restart: forwarding_state is off. cleaning up routes")
+		cleanup_kernel_state()
+		return
+	}
+	LocRib.Shutdown(fmt.Sprintf("local-clos %v is shutting down", routerID))
+	cleanup_kernel_state()
+	log.Println("local-clos finished")
 }
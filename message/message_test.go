@@ -91,7 +91,7 @@ func TestMarshal(t *testing.T) {
 					Id:       1,
 				},
 			},
-			want:    append(marker, []byte{0, 28, 1, 4, 0, 1, 0, 1, 0, 0, 0, 1}...),
+			want:    append(marker, []byte{0, 29, 1, 4, 0, 1, 0, 1, 0, 0, 0, 1, 0}...),
 			wantErr: false,
 		},
 		{
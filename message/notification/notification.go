@@ -1,18 +1,139 @@
 package notifiacation
 
-import "io"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidLength error = errors.New("invalid length")
+)
+
+// Error Code (RFC 4271 4.5)
+var (
+	ErrorCodeMessageHeader    uint8 = 1
+	ErrorCodeOpenMessage      uint8 = 2
+	ErrorCodeUpdateMessage    uint8 = 3
+	ErrorCodeHoldTimerExpired uint8 = 4
+	ErrorCodeFSM              uint8 = 5
+	ErrorCodeCease            uint8 = 6
+)
+
+// OPEN Message Error の Error Subcode
+var (
+	OpenErrorUnsupportedVersion uint8 = 1
+	OpenErrorBadPeerAS          uint8 = 2
+	OpenErrorBadBGPIdentifier   uint8 = 3
+)
+
+// UPDATE Message Error の Error Subcode
+var (
+	UpdateErrorMalformedAttributeList    uint8 = 1
+	UpdateErrorUnrecognizedWellKnownAttr uint8 = 2
+	UpdateErrorMissingWellKnownAttr      uint8 = 3
+	UpdateErrorAttributeFlagsError       uint8 = 4
+	UpdateErrorAttributeLengthError      uint8 = 5
+	UpdateErrorInvalidOriginAttribute    uint8 = 6
+	UpdateErrorInvalidNextHopAttribute   uint8 = 8
+	UpdateErrorOptionalAttributeError    uint8 = 9
+	UpdateErrorInvalidNetworkField       uint8 = 10
+	UpdateErrorMalformedASPath           uint8 = 11
+)
+
+// Cease の Error Subcode (RFC 4486)
+var (
+	CeaseMaxPrefixReached         uint8 = 1
+	CeaseAdministrativeShutdown   uint8 = 2
+	CeasePeerDeconfigured         uint8 = 3
+	CeaseAdministrativeReset      uint8 = 4
+	CeaseConnectionRejected       uint8 = 5
+	CeaseOtherConfigurationChange uint8 = 6
+	CeaseConnectionCollision      uint8 = 7
+	CeaseOutOfResources           uint8 = 8
+)
+
+// RFC 8203 で許される Shutdown Communication の最大長
+const ShutdownCommunicationMaxLength int = 128
 
 type Notification struct {
+	ErrorCode    uint8
+	ErrorSubcode uint8
+	Data         []byte
+}
+
+func New(code uint8, subcode uint8, data []byte) *Notification {
+	return &Notification{
+		ErrorCode:    code,
+		ErrorSubcode: subcode,
+		Data:         data,
+	}
+}
+
+// Administrative Shutdown/Reset に RFC 8203 の Shutdown Communication を載せる
+// 128 byte を超える分はUTF-8の文字境界で切り捨てる
+func NewShutdown(subcode uint8, communication string) *Notification {
+	b := []byte(communication)
+	if len(b) > ShutdownCommunicationMaxLength {
+		b = b[:ShutdownCommunicationMaxLength]
+		for !utf8.Valid(b) {
+			b = b[:len(b)-1]
+		}
+	}
+	data := append([]byte{byte(len(b))}, b...)
+	return New(ErrorCodeCease, subcode, data)
+}
+
+// Maximum Number of Prefixes Reached (RFC 4486 4)
+// DataにはAFI, SAFIと上限値を入れる
+func NewMaxPrefix(afi uint16, safi uint8, limit uint32) *Notification {
+	data := make([]byte, 7)
+	binary.BigEndian.PutUint16(data, afi)
+	data[2] = safi
+	binary.BigEndian.PutUint32(data[3:], limit)
+	return New(ErrorCodeCease, CeaseMaxPrefixReached, data)
+}
+
+// Shutdown Communication を取り出す
+// 含まれていない場合は空文字列を返す
+func (n *Notification) ShutdownCommunication() string {
+	if n.ErrorCode != ErrorCodeCease {
+		return ""
+	}
+	if n.ErrorSubcode != CeaseAdministrativeShutdown && n.ErrorSubcode != CeaseAdministrativeReset {
+		return ""
+	}
+	if len(n.Data) == 0 || int(n.Data[0]) > len(n.Data)-1 {
+		return ""
+	}
+	return string(n.Data[1 : 1+int(n.Data[0])])
 }
 
-func New() *Notification {
-	return &Notification{}
+func (n *Notification) String() string {
+	s := fmt.Sprintf("code %d subcode %d", n.ErrorCode, n.ErrorSubcode)
+	if c := n.ShutdownCommunication(); c != "" {
+		s += fmt.Sprintf(" %q", c)
+	}
+	return s
 }
 
 func (n *Notification) Marshal() ([]byte, error) {
-	return nil, nil
+	b := []byte{n.ErrorCode, n.ErrorSubcode}
+	return append(b, n.Data...), nil
 }
 
 func (n *Notification) UnMarshal(r io.Reader, l uint16) error {
+	if l < 2 {
+		return ErrInvalidLength
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	n.ErrorCode = b[0]
+	n.ErrorSubcode = b[1]
+	n.Data = b[2:]
 	return nil
 }
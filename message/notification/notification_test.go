@@ -0,0 +1,89 @@
+package notifiacation
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		n    *Notification
+		want []byte
+	}{
+		{
+			name: "no_data",
+			n:    New(ErrorCodeHoldTimerExpired, 0, nil),
+			want: []byte{4, 0},
+		},
+		{
+			name: "shutdown",
+			n:    NewShutdown(CeaseAdministrativeShutdown, "bye"),
+			want: []byte{6, 2, 3, 'b', 'y', 'e'},
+		},
+		{
+			name: "max_prefix",
+			n:    NewMaxPrefix(1, 1, 256),
+			want: []byte{6, 1, 0, 1, 1, 0, 0, 1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := tt.n.Marshal(); !bytes.Equal(got, tt.want) {
+				t.Errorf("Marshal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnMarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    *Notification
+		wantErr bool
+	}{
+		{
+			name: "shutdown",
+			b:    []byte{6, 2, 3, 'b', 'y', 'e'},
+			want: &Notification{ErrorCode: 6, ErrorSubcode: 2, Data: []byte{3, 'b', 'y', 'e'}},
+		},
+		{
+			name:    "too_short",
+			b:       []byte{6},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n Notification
+			err := n.UnMarshal(bytes.NewReader(tt.b), uint16(len(tt.b)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnMarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(&n, tt.want) {
+				t.Errorf("UnMarshal() = %v, want %v", &n, tt.want)
+			}
+		})
+	}
+}
+
+func TestShutdownCommunication(t *testing.T) {
+	long := strings.Repeat("あ", 50) // 150 byte
+	n := NewShutdown(CeaseAdministrativeShutdown, long)
+	if int(n.Data[0]) > ShutdownCommunicationMaxLength {
+		t.Fatalf("communication is too long: %d", n.Data[0])
+	}
+	got := n.ShutdownCommunication()
+	if !strings.HasPrefix(long, got) || len(got) != 126 {
+		t.Errorf("ShutdownCommunication() = %q", got)
+	}
+	if New(ErrorCodeCease, CeaseMaxPrefixReached, []byte{0, 1}).ShutdownCommunication() != "" {
+		t.Error("max prefix notification should not have a shutdown communication")
+	}
+}
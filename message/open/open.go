@@ -1,9 +1,9 @@
 package open
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -11,13 +11,32 @@ var (
 	ErrInvalidLength error = errors.New("invalid length")
 )
 
+// Optional Parameter Type
+var (
+	ParamTypeCapabilities uint8 = 2
+)
+
+// Capability Code
+var (
+	CapabilityGracefulRestart uint8 = 64
+)
+
+type Capability struct {
+	Code  uint8
+	Value []byte
+}
+
 type Open struct {
-	Version  uint8
-	AS       uint16
-	Holdtime uint16
-	Id       uint32
+	Version      uint8
+	AS           uint16
+	Holdtime     uint16
+	Id           uint32
+	Capabilities []Capability
 }
 
+// Optional Parametersより前の固定長部分
+const fixedLength = 9
+
 func New(version uint8, AS uint16, holdtime uint16, id uint32) *Open {
 	return &Open{
 		Version:  version,
@@ -27,20 +46,158 @@ func New(version uint8, AS uint16, holdtime uint16, id uint32) *Open {
 	}
 }
 
+// Capabilityは全て1つのCapabilities Optional Parameterに入れる (RFC 5492)
 func (o *Open) Marshal() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, o)
-	if err != nil {
-		return nil, err
+	b := []byte{o.Version}
+	b = binary.BigEndian.AppendUint16(b, o.AS)
+	b = binary.BigEndian.AppendUint16(b, o.Holdtime)
+	b = binary.BigEndian.AppendUint32(b, o.Id)
+	var caps []byte
+	for _, c := range o.Capabilities {
+		if len(c.Value) > 255 {
+			return nil, fmt.Errorf("capability %d is too long: %d", c.Code, len(c.Value))
+		}
+		caps = append(caps, c.Code, uint8(len(c.Value)))
+		caps = append(caps, c.Value...)
+	}
+	if len(caps) == 0 {
+		return append(b, 0), nil
 	}
-	return buf.Bytes(), nil
+	if len(caps) > 253 {
+		return nil, fmt.Errorf("capabilities are too long: %d", len(caps))
+	}
+	b = append(b, uint8(len(caps)+2), ParamTypeCapabilities, uint8(len(caps)))
+	return append(b, caps...), nil
 }
 
+// Optional Parameters Lengthを含まない古い形式も受け付ける
 func (o *Open) UnMarshal(r io.Reader, l uint16) error {
-	// length check is ignored now(just lazy)
-	err := binary.Read(r, binary.BigEndian, o)
-	if err != nil {
+	if l < fixedLength {
+		return ErrInvalidLength
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
 		return err
 	}
+	o.Version = b[0]
+	o.AS = binary.BigEndian.Uint16(b[1:])
+	o.Holdtime = binary.BigEndian.Uint16(b[3:])
+	o.Id = binary.BigEndian.Uint32(b[5:])
+	if l == fixedLength {
+		return nil
+	}
+	optLen := int(b[fixedLength])
+	params := b[fixedLength+1:]
+	if optLen != len(params) {
+		return ErrInvalidLength
+	}
+	for len(params) > 0 {
+		if len(params) < 2 || len(params) < 2+int(params[1]) {
+			return ErrInvalidLength
+		}
+		paramType, value := params[0], params[2:2+int(params[1])]
+		params = params[2+int(params[1]):]
+		// Capabilities以外のパラメータは無視する
+		if paramType != ParamTypeCapabilities {
+			continue
+		}
+		for len(value) > 0 {
+			if len(value) < 2 || len(value) < 2+int(value[1]) {
+				return ErrInvalidLength
+			}
+			o.Capabilities = append(o.Capabilities, Capability{
+				Code:  value[0],
+				Value: value[2 : 2+int(value[1])],
+			})
+			value = value[2+int(value[1]):]
+		}
+	}
 	return nil
 }
+
+// codeのCapabilityを探す
+func (o *Open) Capability(code uint8) (Capability, bool) {
+	for _, c := range o.Capabilities {
+		if c.Code == code {
+			return c, true
+		}
+	}
+	return Capability{}, false
+}
+
+// Graceful Restart Capability (RFC 4724 3) のAFI/SAFIごとの情報
+type GracefulRestartFamily struct {
+	AFI  uint16
+	SAFI uint8
+	// 再起動の間も転送状態を保持していたか
+	ForwardingState bool
+}
+
+type GracefulRestart struct {
+	// 再起動したところかどうか
+	Restarting bool
+	// 秒. 12bitまで
+	RestartTime uint16
+	Families    []GracefulRestartFamily
+}
+
+const MaxRestartTime uint16 = 0x0fff
+
+func (g GracefulRestart) Capability() Capability {
+	flags := g.RestartTime & MaxRestartTime
+	if g.Restarting {
+		flags |= 0x8000
+	}
+	b := binary.BigEndian.AppendUint16(nil, flags)
+	for _, f := range g.Families {
+		b = binary.BigEndian.AppendUint16(b, f.AFI)
+		b = append(b, f.SAFI)
+		if f.ForwardingState {
+			b = append(b, 0x80)
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return Capability{Code: CapabilityGracefulRestart, Value: b}
+}
+
+func ParseGracefulRestart(c Capability) (GracefulRestart, error) {
+	var g GracefulRestart
+	if c.Code != CapabilityGracefulRestart || len(c.Value) < 2 || (len(c.Value)-2)%4 != 0 {
+		return g, ErrInvalidLength
+	}
+	flags := binary.BigEndian.Uint16(c.Value)
+	g.Restarting = flags&0x8000 != 0
+	g.RestartTime = flags & MaxRestartTime
+	for b := c.Value[2:]; len(b) > 0; b = b[4:] {
+		g.Families = append(g.Families, GracefulRestartFamily{
+			AFI:             binary.BigEndian.Uint16(b),
+			SAFI:            b[2],
+			ForwardingState: b[3]&0x80 != 0,
+		})
+	}
+	return g, nil
+}
+
+// ピアがGraceful Restartに対応していればその情報を返す
+func (o *Open) GracefulRestart() (GracefulRestart, bool) {
+	c, ok := o.Capability(CapabilityGracefulRestart)
+	if !ok {
+		return GracefulRestart{}, false
+	}
+	g, err := ParseGracefulRestart(c)
+	if err != nil {
+		return GracefulRestart{}, false
+	}
+	return g, true
+}
+
+// afi/safiの転送状態を保持していたか
+func (g GracefulRestart) ForwardingState(afi uint16, safi uint8) bool {
+	for _, f := range g.Families {
+		if f.AFI == afi && f.SAFI == safi {
+			return f.ForwardingState
+		}
+	}
+	return false
+}
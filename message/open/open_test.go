@@ -2,6 +2,7 @@ package open
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 )
 
@@ -36,7 +37,7 @@ func TestNew(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := New(tt.args.version, tt.args.AS, tt.args.holdtime, tt.args.id); *got != *tt.want {
+			if got := New(tt.args.version, tt.args.AS, tt.args.holdtime, tt.args.id); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("New() = %v, want %v", got, tt.want)
 			}
 		})
@@ -57,7 +58,7 @@ func TestMarshal(t *testing.T) {
 				Holdtime: 1,
 				Id:       1,
 			},
-			want: []byte{4, 0, 1, 0, 1, 0, 0, 0, 1},
+			want: []byte{4, 0, 1, 0, 1, 0, 0, 0, 1, 0},
 		},
 		{
 			name: "bigendian_2",
@@ -67,7 +68,7 @@ func TestMarshal(t *testing.T) {
 				Holdtime: 256,
 				Id:       256,
 			},
-			want: []byte{4, 0, 1, 1, 0, 0, 0, 1, 0},
+			want: []byte{4, 0, 1, 1, 0, 0, 0, 1, 0, 0},
 		},
 		{
 			name: "bigendian_3",
@@ -77,7 +78,7 @@ func TestMarshal(t *testing.T) {
 				Holdtime: 1,
 				Id:       256 * 256,
 			},
-			want: []byte{4, 1, 0, 0, 1, 0, 1, 0, 0},
+			want: []byte{4, 1, 0, 0, 1, 0, 1, 0, 0, 0},
 		},
 		{
 			name: "bigendian_4",
@@ -87,7 +88,7 @@ func TestMarshal(t *testing.T) {
 				Holdtime: 256,
 				Id:       256 * 256 * 256,
 			},
-			want: []byte{4, 1, 0, 1, 0, 1, 0, 0, 0},
+			want: []byte{4, 1, 0, 1, 0, 1, 0, 0, 0, 0},
 		},
 	}
 
@@ -100,3 +101,69 @@ func TestMarshal(t *testing.T) {
 	}
 
 }
+
+func TestGracefulRestart(t *testing.T) {
+	o := New(4, 65000, 180, 1)
+	g := GracefulRestart{
+		Restarting:  true,
+		RestartTime: 120,
+		Families:    []GracefulRestartFamily{{AFI: 1, SAFI: 1, ForwardingState: true}},
+	}
+	o.Capabilities = append(o.Capabilities, g.Capability())
+	b, err := o.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{4, 0xfd, 0xe8, 0, 180, 0, 0, 0, 1, 10, 2, 8, 64, 6, 0x80, 120, 0, 1, 1, 0x80}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("Marshal() = %v, want %v", b, want)
+	}
+	var got Open
+	if err := got.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	gotGR, ok := got.GracefulRestart()
+	if !ok || !reflect.DeepEqual(gotGR, g) {
+		t.Errorf("GracefulRestart() = %v, %v, want %v", gotGR, ok, g)
+	}
+	if !gotGR.ForwardingState(1, 1) || gotGR.ForwardingState(2, 1) {
+		t.Errorf("invalid forwarding state: %v", gotGR)
+	}
+}
+
+func TestUnMarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		want    *Open
+		wantErr bool
+	}{
+		{
+			name: "without_optional_parameters_length",
+			b:    []byte{4, 0, 1, 0, 180, 0, 0, 0, 1},
+			want: &Open{Version: 4, AS: 1, Holdtime: 180, Id: 1},
+		},
+		{
+			name: "unknown_parameter",
+			b:    []byte{4, 0, 1, 0, 180, 0, 0, 0, 1, 3, 1, 1, 0},
+			want: &Open{Version: 4, AS: 1, Holdtime: 180, Id: 1},
+		},
+		{
+			name:    "invalid_parameter_length",
+			b:       []byte{4, 0, 1, 0, 180, 0, 0, 0, 1, 4, 2, 8, 64},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Open
+			err := got.UnMarshal(bytes.NewReader(tt.b), uint16(len(tt.b)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnMarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(&got, tt.want) {
+				t.Errorf("UnMarshal() = %v, want %v", &got, tt.want)
+			}
+		})
+	}
+}
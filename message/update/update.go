@@ -2,9 +2,23 @@ package update
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// 属性の長さがPath Attributesに収まらない (RFC 4271 6.3 Malformed Attribute List)
+var ErrMalformedAttributeList error = errors.New("malformed attribute list")
+
+// Address Family Identifier と Subsequent Address Family Identifier
+var (
+	AFIIPv4     uint16 = 1
+	AFIIPv6     uint16 = 2
+	SAFIUnicast uint8  = 1
 )
 
 type AttrFlags uint8
@@ -42,8 +56,24 @@ var (
 	AttrTypeLocalPref       AttrType = 5
 	AttrTypeAtomicAggregate AttrType = 6
 	AttrTypeAggregator      AttrType = 7
+	AttrTypeCommunities     AttrType = 8
+	AttrTypeOriginatorID    AttrType = 9
+	AttrTypeClusterList     AttrType = 10
+	AttrTypeMPUnreachNLRI   AttrType = 15
+	AttrTypeExtCommunities  AttrType = 16
 )
 
+// 属性のヘッダを付ける. 値が255byteを超える場合はExtended Lengthを使う
+func marshalAttr(flags AttrFlags, attrType AttrType, value []byte) []byte {
+	if len(value) > 255 {
+		b := []byte{byte(flags | AttrFlagsExtendedLength), byte(attrType)}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+		return append(b, value...)
+	}
+	b := []byte{byte(flags), byte(attrType), byte(len(value))}
+	return append(b, value...)
+}
+
 type Origin uint8
 
 var (
@@ -63,27 +93,110 @@ func (o *Origin) marshal() ([]byte, error) {
 
 type VALUE_SEGMENT_TYPE uint8
 
+// AS_CONFED_SEQUENCEとAS_CONFED_SETはRFC 5065
 var (
-	VALUE_SEGMENT_AS_SET      VALUE_SEGMENT_TYPE = 1
-	VALUE_SEGMENT_AS_SEQUENCE VALUE_SEGMENT_TYPE = 2
+	VALUE_SEGMENT_AS_SET             VALUE_SEGMENT_TYPE = 1
+	VALUE_SEGMENT_AS_SEQUENCE        VALUE_SEGMENT_TYPE = 2
+	VALUE_SEGMENT_AS_CONFED_SEQUENCE VALUE_SEGMENT_TYPE = 3
+	VALUE_SEGMENT_AS_CONFED_SET      VALUE_SEGMENT_TYPE = 4
 )
 
-type AS_PATH struct {
+// 1つのセグメントに入れられるASの数
+const MAX_SEGMENT_LENGTH int = 255
+
+type AS_PATH_SEGMENT struct {
 	VALUE_SEGMENT VALUE_SEGMENT_TYPE
 	AS_SEQUENCE   []uint16
 }
 
+func (s AS_PATH_SEGMENT) confed() bool {
+	return s.VALUE_SEGMENT == VALUE_SEGMENT_AS_CONFED_SEQUENCE || s.VALUE_SEGMENT == VALUE_SEGMENT_AS_CONFED_SET
+}
+
+// 自AS内の経路ではAS_PATHは空になる
+type AS_PATH []AS_PATH_SEGMENT
+
+// 最良経路の選択に使う長さ
+// AS_SETは1つと数え、コンフェデレーションのセグメントは数えない (RFC 4271 9.1.2.2, RFC 5065 5.3)
+func (a AS_PATH) Length() int {
+	l := 0
+	for _, segment := range a {
+		switch segment.VALUE_SEGMENT {
+		case VALUE_SEGMENT_AS_SEQUENCE:
+			l += len(segment.AS_SEQUENCE)
+		case VALUE_SEGMENT_AS_SET:
+			l += 1
+		}
+	}
+	return l
+}
+
+// コンフェデレーションのセグメントを含めてASが含まれているかどうか
+func (a AS_PATH) Contains(AS uint16) bool {
+	for _, segment := range a {
+		for _, as := range segment.AS_SEQUENCE {
+			if as == AS {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// コンフェデレーションのセグメントを除いた部分にASが含まれているかどうか
+func (a AS_PATH) ContainsOutsideConfed(AS uint16) bool {
+	return a.WithoutConfed().Contains(AS)
+}
+
+func (a AS_PATH) prepend(segmentType VALUE_SEGMENT_TYPE, AS uint16) AS_PATH {
+	if len(a) != 0 && a[0].VALUE_SEGMENT == segmentType && len(a[0].AS_SEQUENCE) < MAX_SEGMENT_LENGTH {
+		first := AS_PATH_SEGMENT{
+			VALUE_SEGMENT: segmentType,
+			AS_SEQUENCE:   append([]uint16{AS}, a[0].AS_SEQUENCE...),
+		}
+		return append(AS_PATH{first}, a[1:]...)
+	}
+	first := AS_PATH_SEGMENT{VALUE_SEGMENT: segmentType, AS_SEQUENCE: []uint16{AS}}
+	return append(AS_PATH{first}, a...)
+}
+
+// 先頭にASを付けた新しいAS_PATHを返す
+func (a AS_PATH) Prepend(AS uint16) AS_PATH {
+	return a.prepend(VALUE_SEGMENT_AS_SEQUENCE, AS)
+}
+
+// 先頭のAS_CONFED_SEQUENCEにメンバーASを付けた新しいAS_PATHを返す
+func (a AS_PATH) PrependConfed(AS uint16) AS_PATH {
+	return a.prepend(VALUE_SEGMENT_AS_CONFED_SEQUENCE, AS)
+}
+
+// コンフェデレーションの外に出すときのためにコンフェデレーションのセグメントを取り除く
+func (a AS_PATH) WithoutConfed() AS_PATH {
+	path := AS_PATH{}
+	for _, segment := range a {
+		if segment.confed() {
+			continue
+		}
+		path = append(path, segment)
+	}
+	return path
+}
+
 func (a *AS_PATH) marshal() ([]byte, error) {
-	b := make([]byte, 3+1+1+2*len(a.AS_SEQUENCE))
-	b[0] = byte(AttrFlagsTransitive)
-	b[1] = byte(AttrTypeASPath)
-	b[2] = uint8(1 + 1 + 2*len(a.AS_SEQUENCE))
-	b[3] = byte(a.VALUE_SEGMENT)
-	b[4] = uint8(len(a.AS_SEQUENCE))
-	for i, as := range a.AS_SEQUENCE {
-		binary.BigEndian.PutUint16(b[5+2*i:], as)
+	value := make([]byte, 0)
+	for _, segment := range *a {
+		if len(segment.AS_SEQUENCE) == 0 {
+			continue
+		}
+		if len(segment.AS_SEQUENCE) > MAX_SEGMENT_LENGTH {
+			return nil, fmt.Errorf("too long as path segment: %v", len(segment.AS_SEQUENCE))
+		}
+		value = append(value, byte(segment.VALUE_SEGMENT), byte(len(segment.AS_SEQUENCE)))
+		for _, as := range segment.AS_SEQUENCE {
+			value = binary.BigEndian.AppendUint16(value, as)
+		}
 	}
-	return b, nil
+	return marshalAttr(AttrFlagsTransitive, AttrTypeASPath, value), nil
 }
 
 type NEXT_HOP netip.Addr
@@ -115,19 +228,303 @@ func (l *LOCAL_PREF) marshal() ([]byte, error) {
 	return b, nil
 }
 
+// 隣接ASへの入口の優先度 (RFC 4271 5.1.4). 小さいほど優先
+type MULTI_EXIT_DISC uint32
+
+func (m *MULTI_EXIT_DISC) marshal() ([]byte, error) {
+	return marshalAttr(AttrFlagsOptional, AttrTypeMultiExitDisc, binary.BigEndian.AppendUint32(nil, uint32(*m))), nil
+}
+
+// 集約で経路の情報が失われたことを表す. 値は持たない
 type ATOMIC_AGGREGATE bool
 
+func (a *ATOMIC_AGGREGATE) marshal() ([]byte, error) {
+	return marshalAttr(AttrFlagsTransitive, AttrTypeAtomicAggregate, nil), nil
+}
+
+// 経路を集約したルータのASとrouter-id
+type AGGREGATOR struct {
+	AS      uint16
+	Address netip.Addr
+}
+
+func (a *AGGREGATOR) marshal() ([]byte, error) {
+	if !a.Address.Is4() {
+		return nil, fmt.Errorf("invalid aggregator address: %v", a.Address)
+	}
+	b := a.Address.As4()
+	value := binary.BigEndian.AppendUint16(nil, a.AS)
+	value = append(value, b[:]...)
+	return marshalAttr(AttrFlagsOptional|AttrFlagsTransitive, AttrTypeAggregator, value), nil
+}
+
+// 経路をiBGPに最初に広告したルータのrouter-id (RFC 4456)
+type ORIGINATOR_ID netip.Addr
+
+func (o *ORIGINATOR_ID) marshal() ([]byte, error) {
+	addr := netip.Addr(*o)
+	if !addr.Is4() {
+		return nil, fmt.Errorf("invalid originator id: %v", addr)
+	}
+	b := addr.As4()
+	return marshalAttr(AttrFlagsOptional, AttrTypeOriginatorID, b[:]), nil
+}
+
+// 経路が通過したクラスタのID (RFC 4456)
+// 新しいものほど前に入る
+type CLUSTER_LIST []netip.Addr
+
+func (c *CLUSTER_LIST) marshal() ([]byte, error) {
+	value := make([]byte, 0, 4*len(*c))
+	for _, id := range *c {
+		if !id.Is4() {
+			return nil, fmt.Errorf("invalid cluster id: %v", id)
+		}
+		b := id.As4()
+		value = append(value, b[:]...)
+	}
+	return marshalAttr(AttrFlagsOptional, AttrTypeClusterList, value), nil
+}
+
+// Community (RFC 1997). 上位16bitがAS, 下位16bitが値
+type Community uint32
+
+// well-known community
+var (
+	CommunityNoExport          Community = 0xFFFFFF01
+	CommunityNoAdvertise       Community = 0xFFFFFF02
+	CommunityNoExportSubconfed Community = 0xFFFFFF03
+)
+
+var wellKnownCommunities = map[string]Community{
+	"no-export":           CommunityNoExport,
+	"no-advertise":        CommunityNoAdvertise,
+	"no-export-subconfed": CommunityNoExportSubconfed,
+}
+
+// "AS:値"かwell-known communityの名前を読む
+func ParseCommunity(s string) (Community, error) {
+	if c, ok := wellKnownCommunities[s]; ok {
+		return c, nil
+	}
+	AS, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid community: %v", s)
+	}
+	high, err := strconv.ParseUint(AS, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community: %v", s)
+	}
+	low, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid community: %v", s)
+	}
+	return Community(high<<16 | low), nil
+}
+
+func (c Community) String() string {
+	for name, community := range wellKnownCommunities {
+		if c == community {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d:%d", c>>16, c&0xFFFF)
+}
+
+type COMMUNITIES []Community
+
+func (c *COMMUNITIES) marshal() ([]byte, error) {
+	value := make([]byte, 0, 4*len(*c))
+	for _, community := range *c {
+		value = binary.BigEndian.AppendUint32(value, uint32(community))
+	}
+	return marshalAttr(AttrFlagsOptional|AttrFlagsTransitive, AttrTypeCommunities, value), nil
+}
+
+func (c COMMUNITIES) Contains(community Community) bool {
+	for _, v := range c {
+		if v == community {
+			return true
+		}
+	}
+	return false
+}
+
+// Extended Community (RFC 4360)
+// 先頭のTypeとSub-Typeで意味が決まる
+type ExtCommunity [8]byte
+
+// Typeの0x40が立っていればASの外に伝えない
+func (c ExtCommunity) Transitive() bool {
+	return c[0]&0x40 == 0
+}
+
+// Link Bandwidth (draft-ietf-idr-link-bandwidth) のTypeとSub-Type
+var (
+	ExtCommunityTypeLinkBandwidth    uint8 = 0x40
+	ExtCommunitySubTypeLinkBandwidth uint8 = 0x04
+)
+
+// bandwidthはbyte/sで、IEEEの浮動小数点数で入れる
+func NewLinkBandwidth(AS uint16, bandwidth float32) ExtCommunity {
+	c := ExtCommunity{ExtCommunityTypeLinkBandwidth, ExtCommunitySubTypeLinkBandwidth}
+	binary.BigEndian.PutUint16(c[2:], AS)
+	binary.BigEndian.PutUint32(c[4:], math.Float32bits(bandwidth))
+	return c
+}
+
+func (c ExtCommunity) LinkBandwidth() (uint16, float32, bool) {
+	if c[0] != ExtCommunityTypeLinkBandwidth || c[1] != ExtCommunitySubTypeLinkBandwidth {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(c[2:]), math.Float32frombits(binary.BigEndian.Uint32(c[4:])), true
+}
+
+type EXTENDED_COMMUNITIES []ExtCommunity
+
+func (e *EXTENDED_COMMUNITIES) marshal() ([]byte, error) {
+	value := make([]byte, 0, 8*len(*e))
+	for _, c := range *e {
+		value = append(value, c[:]...)
+	}
+	return marshalAttr(AttrFlagsOptional|AttrFlagsTransitive, AttrTypeExtCommunities, value), nil
+}
+
+// Link Bandwidthがあればその値を返す
+func (e EXTENDED_COMMUNITIES) LinkBandwidth() (float32, bool) {
+	for _, c := range e {
+		if _, bandwidth, ok := c.LinkBandwidth(); ok {
+			return bandwidth, true
+		}
+	}
+	return 0, false
+}
+
+// Link Bandwidthをbandwidthに置き換える
+func (e EXTENDED_COMMUNITIES) WithLinkBandwidth(AS uint16, bandwidth float32) EXTENDED_COMMUNITIES {
+	return append(e.WithoutLinkBandwidth(), NewLinkBandwidth(AS, bandwidth))
+}
+
+func (e EXTENDED_COMMUNITIES) WithoutLinkBandwidth() EXTENDED_COMMUNITIES {
+	var communities EXTENDED_COMMUNITIES
+	for _, c := range e {
+		if _, _, ok := c.LinkBandwidth(); !ok {
+			communities = append(communities, c)
+		}
+	}
+	return communities
+}
+
+// ASの外に伝えないものを取り除く
+func (e EXTENDED_COMMUNITIES) TransitiveOnly() EXTENDED_COMMUNITIES {
+	var communities EXTENDED_COMMUNITIES
+	for _, c := range e {
+		if c.Transitive() {
+			communities = append(communities, c)
+		}
+	}
+	return communities
+}
+
+// IPv4ユニキャスト以外の経路の取り消し (RFC 4760)
+// 今はEnd-of-RIBにしか使わないので、取り消す経路はデコードせずにそのまま持つ
+type MP_UNREACH_NLRI struct {
+	AFI       uint16
+	SAFI      uint8
+	Withdrawn []byte
+}
+
+func (m *MP_UNREACH_NLRI) marshal() ([]byte, error) {
+	value := binary.BigEndian.AppendUint16(nil, m.AFI)
+	value = append(value, m.SAFI)
+	value = append(value, m.Withdrawn...)
+	return marshalAttr(AttrFlagsOptional, AttrTypeMPUnreachNLRI, value), nil
+}
+
+// PathAttrMED, PathAttrLocalPref, PathAttrAtomicAggregate, PathAttrAggregator, PathAttrOriginatorID,
+// PathAttrClusterList, PathAttrCommunities, PathAttrExtCommunitiesは
+// 送らない場合があるのでnil(空)の場合は付けない
 type Update struct {
 	WithdrawnRoutes                     []netip.Prefix
 	PathAttrOrigin                      Origin
 	PathAttrASPath                      AS_PATH
 	PathAttrNextHop                     NEXT_HOP
-	PathAttrLocalPref                   LOCAL_PREF
+	PathAttrMED                         *MULTI_EXIT_DISC
+	PathAttrLocalPref                   *LOCAL_PREF
+	PathAttrAtomicAggregate             ATOMIC_AGGREGATE
+	PathAttrAggregator                  *AGGREGATOR
+	PathAttrOriginatorID                *ORIGINATOR_ID
+	PathAttrClusterList                 CLUSTER_LIST
+	PathAttrCommunities                 COMMUNITIES
+	PathAttrExtCommunities              EXTENDED_COMMUNITIES
+	PathAttrMPUnreach                   *MP_UNREACH_NLRI
 	NetworkLayerReachabilityInformation []netip.Prefix
 }
 
+// メッセージの最大長 (RFC 4271 4.1)
+const MAXMESSAGELENGTH int = 4096
+
+// ヘッダとWithdrawn Routes LengthとTotal Path Attribute Length
+const UPDATEOVERHEAD int = 19 + 2 + 2
+
+// プレフィックスをエンコードしたときのバイト数
+func PrefixLength(prefix netip.Prefix) int {
+	return 1 + (prefix.Bits()+7)/8
+}
+
+// WithdrawnRoutesとNLRIをMAXMESSAGELENGTHに収まるメッセージに分ける
+// withdrawだけのメッセージを先に作り、NLRIのメッセージにはそれぞれ同じ属性を付ける
+func (u *Update) Split() ([]Update, error) {
+	msgs := make([]Update, 0)
+	withdraw := Update{WithdrawnRoutes: []netip.Prefix{}}
+	size := UPDATEOVERHEAD
+	for _, prefix := range u.WithdrawnRoutes {
+		if size+PrefixLength(prefix) > MAXMESSAGELENGTH && len(withdraw.WithdrawnRoutes) != 0 {
+			msgs = append(msgs, withdraw)
+			withdraw = Update{WithdrawnRoutes: []netip.Prefix{}}
+			size = UPDATEOVERHEAD
+		}
+		withdraw.WithdrawnRoutes = append(withdraw.WithdrawnRoutes, prefix)
+		size += PrefixLength(prefix)
+	}
+	if len(u.NetworkLayerReachabilityInformation) == 0 {
+		if len(withdraw.WithdrawnRoutes) != 0 || len(msgs) == 0 {
+			withdraw.PathAttrMPUnreach = u.PathAttrMPUnreach
+			msgs = append(msgs, withdraw)
+		}
+		return msgs, nil
+	}
+	if len(withdraw.WithdrawnRoutes) != 0 {
+		msgs = append(msgs, withdraw)
+	}
+	// 1つ目の経路で属性の長さを測る
+	announce := *u
+	announce.WithdrawnRoutes = nil
+	announce.NetworkLayerReachabilityInformation = u.NetworkLayerReachabilityInformation[:1]
+	b, err := announce.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	base := 19 + len(b) - PrefixLength(u.NetworkLayerReachabilityInformation[0])
+	if base >= MAXMESSAGELENGTH {
+		return nil, fmt.Errorf("path attributes are too long: %v", base)
+	}
+	announce.NetworkLayerReachabilityInformation = []netip.Prefix{}
+	size = base
+	for _, prefix := range u.NetworkLayerReachabilityInformation {
+		if size+PrefixLength(prefix) > MAXMESSAGELENGTH && len(announce.NetworkLayerReachabilityInformation) != 0 {
+			msgs = append(msgs, announce)
+			announce.NetworkLayerReachabilityInformation = []netip.Prefix{}
+			size = base
+		}
+		announce.NetworkLayerReachabilityInformation = append(announce.NetworkLayerReachabilityInformation, prefix)
+		size += PrefixLength(prefix)
+	}
+	return append(msgs, announce), nil
+}
+
 func prefixToBytes(prefix netip.Prefix) ([]byte, error) {
-	pLen := (prefix.Bits()-1)/8 + 1
+	pLen := (prefix.Bits() + 7) / 8
 
 	b := make([]byte, 1+pLen)
 	b[0] = byte(prefix.Bits())
@@ -143,24 +540,62 @@ func prefixToBytes(prefix netip.Prefix) ([]byte, error) {
 
 }
 
+// End-of-RIB (RFC 4724 2)
+// IPv4ユニキャストでは経路も属性も含まない空のUPDATE
+// それ以外ではAFI/SAFIだけを入れたMP_UNREACH_NLRIだけを含むUPDATE
+func NewEndOfRIB(afi uint16, safi uint8) *Update {
+	if afi == AFIIPv4 && safi == SAFIUnicast {
+		return &Update{}
+	}
+	return &Update{PathAttrMPUnreach: &MP_UNREACH_NLRI{AFI: afi, SAFI: safi}}
+}
+
+// End-of-RIBならそのAFI/SAFIを返す
+func (u *Update) EndOfRIB() (uint16, uint8, bool) {
+	if len(u.WithdrawnRoutes) != 0 || len(u.NetworkLayerReachabilityInformation) != 0 ||
+		len(u.PathAttrASPath) != 0 || u.PathAttrMED != nil || u.PathAttrLocalPref != nil || bool(u.PathAttrAtomicAggregate) || u.PathAttrAggregator != nil || u.PathAttrOriginatorID != nil ||
+		len(u.PathAttrClusterList) != 0 || len(u.PathAttrCommunities) != 0 || len(u.PathAttrExtCommunities) != 0 || netip.Addr(u.PathAttrNextHop).IsValid() {
+		return 0, 0, false
+	}
+	if u.PathAttrMPUnreach == nil {
+		return AFIIPv4, SAFIUnicast, true
+	}
+	if len(u.PathAttrMPUnreach.Withdrawn) != 0 {
+		return 0, 0, false
+	}
+	return u.PathAttrMPUnreach.AFI, u.PathAttrMPUnreach.SAFI, true
+}
+
 // binだとsliceのコピーが発生して遅いかもしれないが実装の簡略化を優先
 // bytes.Bufferを使ったほうがパフォーマンスは良いかもしれない
 func (u *Update) Marshal() ([]byte, error) {
-	var bin []byte
-	bin = binary.BigEndian.AppendUint16(bin, uint16(len(u.WithdrawnRoutes)))
+	var withdrawnBin []byte
 	for _, prefix := range u.WithdrawnRoutes {
 		b, err := prefixToBytes(prefix)
 		if err != nil {
 			return nil, err
 		}
-		bin = append(bin, b...)
+		withdrawnBin = append(withdrawnBin, b...)
 	}
+	// Withdrawn Routes Lengthはプレフィックスの数ではなくバイト数
+	var bin []byte
+	bin = binary.BigEndian.AppendUint16(bin, uint16(len(withdrawnBin)))
+	bin = append(bin, withdrawnBin...)
 
 	//TODO: 必須属性についてはzero valueでないことを確認したい
 	if len(u.NetworkLayerReachabilityInformation) == 0 {
-		TotalPathAttrLen := 0
+		// 経路がなければMP_UNREACH_NLRIだけを付ける
+		var mpUnreachBin []byte
+		if u.PathAttrMPUnreach != nil {
+			b, err := u.PathAttrMPUnreach.marshal()
+			if err != nil {
+				return nil, err
+			}
+			mpUnreachBin = b
+		}
+		TotalPathAttrLen := len(mpUnreachBin)
 		bin = binary.BigEndian.AppendUint16(bin, uint16(TotalPathAttrLen))
-		return bin, nil
+		return append(bin, mpUnreachBin...), nil
 	}
 	originBin, err := u.PathAttrOrigin.marshal()
 	if err != nil {
@@ -174,16 +609,75 @@ func (u *Update) Marshal() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	localprefBin, err := u.PathAttrLocalPref.marshal()
-	if err != nil {
-		return nil, err
+	var medBin []byte
+	if u.PathAttrMED != nil {
+		medBin, err = u.PathAttrMED.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var localprefBin []byte
+	if u.PathAttrLocalPref != nil {
+		localprefBin, err = u.PathAttrLocalPref.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var atomicAggregateBin []byte
+	if u.PathAttrAtomicAggregate {
+		atomicAggregateBin, err = u.PathAttrAtomicAggregate.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var aggregatorBin []byte
+	if u.PathAttrAggregator != nil {
+		aggregatorBin, err = u.PathAttrAggregator.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var originatorIDBin []byte
+	if u.PathAttrOriginatorID != nil {
+		originatorIDBin, err = u.PathAttrOriginatorID.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var clusterListBin []byte
+	if len(u.PathAttrClusterList) != 0 {
+		clusterListBin, err = u.PathAttrClusterList.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var communitiesBin []byte
+	if len(u.PathAttrCommunities) != 0 {
+		communitiesBin, err = u.PathAttrCommunities.marshal()
+		if err != nil {
+			return nil, err
+		}
 	}
-	TotalPathAttrLen := len(originBin) + len(aspathBin) + len(nexthopBin) + len(localprefBin)
+	var extCommunitiesBin []byte
+	if len(u.PathAttrExtCommunities) != 0 {
+		extCommunitiesBin, err = u.PathAttrExtCommunities.marshal()
+		if err != nil {
+			return nil, err
+		}
+	}
+	TotalPathAttrLen := len(originBin) + len(aspathBin) + len(nexthopBin) + len(medBin) + len(localprefBin) + len(atomicAggregateBin) + len(aggregatorBin) + len(originatorIDBin) + len(clusterListBin) + len(communitiesBin) + len(extCommunitiesBin)
 	bin = binary.BigEndian.AppendUint16(bin, uint16(TotalPathAttrLen))
 	bin = append(bin, originBin...)
 	bin = append(bin, aspathBin...)
 	bin = append(bin, nexthopBin...)
+	bin = append(bin, medBin...)
 	bin = append(bin, localprefBin...)
+	bin = append(bin, atomicAggregateBin...)
+	bin = append(bin, aggregatorBin...)
+	bin = append(bin, originatorIDBin...)
+	bin = append(bin, clusterListBin...)
+	bin = append(bin, communitiesBin...)
+	bin = append(bin, extCommunitiesBin...)
 	for _, prefix := range u.NetworkLayerReachabilityInformation {
 		b, err := prefixToBytes(prefix)
 		if err != nil {
@@ -205,7 +699,12 @@ func (u *Update) UnMarshal(r io.Reader, length uint16) error {
 	for i := 0; i < int(withdrawnLength); {
 		prefixBin := make([]byte, 5)
 		prefixLen := withdrawnRoutesBin[i]
-		copy(prefixBin, withdrawnRoutesBin[i+1:i+1+(int(prefixLen)-1)/8+1])
+		// プレフィックスはプレフィックス長を表すのに必要なバイト数だけ入っている
+		n := (int(prefixLen) + 7) / 8
+		if prefixLen > 32 || i+1+n > int(withdrawnLength) {
+			return fmt.Errorf("invalid withdrawn route length: %v", prefixLen)
+		}
+		copy(prefixBin, withdrawnRoutesBin[i+1:i+1+n])
 		prefixBin[4] = prefixLen
 		var prefix netip.Prefix
 		err := prefix.UnmarshalBinary(prefixBin)
@@ -213,7 +712,7 @@ func (u *Update) UnMarshal(r io.Reader, length uint16) error {
 			return err
 		}
 		u.WithdrawnRoutes = append(u.WithdrawnRoutes, prefix)
-		i += 1 + len(prefixBin)
+		i += 1 + n
 	}
 
 	var pathAttrLen uint16
@@ -221,43 +720,69 @@ func (u *Update) UnMarshal(r io.Reader, length uint16) error {
 	if err != nil {
 		return err
 	}
+	// 属性の長さがメッセージに収まっていなければMalformed Attribute List (RFC 4271 6.3)
+	if 2+int(withdrawnLength)+2+int(pathAttrLen) > int(length) {
+		return fmt.Errorf("%w: path attribute length %v exceeds message", ErrMalformedAttributeList, pathAttrLen)
+	}
 	pathAttrBin := make([]byte, pathAttrLen)
-	io.ReadFull(r, pathAttrBin)
+	if _, err := io.ReadFull(r, pathAttrBin); err != nil {
+		return err
+	}
 	for i := 0; i < int(pathAttrLen); {
+		if i+3 > int(pathAttrLen) {
+			return fmt.Errorf("%w: truncated attribute header", ErrMalformedAttributeList)
+		}
 		attrflags := AttrFlags(pathAttrBin[i])
 		i += 1
 		attrType := AttrType(pathAttrBin[i])
 		i += 1
 		var attrLen uint
 		if attrflags.ExtendedLength() {
+			if i+2 > int(pathAttrLen) {
+				return fmt.Errorf("%w: truncated attribute header", ErrMalformedAttributeList)
+			}
 			attrLen = uint(binary.BigEndian.Uint16(pathAttrBin[i:]))
 			i += 2
 		} else {
 			attrLen = uint(pathAttrBin[i])
 			i += 1
 		}
+		// 以下では属性の値がpathAttrBinに収まっているものとして読む
+		if i+int(attrLen) > int(pathAttrLen) {
+			return fmt.Errorf("%w: attribute %v length %v exceeds path attributes", ErrMalformedAttributeList, attrType, attrLen)
+		}
 
 		switch attrType {
 		case AttrTypeOrigin:
-			u.PathAttrOrigin = Origin(pathAttrBin[i])
-			i += 1
 			if attrLen != 1 {
 				return fmt.Errorf("invalid origin length: %v", attrLen)
 			}
-		case AttrTypeASPath:
-			u.PathAttrASPath.VALUE_SEGMENT = VALUE_SEGMENT_TYPE(pathAttrBin[i])
-			i += 1
-			segmentLen := pathAttrBin[i]
+			u.PathAttrOrigin = Origin(pathAttrBin[i])
 			i += 1
-			for j := 0; j < int(segmentLen); j++ {
-				as := binary.BigEndian.Uint16(pathAttrBin[i+j*2:])
-				u.PathAttrASPath.AS_SEQUENCE = append(u.PathAttrASPath.AS_SEQUENCE, as)
-			}
-			i += int(segmentLen) * 2
-			if attrLen != uint(1+1+2*segmentLen) {
-				return fmt.Errorf("invalid aspath length: %v", attrLen)
+		case AttrTypeASPath:
+			j := 0
+			for j < int(attrLen) {
+				if j+2 > int(attrLen) {
+					return fmt.Errorf("invalid aspath length: %v", attrLen)
+				}
+				segment := AS_PATH_SEGMENT{VALUE_SEGMENT: VALUE_SEGMENT_TYPE(pathAttrBin[i+j])}
+				segmentLen := int(pathAttrBin[i+j+1])
+				j += 2
+				if j+2*segmentLen > int(attrLen) {
+					return fmt.Errorf("invalid aspath length: %v", attrLen)
+				}
+				for k := 0; k < segmentLen; k++ {
+					as := binary.BigEndian.Uint16(pathAttrBin[i+j+k*2:])
+					segment.AS_SEQUENCE = append(segment.AS_SEQUENCE, as)
+				}
+				j += 2 * segmentLen
+				u.PathAttrASPath = append(u.PathAttrASPath, segment)
 			}
+			i += int(attrLen)
 		case AttrTypeNextHop:
+			if attrLen != 4 {
+				return fmt.Errorf("invalid nexthop length: %v", attrLen)
+			}
 			var nexthop netip.Addr
 			err := nexthop.UnmarshalBinary(pathAttrBin[i : i+4])
 			i += 4
@@ -265,15 +790,82 @@ func (u *Update) UnMarshal(r io.Reader, length uint16) error {
 				return err
 			}
 			u.PathAttrNextHop = NEXT_HOP(nexthop)
+		case AttrTypeMultiExitDisc:
 			if attrLen != 4 {
-				return fmt.Errorf("invalid nexthop length: %v", attrLen)
+				return fmt.Errorf("invalid med length: %v", attrLen)
 			}
-		case AttrTypeLocalPref:
-			u.PathAttrLocalPref = LOCAL_PREF(binary.BigEndian.Uint32(pathAttrBin[i:]))
+			med := MULTI_EXIT_DISC(binary.BigEndian.Uint32(pathAttrBin[i:]))
+			u.PathAttrMED = &med
 			i += 4
+		case AttrTypeLocalPref:
 			if attrLen != 4 {
 				return fmt.Errorf("invalid localpref length: %v", attrLen)
 			}
+			localPref := LOCAL_PREF(binary.BigEndian.Uint32(pathAttrBin[i:]))
+			u.PathAttrLocalPref = &localPref
+			i += 4
+		case AttrTypeAtomicAggregate:
+			if attrLen != 0 {
+				return fmt.Errorf("invalid atomic aggregate length: %v", attrLen)
+			}
+			u.PathAttrAtomicAggregate = true
+		case AttrTypeAggregator:
+			if attrLen != 6 {
+				return fmt.Errorf("invalid aggregator length: %v", attrLen)
+			}
+			u.PathAttrAggregator = &AGGREGATOR{
+				AS:      binary.BigEndian.Uint16(pathAttrBin[i:]),
+				Address: netip.AddrFrom4([4]byte(pathAttrBin[i+2 : i+6])),
+			}
+			i += 6
+		case AttrTypeOriginatorID:
+			if attrLen != 4 {
+				return fmt.Errorf("invalid originator id length: %v", attrLen)
+			}
+			originatorID := ORIGINATOR_ID(netip.AddrFrom4([4]byte(pathAttrBin[i : i+4])))
+			u.PathAttrOriginatorID = &originatorID
+			i += 4
+		case AttrTypeClusterList:
+			if attrLen%4 != 0 {
+				return fmt.Errorf("invalid cluster list length: %v", attrLen)
+			}
+			for j := 0; j < int(attrLen); j += 4 {
+				id := netip.AddrFrom4([4]byte(pathAttrBin[i+j : i+j+4]))
+				u.PathAttrClusterList = append(u.PathAttrClusterList, id)
+			}
+			i += int(attrLen)
+		case AttrTypeCommunities:
+			if attrLen%4 != 0 {
+				return fmt.Errorf("invalid communities length: %v", attrLen)
+			}
+			for j := 0; j < int(attrLen); j += 4 {
+				u.PathAttrCommunities = append(u.PathAttrCommunities, Community(binary.BigEndian.Uint32(pathAttrBin[i+j:])))
+			}
+			i += int(attrLen)
+		case AttrTypeExtCommunities:
+			if attrLen%8 != 0 {
+				return fmt.Errorf("invalid extended communities length: %v", attrLen)
+			}
+			for j := 0; j < int(attrLen); j += 8 {
+				u.PathAttrExtCommunities = append(u.PathAttrExtCommunities, ExtCommunity(pathAttrBin[i+j:i+j+8]))
+			}
+			i += int(attrLen)
+		case AttrTypeMPUnreachNLRI:
+			if attrLen < 3 {
+				return fmt.Errorf("invalid mp_unreach_nlri length: %v", attrLen)
+			}
+			u.PathAttrMPUnreach = &MP_UNREACH_NLRI{
+				AFI:       binary.BigEndian.Uint16(pathAttrBin[i:]),
+				SAFI:      pathAttrBin[i+2],
+				Withdrawn: append([]byte{}, pathAttrBin[i+3:i+int(attrLen)]...),
+			}
+			if len(u.PathAttrMPUnreach.Withdrawn) == 0 {
+				u.PathAttrMPUnreach.Withdrawn = nil
+			}
+			i += int(attrLen)
+		default:
+			// 未対応の属性は読み飛ばす
+			i += int(attrLen)
 		}
 	}
 	NLRlength := length - 2 - withdrawnLength - 2 - pathAttrLen
@@ -289,9 +881,12 @@ func (u *Update) UnMarshal(r io.Reader, length uint16) error {
 		plen := uint8(_plen[0])
 		i += 1
 
+		if plen > 32 {
+			return fmt.Errorf("invalid prefix length: %v", plen)
+		}
 		prefixBin := make([]byte, 5)
-		io.ReadFull(r, prefixBin[:(plen-1)/8+1])
-		i += int((plen-1)/8 + 1)
+		io.ReadFull(r, prefixBin[:(plen+7)/8])
+		i += int((plen + 7) / 8)
 		prefixBin[4] = plen
 		var prefix netip.Prefix
 		if err = prefix.UnmarshalBinary(prefixBin); err != nil {
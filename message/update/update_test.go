@@ -3,6 +3,7 @@ package update
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net/netip"
 	"reflect"
@@ -33,10 +34,10 @@ func TestMarshalOrigin(t *testing.T) {
 }
 
 func TestMarshalAS_PATH(t *testing.T) {
-	a := AS_PATH{
+	a := AS_PATH{{
 		VALUE_SEGMENT: VALUE_SEGMENT_AS_SEQUENCE,
 		AS_SEQUENCE:   []uint16{1, 2, 3},
-	}
+	}}
 	b, err := a.marshal()
 	if err != nil {
 		t.Fatal(err)
@@ -70,6 +71,17 @@ func TestMarshalAS_PATH(t *testing.T) {
 	}
 }
 
+func TestMarshalEmptyAS_PATH(t *testing.T) {
+	a := AS_PATH{}
+	b, err := a.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{byte(AttrFlagsTransitive), byte(AttrTypeASPath), 0}) {
+		t.Fatalf("invalid empty as path: %v", b)
+	}
+}
+
 func TestMarshalLOCAL_PREF(t *testing.T) {
 	l := LOCAL_PREF(1)
 	b, err := l.marshal()
@@ -135,10 +147,10 @@ func concatSlice(slices ...[]byte) []byte {
 
 func TestMarshalUpdate(t *testing.T) {
 	origin := Origin(OriginEGP)
-	as_path := AS_PATH{
+	as_path := AS_PATH{{
 		VALUE_SEGMENT: VALUE_SEGMENT_AS_SEQUENCE,
 		AS_SEQUENCE:   []uint16{1, 2, 3},
-	}
+	}}
 	next_hop := NEXT_HOP(netip.MustParseAddr("1.2.3.4"))
 	local_pref := LOCAL_PREF(1)
 	origin_bin, _ := origin.marshal()
@@ -159,7 +171,7 @@ func TestMarshalUpdate(t *testing.T) {
 				PathAttrOrigin:    origin,
 				PathAttrASPath:    as_path,
 				PathAttrNextHop:   next_hop,
-				PathAttrLocalPref: local_pref,
+				PathAttrLocalPref: &local_pref,
 				NetworkLayerReachabilityInformation: []netip.Prefix{
 					netip.MustParsePrefix("1.2.3.0/24"),
 				},
@@ -174,6 +186,25 @@ func TestMarshalUpdate(t *testing.T) {
 				[]byte{24, 1, 2, 3}, // NLRI
 			),
 		},
+		{
+			"no local pref",
+			Update{
+				PathAttrOrigin:  origin,
+				PathAttrASPath:  as_path,
+				PathAttrNextHop: next_hop,
+				NetworkLayerReachabilityInformation: []netip.Prefix{
+					netip.MustParsePrefix("1.2.3.0/24"),
+				},
+			},
+			concatSlice(
+				[]byte{0, 0}, // withdrawn routes length
+				binary.BigEndian.AppendUint16([]byte{}, uint16(attrlen-len(local_pref_bin))), // total path attr length
+				origin_bin,
+				as_path_bin,
+				next_hop_bin,
+				[]byte{24, 1, 2, 3}, // NLRI
+			),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -195,6 +226,7 @@ func TestMarshalUpdate(t *testing.T) {
 }
 
 func TestUnMarshal(t *testing.T) {
+	local_pref := LOCAL_PREF(1)
 	type args struct {
 		name   string
 		r      io.Reader
@@ -223,9 +255,9 @@ func TestUnMarshal(t *testing.T) {
 			want: Update{
 				WithdrawnRoutes:                     []netip.Prefix{},
 				PathAttrOrigin:                      Origin(OriginIGP),
-				PathAttrASPath:                      AS_PATH{VALUE_SEGMENT_AS_SEQUENCE, []uint16{0, 1, 2}},
+				PathAttrASPath:                      AS_PATH{{VALUE_SEGMENT_AS_SEQUENCE, []uint16{0, 1, 2}}},
 				PathAttrNextHop:                     NEXT_HOP(netip.MustParseAddr("1.2.3.4")),
-				PathAttrLocalPref:                   LOCAL_PREF(1),
+				PathAttrLocalPref:                   &local_pref,
 				NetworkLayerReachabilityInformation: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
 			},
 		},
@@ -250,7 +282,7 @@ func TestUnMarshal(t *testing.T) {
 		if tt.want.PathAttrNextHop != u.PathAttrNextHop {
 			t.Errorf("invalid next hop: got %v, want %v", u.PathAttrNextHop, tt.want.PathAttrNextHop)
 		}
-		if tt.want.PathAttrLocalPref != u.PathAttrLocalPref {
+		if u.PathAttrLocalPref == nil || *tt.want.PathAttrLocalPref != *u.PathAttrLocalPref {
 			t.Errorf("invalid local pref: got %v, want %v", u.PathAttrLocalPref, tt.want.PathAttrLocalPref)
 		}
 		if !reflect.DeepEqual(tt.want.NetworkLayerReachabilityInformation, u.NetworkLayerReachabilityInformation) {
@@ -258,3 +290,423 @@ func TestUnMarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestRouteReflectorAttrs(t *testing.T) {
+	originatorID := ORIGINATOR_ID(netip.MustParseAddr("10.0.0.1"))
+	local_pref := LOCAL_PREF(100)
+	u := Update{
+		PathAttrOrigin:       OriginIGP,
+		PathAttrASPath:       AS_PATH{},
+		PathAttrNextHop:      NEXT_HOP(netip.MustParseAddr("1.2.3.4")),
+		PathAttrLocalPref:    &local_pref,
+		PathAttrOriginatorID: &originatorID,
+		PathAttrClusterList: CLUSTER_LIST{
+			netip.MustParseAddr("10.0.0.2"),
+			netip.MustParseAddr("10.0.0.3"),
+		},
+		NetworkLayerReachabilityInformation: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+	}
+	b, err := u.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originatorIDBin, _ := originatorID.marshal()
+	if !bytes.Equal(originatorIDBin, []byte{byte(AttrFlagsOptional), byte(AttrTypeOriginatorID), 4, 10, 0, 0, 1}) {
+		t.Errorf("invalid originator id: %v", originatorIDBin)
+	}
+	var got Update
+	if err := got.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if got.PathAttrOriginatorID == nil || *got.PathAttrOriginatorID != originatorID {
+		t.Errorf("invalid originator id: got %v, want %v", got.PathAttrOriginatorID, originatorID)
+	}
+	if !reflect.DeepEqual(got.PathAttrClusterList, u.PathAttrClusterList) {
+		t.Errorf("invalid cluster list: got %v, want %v", got.PathAttrClusterList, u.PathAttrClusterList)
+	}
+	if !reflect.DeepEqual(got.NetworkLayerReachabilityInformation, u.NetworkLayerReachabilityInformation) {
+		t.Errorf("invalid NLRI: got %v, want %v", got.NetworkLayerReachabilityInformation, u.NetworkLayerReachabilityInformation)
+	}
+}
+
+func TestUnMarshalSkipsUnknownAttr(t *testing.T) {
+	b := []byte{
+		0, 0, // withdrawn routes length
+		0, 11, // total path attr length
+		byte(AttrFlagsTransitive), byte(AttrTypeOrigin), 1, byte(OriginIGP),
+		byte(AttrFlagsOptional), 255, 4, 0, 0, 0, 5, // reserved for development
+		8, 10, // prefix 10.0.0.0/8
+	}
+	var u Update
+	if err := u.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u.NetworkLayerReachabilityInformation, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}) {
+		t.Errorf("invalid NLRI: %v", u.NetworkLayerReachabilityInformation)
+	}
+}
+
+func TestMED(t *testing.T) {
+	med := MULTI_EXIT_DISC(5)
+	u := Update{
+		PathAttrOrigin:                      OriginIGP,
+		PathAttrASPath:                      AS_PATH{},
+		PathAttrNextHop:                     NEXT_HOP(netip.MustParseAddr("1.2.3.4")),
+		PathAttrMED:                         &med,
+		NetworkLayerReachabilityInformation: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	b, err := u.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{byte(AttrFlagsOptional), byte(AttrTypeMultiExitDisc), 4, 0, 0, 0, 5}
+	if !bytes.Contains(b, want) {
+		t.Errorf("MED is not marshaled: %v", b)
+	}
+	var got Update
+	if err := got.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if got.PathAttrMED == nil || *got.PathAttrMED != med {
+		t.Errorf("invalid MED: %v", got.PathAttrMED)
+	}
+}
+
+func TestAS_PATHConfed(t *testing.T) {
+	path := AS_PATH{{VALUE_SEGMENT_AS_SEQUENCE, []uint16{65100}}}
+	path = path.PrependConfed(65002).PrependConfed(65001)
+	want := AS_PATH{
+		{VALUE_SEGMENT_AS_CONFED_SEQUENCE, []uint16{65001, 65002}},
+		{VALUE_SEGMENT_AS_SEQUENCE, []uint16{65100}},
+	}
+	if !reflect.DeepEqual(path, want) {
+		t.Fatalf("PrependConfed() = %v, want %v", path, want)
+	}
+	if path.Length() != 1 {
+		t.Errorf("confed segments should not be counted: %v", path.Length())
+	}
+	if !path.Contains(65002) || path.ContainsOutsideConfed(65002) {
+		t.Error("invalid Contains() for confed member AS")
+	}
+	external := path.WithoutConfed().Prepend(65000)
+	want = AS_PATH{{VALUE_SEGMENT_AS_SEQUENCE, []uint16{65000, 65100}}}
+	if !reflect.DeepEqual(external, want) {
+		t.Errorf("WithoutConfed().Prepend() = %v, want %v", external, want)
+	}
+
+	b, err := path.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := concatSlice(
+		[]byte{0, 0},
+		binary.BigEndian.AppendUint16([]byte{}, uint16(len(b))),
+		b,
+	)
+	var u Update
+	if err := u.UnMarshal(bytes.NewReader(msg), uint16(len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u.PathAttrASPath, path) {
+		t.Errorf("UnMarshal() = %v, want %v", u.PathAttrASPath, path)
+	}
+}
+
+func TestAS_PATHLength(t *testing.T) {
+	path := AS_PATH{
+		{VALUE_SEGMENT_AS_SEQUENCE, []uint16{1, 2}},
+		{VALUE_SEGMENT_AS_SET, []uint16{3, 4, 5}},
+	}
+	if path.Length() != 3 {
+		t.Errorf("Length() = %v, want 3", path.Length())
+	}
+}
+
+func TestEndOfRIB(t *testing.T) {
+	tests := []struct {
+		name string
+		afi  uint16
+		safi uint8
+		want []byte
+	}{
+		{
+			name: "ipv4 unicast",
+			afi:  AFIIPv4,
+			safi: SAFIUnicast,
+			want: []byte{0, 0, 0, 0},
+		},
+		{
+			name: "ipv6 unicast",
+			afi:  AFIIPv6,
+			safi: SAFIUnicast,
+			want: []byte{
+				0, 0, // withdrawn routes length
+				0, 6, // total path attr length
+				byte(AttrFlagsOptional), byte(AttrTypeMPUnreachNLRI), 3, 0, 2, 1, // afi, safi
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewEndOfRIB(tt.afi, tt.safi).Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(b, tt.want) {
+				t.Errorf("Marshal() = %v, want %v", b, tt.want)
+			}
+			var u Update
+			if err := u.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+				t.Fatal(err)
+			}
+			afi, safi, ok := u.EndOfRIB()
+			if !ok || afi != tt.afi || safi != tt.safi {
+				t.Errorf("EndOfRIB() = %v %v %v, want %v %v true", afi, safi, ok, tt.afi, tt.safi)
+			}
+		})
+	}
+
+	u := Update{NetworkLayerReachabilityInformation: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	if _, _, ok := u.EndOfRIB(); ok {
+		t.Errorf("update with NLRI is detected as End-of-RIB")
+	}
+	u = Update{PathAttrMPUnreach: &MP_UNREACH_NLRI{AFI: AFIIPv6, SAFI: SAFIUnicast, Withdrawn: []byte{64, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0}}}
+	if _, _, ok := u.EndOfRIB(); ok {
+		t.Errorf("MP_UNREACH_NLRI with withdrawn routes is detected as End-of-RIB")
+	}
+}
+
+func TestLinkBandwidth(t *testing.T) {
+	// 10Gbps
+	c := NewLinkBandwidth(65001, 1.25e9)
+	if !reflect.DeepEqual(c, ExtCommunity{0x40, 0x04, 0xfd, 0xe9, 0x4e, 0x95, 0x02, 0xf9}) {
+		t.Errorf("invalid link bandwidth: %x", c)
+	}
+	if c.Transitive() {
+		t.Errorf("link bandwidth should be non-transitive")
+	}
+	u := Update{
+		PathAttrOrigin:                      OriginIGP,
+		PathAttrASPath:                      AS_PATH{},
+		PathAttrNextHop:                     NEXT_HOP(netip.MustParseAddr("1.2.3.4")),
+		PathAttrExtCommunities:              EXTENDED_COMMUNITIES{c},
+		NetworkLayerReachabilityInformation: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	b, err := u.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Update
+	if err := got.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	bandwidth, ok := got.PathAttrExtCommunities.LinkBandwidth()
+	if !ok || bandwidth != 1.25e9 {
+		t.Errorf("LinkBandwidth() = %v %v", bandwidth, ok)
+	}
+	replaced := got.PathAttrExtCommunities.WithLinkBandwidth(65002, 2.5e9)
+	if AS, bandwidth, _ := replaced[0].LinkBandwidth(); len(replaced) != 1 || AS != 65002 || bandwidth != 2.5e9 {
+		t.Errorf("WithLinkBandwidth() = %x", replaced)
+	}
+	if len(got.PathAttrExtCommunities.TransitiveOnly()) != 0 {
+		t.Errorf("non-transitive community is not removed")
+	}
+}
+
+func TestCommunities(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Community
+	}{
+		{"65001:100", 0xFDE90064},
+		{"0:0", 0},
+		{"no-export", CommunityNoExport},
+		{"no-advertise", CommunityNoAdvertise},
+	}
+	for _, tt := range tests {
+		got, err := ParseCommunity(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseCommunity(%v) = %x %v, want %x", tt.in, got, err, tt.want)
+		}
+		if got.String() != tt.in {
+			t.Errorf("String() = %v, want %v", got.String(), tt.in)
+		}
+	}
+	for _, in := range []string{"65001", "65536:1", "a:1", "1:-1"} {
+		if _, err := ParseCommunity(in); err == nil {
+			t.Errorf("ParseCommunity(%v) should fail", in)
+		}
+	}
+	u := Update{
+		PathAttrOrigin:                      OriginIGP,
+		PathAttrASPath:                      AS_PATH{},
+		PathAttrNextHop:                     NEXT_HOP(netip.MustParseAddr("1.2.3.4")),
+		PathAttrCommunities:                 COMMUNITIES{0xFDE90064, CommunityNoExport},
+		NetworkLayerReachabilityInformation: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	communitiesBin, _ := u.PathAttrCommunities.marshal()
+	if !bytes.Equal(communitiesBin, []byte{byte(AttrFlagsOptional | AttrFlagsTransitive), byte(AttrTypeCommunities), 8, 0xfd, 0xe9, 0, 0x64, 0xff, 0xff, 0xff, 0x01}) {
+		t.Errorf("invalid communities: %v", communitiesBin)
+	}
+	b, err := u.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Update
+	if err := got.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.PathAttrCommunities, u.PathAttrCommunities) {
+		t.Errorf("invalid communities: got %v, want %v", got.PathAttrCommunities, u.PathAttrCommunities)
+	}
+	if !got.PathAttrCommunities.Contains(CommunityNoExport) || got.PathAttrCommunities.Contains(CommunityNoAdvertise) {
+		t.Errorf("Contains() is wrong: %v", got.PathAttrCommunities)
+	}
+}
+
+func TestAggregateAttrs(t *testing.T) {
+	u := Update{
+		PathAttrOrigin:                      OriginIGP,
+		PathAttrASPath:                      AS_PATH{{VALUE_SEGMENT: VALUE_SEGMENT_AS_SET, AS_SEQUENCE: []uint16{65001, 65002}}},
+		PathAttrNextHop:                     NEXT_HOP(netip.MustParseAddr("1.2.3.4")),
+		PathAttrAtomicAggregate:             true,
+		PathAttrAggregator:                  &AGGREGATOR{AS: 65000, Address: netip.MustParseAddr("10.255.0.1")},
+		NetworkLayerReachabilityInformation: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/16")},
+	}
+	atomicAggregateBin, _ := u.PathAttrAtomicAggregate.marshal()
+	if !bytes.Equal(atomicAggregateBin, []byte{byte(AttrFlagsTransitive), byte(AttrTypeAtomicAggregate), 0}) {
+		t.Errorf("invalid atomic aggregate: %v", atomicAggregateBin)
+	}
+	aggregatorBin, _ := u.PathAttrAggregator.marshal()
+	if !bytes.Equal(aggregatorBin, []byte{byte(AttrFlagsOptional | AttrFlagsTransitive), byte(AttrTypeAggregator), 6, 0xfd, 0xe8, 10, 255, 0, 1}) {
+		t.Errorf("invalid aggregator: %v", aggregatorBin)
+	}
+	b, err := u.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Update
+	if err := got.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, u) {
+		t.Errorf("got %+v, want %+v", got, u)
+	}
+}
+
+// 長さの違うプレフィックスをまとめてwithdrawする
+func TestUnMarshalWithdrawnRoutes(t *testing.T) {
+	u := Update{
+		WithdrawnRoutes: []netip.Prefix{
+			netip.MustParsePrefix("10.0.1.0/24"),
+			netip.MustParsePrefix("10.0.2.0/24"),
+			netip.MustParsePrefix("10.0.3.0/24"),
+			netip.MustParsePrefix("10.255.0.1/32"),
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("10.1.0.0/17"),
+			netip.MustParsePrefix("0.0.0.0/0"),
+		},
+	}
+	b, err := u.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (1+3)*3 + (1+4) + (1+1) + (1+3) + (1+0)バイト
+	if withdrawnLength := binary.BigEndian.Uint16(b); withdrawnLength != 24 {
+		t.Errorf("withdrawn routes length = %v, want 24", withdrawnLength)
+	}
+	var got Update
+	if err := got.UnMarshal(bytes.NewReader(b), uint16(len(b))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.WithdrawnRoutes, u.WithdrawnRoutes) {
+		t.Errorf("got %v, want %v", got.WithdrawnRoutes, u.WithdrawnRoutes)
+	}
+
+	// プレフィックス長に足りない
+	truncated := []byte{0, 3, 24, 10, 0, 0, 0}
+	if err := got.UnMarshal(bytes.NewReader(truncated), uint16(len(truncated))); err == nil {
+		t.Error("truncated withdrawn route should be rejected")
+	}
+}
+
+// 属性の長さがPath Attributesに収まらなければMalformed Attribute Listにする
+func TestUnMarshalTruncatedAttr(t *testing.T) {
+	tests := []struct {
+		name string
+		attr []byte
+	}{
+		{"originator id", []byte{byte(AttrFlagsOptional), byte(AttrTypeOriginatorID), 4, 10, 0}},
+		{"cluster list", []byte{byte(AttrFlagsOptional), byte(AttrTypeClusterList), 8, 10, 0, 0, 1, 10, 0}},
+		{"extended length", []byte{byte(AttrFlagsOptional | AttrFlagsExtendedLength), byte(AttrTypeClusterList), 1}},
+		{"header", []byte{byte(AttrFlagsOptional), byte(AttrTypeOriginatorID)}},
+		{"med", []byte{byte(AttrFlagsOptional), byte(AttrTypeMultiExitDisc), 4, 0, 0}},
+		{"aggregator", []byte{byte(AttrFlagsOptional | AttrFlagsTransitive), byte(AttrTypeAggregator), 6, 0xfd, 0xe8, 10}},
+		{"communities", []byte{byte(AttrFlagsOptional | AttrFlagsTransitive), byte(AttrTypeCommunities), 8, 0xfd, 0xe9, 0, 1}},
+		{"extended communities", []byte{byte(AttrFlagsOptional | AttrFlagsTransitive), byte(AttrTypeExtCommunities), 8, 0, 2, 0xfd, 0xe9}},
+		{"mp_unreach_nlri", []byte{byte(AttrFlagsOptional), byte(AttrTypeMPUnreachNLRI), 5, 0, 1, 1, 24}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := binary.BigEndian.AppendUint16([]byte{0, 0}, uint16(len(tt.attr)))
+			b = append(b, tt.attr...)
+			var u Update
+			if err := u.UnMarshal(bytes.NewReader(b), uint16(len(b))); !errors.Is(err, ErrMalformedAttributeList) {
+				t.Errorf("UnMarshal() error = %v, want %v", err, ErrMalformedAttributeList)
+			}
+		})
+	}
+}
+
+// 属性の長さがメッセージの長さを超えている
+func TestUnMarshalPathAttrLength(t *testing.T) {
+	med := []byte{byte(AttrFlagsOptional), byte(AttrTypeMultiExitDisc), 4, 0, 0, 0, 1}
+	b := binary.BigEndian.AppendUint16([]byte{0, 0}, uint16(len(med)+4))
+	b = append(b, med...)
+	var u Update
+	if err := u.UnMarshal(bytes.NewReader(b), uint16(len(b))); !errors.Is(err, ErrMalformedAttributeList) {
+		t.Errorf("UnMarshal() error = %v, want %v", err, ErrMalformedAttributeList)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	local_pref := LOCAL_PREF(100)
+	u := Update{
+		PathAttrOrigin:    OriginIGP,
+		PathAttrASPath:    AS_PATH{{VALUE_SEGMENT: VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65001}}},
+		PathAttrNextHop:   NEXT_HOP(netip.MustParseAddr("10.0.0.1")),
+		PathAttrLocalPref: &local_pref,
+	}
+	for i := 0; i < 10000; i++ {
+		u.WithdrawnRoutes = append(u.WithdrawnRoutes, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 1}), 32))
+		u.NetworkLayerReachabilityInformation = append(u.NetworkLayerReachabilityInformation, netip.PrefixFrom(netip.AddrFrom4([4]byte{172, byte(i >> 8), byte(i), 0}), 24))
+	}
+	msgs, err := u.Split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var withdrawn, announced int
+	for _, msg := range msgs {
+		b, err := msg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if 19+len(b) > MAXMESSAGELENGTH {
+			t.Fatalf("message length %v exceeds %v", 19+len(b), MAXMESSAGELENGTH)
+		}
+		if len(msg.NetworkLayerReachabilityInformation) != 0 && (msg.PathAttrLocalPref != &local_pref || len(msg.WithdrawnRoutes) != 0) {
+			t.Errorf("announce should carry only the path attributes: %+v", msg)
+		}
+		withdrawn += len(msg.WithdrawnRoutes)
+		announced += len(msg.NetworkLayerReachabilityInformation)
+	}
+	if withdrawn != 10000 || announced != 10000 {
+		t.Errorf("withdrawn %d, announced %d", withdrawn, announced)
+	}
+
+	// 1つに収まるものは分けない
+	small := Update{WithdrawnRoutes: u.WithdrawnRoutes[:10]}
+	if msgs, _ := small.Split(); len(msgs) != 1 || !reflect.DeepEqual(msgs[0].WithdrawnRoutes, small.WithdrawnRoutes) {
+		t.Errorf("Split() = %v", msgs)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errPeerUnreachable = errors.New("no route to peer")
+
+// ip route get の結果
+type peerRoute struct {
+	Dev string
+	Src netip.Addr
+}
+
+// "10.0.0.1 via 192.168.0.1 dev eth0 src 192.168.0.2 uid 0" のような出力から dev と src を取り出す
+func parse_route_get(out string) (peerRoute, error) {
+	var route peerRoute
+	fields := strings.Fields(out)
+	if len(fields) > 0 && (fields[0] == "unreachable" || fields[0] == "prohibit" || fields[0] == "blackhole") {
+		return route, errPeerUnreachable
+	}
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "dev":
+			route.Dev = fields[i+1]
+		case "src":
+			src, err := netip.ParseAddr(fields[i+1])
+			if err != nil {
+				return route, err
+			}
+			route.Src = src
+		}
+	}
+	if route.Dev == "" {
+		return route, fmt.Errorf("invalid route: %q", out)
+	}
+	return route, nil
+}
+
+// ピアへの経路をカーネルに問い合わせる
+// Loc-RIBの経路もROUTINGTABLEに入れているので、BGPで学習したループバックにも届く
+func route_get(addr netip.Addr) (peerRoute, error) {
+	out, err := exec.Command("ip", "route", "get", addr.String()).Output()
+	if err != nil {
+		return peerRoute{}, errPeerUnreachable
+	}
+	return parse_route_get(string(out))
+}
+
+// 設定されたupdate_sourceを解決する. インターフェース名かアドレスを書ける
+func update_source(source string) (netip.Addr, error) {
+	if source == "" {
+		return netip.Addr{}, nil
+	}
+	if addr, err := netip.ParseAddr(source); err == nil {
+		return addr, nil
+	}
+	ifi, err := net.InterfaceByName(source)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return localNetipIp(*ifi)
+}
+
+// アドレスで設定したピアへの経路ができるまで待ち、送信元とインターフェースを決める
+func resolve_peer(conf PeerConfig) (net.Interface, netip.Addr, error) {
+	src, err := update_source(conf.UpdateSource)
+	if err != nil {
+		return net.Interface{}, netip.Addr{}, err
+	}
+	for {
+		route, err := route_get(conf.Address)
+		if err == errPeerUnreachable {
+			log.Printf("no route to %v. Waiting one more second...", conf.Address)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if err != nil {
+			return net.Interface{}, netip.Addr{}, err
+		}
+		ifi, err := net.InterfaceByName(route.Dev)
+		if err != nil {
+			return net.Interface{}, netip.Addr{}, err
+		}
+		if !src.IsValid() {
+			src = route.Src
+		}
+		return *ifi, src, nil
+	}
+}
+
+// 送信元ポートはカーネルに任せる
+func start_tcp_addr(src, dst netip.Addr, conf PeerConfig) (*net.TCPConn, error) {
+	dialer := net.Dialer{Control: dial_control(conf, netip.PrefixFrom(dst, dst.BitLen()))}
+	if src.IsValid() {
+		dialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, 0))
+	}
+	conn, err := dialer.Dial("tcp", netip.AddrPortFrom(dst, 179).String())
+	if err != nil {
+		log.Printf("failed to dial: %v", err)
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// peer_controlに加えてeBGP multihopのTTLを設定するControl関数を返す
+// SYNから設定したTTLで送らないと1ホップより遠いピアに届かない
+func dial_control(conf PeerConfig, peer netip.Prefix) func(network, address string, c syscall.RawConn) error {
+	control := peer_control(conf, peer)
+	return func(network, address string, c syscall.RawConn) error {
+		if err := control(network, address, c); err != nil {
+			return err
+		}
+		// GTSMを使う場合はTTLを255にしている
+		if conf.TTLSecurity || conf.EBGPMultihop == 0 {
+			return nil
+		}
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = set_ttl_fd(int(fd), network == "tcp6", int(conf.EBGPMultihop))
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// 同じアドレスで待ち受ける複数のピアに接続を振り分ける
+type addrListener struct {
+	l       *net.TCPListener
+	mu      sync.Mutex
+	waiters map[netip.Addr]chan *net.TCPConn
+	// このソケットで待ったピアのGTSMのホップ数
+	hops map[netip.Addr]int
+}
+
+var addrListeners = struct {
+	mu sync.Mutex
+	m  map[netip.Addr]*addrListener
+}{m: make(map[netip.Addr]*addrListener)}
+
+// srcの179番でremoteからの接続を待つ
+// ctxが終わったら待つのをやめ、このピアの登録を消す
+func wait_tcp_addr(ctx context.Context, src, remote netip.Addr, conf PeerConfig) (*net.TCPConn, error) {
+	addrListeners.mu.Lock()
+	l, ok := addrListeners.m[src]
+	if !ok {
+		tl, err := listen_tcp(netip.AddrPortFrom(src, 179), conf.listenerGTSMHops())
+		if err != nil {
+			addrListeners.mu.Unlock()
+			return nil, err
+		}
+		l = &addrListener{l: tl, waiters: make(map[netip.Addr]chan *net.TCPConn), hops: make(map[netip.Addr]int)}
+		addrListeners.m[src] = l
+		go l.serve()
+	}
+	addrListeners.mu.Unlock()
+	// 同じリスナーでピアごとに鍵を持たせる
+	if err := set_listener_auth(l.l, conf, netip.PrefixFrom(remote, remote.BitLen())); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *net.TCPConn, 1)
+	l.mu.Lock()
+	l.hops[remote] = conf.listenerGTSMHops()
+	defer l.remove(remote, ch)
+	if err := l.setGTSM(); err != nil {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("failed to set GTSM: %v", err)
+	}
+	l.waiters[remote] = ch
+	l.mu.Unlock()
+	select {
+	case conn := <-ch:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 待つのをやめたピアを消し、残ったピアに合わせてGTSMを設定し直す
+func (l *addrListener) remove(remote netip.Addr, ch chan *net.TCPConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// 再接続で同じピアが登録し直していれば残す
+	if l.waiters[remote] == ch {
+		delete(l.waiters, remote)
+	}
+	if _, ok := l.waiters[remote]; !ok {
+		delete(l.hops, remote)
+	}
+	// serveが渡した後にやめた接続は閉じる
+	select {
+	case conn := <-ch:
+		conn.Close()
+	default:
+	}
+	if err := l.setGTSM(); err != nil {
+		log.Printf("failed to set GTSM: %v", err)
+	}
+}
+
+// 後から加わったピアに合わせてソケットのGTSMを設定し直す. l.muを持って呼ぶ
+func (l *addrListener) setGTSM() error {
+	hops := make([]int, 0, len(l.hops))
+	for _, h := range l.hops {
+		hops = append(hops, h)
+	}
+	raw, err := l.l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v6 := !l.l.Addr().(*net.TCPAddr).AddrPort().Addr().Unmap().Is4()
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = set_shared_gtsm(int(fd), v6, hops)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func (l *addrListener) serve() {
+	for {
+		conn, err := l.l.AcceptTCP()
+		if err != nil {
+			log.Printf("failed to accept: %v", err)
+			return
+		}
+		remote := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+		l.mu.Lock()
+		ch, ok := l.waiters[remote]
+		delete(l.waiters, remote)
+		l.mu.Unlock()
+		if !ok {
+			log.Printf("rejected %v: no neighbor is waiting", remote)
+			conn.Close()
+			continue
+		}
+		ch <- conn
+	}
+}
+
+func listen_tcp(laddr netip.AddrPort, hops int) (*net.TCPListener, error) {
+	lc := net.ListenConfig{Control: shared_listen_control([]int{hops})}
+	l, err := lc.Listen(context.Background(), "tcp", laddr.String())
+	if err != nil {
+		log.Printf("failed to listen: %v", err)
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// 接続を待つ間に届いたシャットダウンでctxを終わらせる
+// stopは見張りを止め、シャットダウンが届いていればその理由を返す
+func (s *Session) watchShutdown() (context.Context, func() (string, bool)) {
+	ctx, cancel := context.WithCancel(s.Ctx)
+	shutdown := make(chan string, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case communication := <-s.ShutdownCh:
+			shutdown <- communication
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() (string, bool) {
+		cancel()
+		<-done
+		select {
+		case communication := <-shutdown:
+			return communication, true
+		default:
+			return "", false
+		}
+	}
+}
+
+// アドレスで設定したピアと接続し、使うインターフェースと自分のアドレスを決める
+func (s *Session) connectAddr() (*net.TCPConn, error) {
+	ifi, src, err := resolve_peer(s.Config)
+	if err != nil {
+		return nil, err
+	}
+	s.Ifi = ifi
+	var conn *net.TCPConn
+	if s.ActiveMode {
+		conn, err = start_tcp_addr(src, s.Config.Address, s.Config)
+	} else {
+		ctx, stop := s.watchShutdown()
+		conn, err = wait_tcp_addr(ctx, src, s.Config.Address, s.Config)
+		if communication, ok := stop(); ok {
+			if conn != nil {
+				conn.Close()
+			}
+			s.Shutdown(communication)
+			return nil, errShutdown
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Config.TTLSecurity {
+		// 待ち受けるソケットは他のピアと共有していて一番遠いピアに合わせているので、接続ごとに設定し直す
+		if err := set_conn_gtsm(conn, s.Config.gtsmHops()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set GTSM: %v", err)
+		}
+	} else if s.Config.EBGPMultihop > 0 && !s.ActiveMode {
+		// 接続する側はdial_controlで設定済み
+		if err := set_ttl(conn, int(s.Config.EBGPMultihop)); err != nil {
+			log.Printf("failed to set ttl: %v", err)
+		}
+	}
+	s.NetipAddr = conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+	log.Printf("connected to %v from %v via %v", s.Config.Address, s.NetipAddr, ifi.Name)
+	return conn, nil
+}
+
+// eBGP multihopで使うTTLを設定する
+func set_ttl(conn *net.TCPConn, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	v6 := !conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap().Is4()
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = set_ttl_fd(int(fd), v6, ttl)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func set_ttl_fd(fd int, v6 bool, ttl int) error {
+	if v6 {
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+	}
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRouteGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    peerRoute
+		wantErr error
+	}{
+		{
+			name: "via",
+			out:  "10.0.0.1 via 192.168.0.1 dev eth0 table 10 src 192.168.0.2 uid 0 \n    cache \n",
+			want: peerRoute{Dev: "eth0", Src: netip.MustParseAddr("192.168.0.2")},
+		},
+		{
+			name: "local",
+			out:  "local 127.0.0.1 dev lo src 127.0.0.1 uid 0 \n    cache <local> \n",
+			want: peerRoute{Dev: "lo", Src: netip.MustParseAddr("127.0.0.1")},
+		},
+		{
+			name:    "unreachable",
+			out:     "unreachable 10.0.0.1 table 10 uid 0 \n",
+			wantErr: errPeerUnreachable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parse_route_get(tt.out)
+			if err != tt.wantErr {
+				t.Fatalf("parse_route_get() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parse_route_get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// connectする前にTTLを設定する
+func TestDialControlTTL(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer l.Close()
+	var ttl int
+	control := dial_control(PeerConfig{EBGPMultihop: 3}, netip.MustParsePrefix("127.0.0.1/32"))
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		if err := control(network, address, c); err != nil {
+			return err
+		}
+		ttl = getsockoptInt(t, c, unix.IPPROTO_IP, unix.IP_TTL)
+		return nil
+	}}
+	conn, err := dialer.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	conn.Close()
+	if ttl != 3 {
+		t.Errorf("ttl before connect = %v, want 3", ttl)
+	}
+}
+
+// 待つのをやめたピアは登録から消える
+func TestWaitTCPAddrCancel(t *testing.T) {
+	src := netip.MustParseAddr("127.0.0.2")
+	remote := netip.MustParseAddr("127.0.0.3")
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := wait_tcp_addr(ctx, src, remote, PeerConfig{TTLSecurity: true})
+		errCh <- err
+	}()
+	var l *addrListener
+	for i := 0; l == nil && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addrListeners.mu.Lock()
+		l = addrListeners.m[src]
+		addrListeners.mu.Unlock()
+	}
+	if l == nil {
+		t.Skip("cannot listen on 127.0.0.2:179")
+	}
+	cancel()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("wait_tcp_addr() = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait_tcp_addr does not return after cancel")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) != 0 || len(l.hops) != 0 {
+		t.Errorf("peer remains: waiters %v, hops %v", l.waiters, l.hops)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net/netip"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// カーネルのIPv4の経路 (rtnetlink)
+type kernelRoute struct {
+	Prefix   netip.Prefix
+	Gateway  netip.Addr
+	Table    uint32
+	Protocol uint8
+	Scope    uint8
+	Type     uint8
+}
+
+// RTM_NEWROUTEとRTM_DELROUTEのメッセージを読む. 経路でなければfalseを返す
+// テーブルの番号は256以上だとRTA_TABLEにしか入らない
+func parse_route_message(m syscall.NetlinkMessage) (kernelRoute, bool) {
+	var route kernelRoute
+	if m.Header.Type != unix.RTM_NEWROUTE && m.Header.Type != unix.RTM_DELROUTE {
+		return route, false
+	}
+	if len(m.Data) < unix.SizeofRtMsg || m.Data[0] != unix.AF_INET {
+		return route, false
+	}
+	dstLen := int(m.Data[1])
+	route.Table = uint32(m.Data[4])
+	route.Protocol = m.Data[5]
+	route.Scope = m.Data[6]
+	route.Type = m.Data[7]
+	dst := netip.IPv4Unspecified()
+	attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+	if err != nil {
+		log.Printf("failed to parse route attributes: %v", err)
+		return route, false
+	}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.RTA_DST:
+			if addr, ok := netip.AddrFromSlice(attr.Value); ok {
+				dst = addr
+			}
+		case unix.RTA_GATEWAY:
+			if addr, ok := netip.AddrFromSlice(attr.Value); ok {
+				route.Gateway = addr
+			}
+		case unix.RTA_TABLE:
+			if len(attr.Value) == 4 {
+				route.Table = binary.NativeEndian.Uint32(attr.Value)
+			}
+		}
+	}
+	prefix, err := dst.Prefix(dstLen)
+	if err != nil {
+		return route, false
+	}
+	route.Prefix = prefix
+	return route, true
+}
+
+// 全てのテーブルのIPv4の経路を読む
+func kernel_routes() ([]kernelRoute, error) {
+	b, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, unix.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	routes := make([]kernelRoute, 0, len(msgs))
+	for _, m := range msgs {
+		if route, ok := parse_route_message(m); ok {
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+// インターフェースとアドレスと経路の変更を受け取るnetlinkのソケット
+func subscribe_kernel_changes() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return -1, err
+	}
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV4_ROUTE,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// 自分がROUTINGTABLEに入れた経路の変更だけなら読み直さなくてよい
+// 読めないメッセージがあれば読み直す
+func own_route_changes(b []byte) bool {
+	msgs, err := syscall.ParseNetlinkMessage(b)
+	if err != nil {
+		return false
+	}
+	for _, m := range msgs {
+		route, ok := parse_route_message(m)
+		if !ok || strconv.Itoa(int(route.Table)) != ROUTINGTABLE {
+			return false
+		}
+	}
+	return true
+}
+
+// 変更が届くたびにchに知らせる. 中身は読み直すので見ない
+// FIBに経路を入れるたびに読み直さないように、ROUTINGTABLEの変更は知らせない
+// 受信バッファがあふれて変更を取りこぼした(ENOBUFS)場合も読み直せば追いつく
+// 受け取れなくなったらchを閉じる
+func receive_kernel_changes(fd int, ch chan<- struct{}) {
+	defer close(ch)
+	defer unix.Close(fd)
+	b := make([]byte, 65536)
+	for {
+		n, _, err := unix.Recvfrom(fd, b, 0)
+		if err != nil && err != unix.ENOBUFS && err != unix.EINTR {
+			log.Printf("failed to receive netlink message: %v", err)
+			return
+		}
+		if err == unix.EINTR || (err == nil && own_route_changes(b[:n])) {
+			continue
+		}
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+)
+
+var errQueueClosed = errors.New("out queue is closed")
+
+// ピアへ送る経路の変更をためておくキュー
+// 書き込みが終わる前に同じプレフィックスが変更された場合は最後の変更だけを送る
+// 上限に達するとPushは書き込み側が追いつくまで待つ. limitが0なら上限なし
+type OutQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[netip.Prefix]*RibAdjEntry // nilはwithdraw
+	limit   int
+	closed  bool
+	// 最初の経路を全て入れ終わったらEnd-of-RIBを送る
+	endOfRIB bool
+	// 新しい変更が入ったことを書き込み側に知らせる
+	notify chan struct{}
+	// 書き込み側が取り出して空きができたことを知らせる
+	space chan struct{}
+}
+
+func NewOutQueue(limit int) *OutQueue {
+	q := &OutQueue{
+		pending: make(map[netip.Prefix]*RibAdjEntry),
+		limit:   limit,
+		notify:  make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// entryがnilならwithdrawとして扱う
+func (q *OutQueue) Push(prefix netip.Prefix, entry *RibAdjEntry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return errQueueClosed
+		}
+		if _, ok := q.pending[prefix]; ok || q.limit == 0 || len(q.pending) < q.limit {
+			break
+		}
+		q.cond.Wait()
+	}
+	q.pending[prefix] = entry
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// たまっている変更を全て取り出す
+func (q *OutQueue) Pop() (RibAdj, []netip.Prefix) {
+	return q.PopN(-1)
+}
+
+// たまっている変更をn個まで取り出す. nが負なら全て取り出す
+// withdrawを先に取り出す
+func (q *OutQueue) PopN(n int) (RibAdj, []netip.Prefix) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	announce := make(RibAdj)
+	withdraw := make([]netip.Prefix, 0)
+	if n < 0 || n > len(q.pending) {
+		n = len(q.pending)
+	}
+	for prefix, entry := range q.pending {
+		if len(withdraw) == n {
+			break
+		}
+		if entry == nil {
+			withdraw = append(withdraw, prefix)
+			delete(q.pending, prefix)
+		}
+	}
+	for prefix, entry := range q.pending {
+		if len(withdraw)+len(announce) == n {
+			break
+		}
+		announce[prefix] = *entry
+		delete(q.pending, prefix)
+	}
+	if n != 0 {
+		q.freed()
+	}
+	return announce, withdraw
+}
+
+// 空きができたことをPushと読み出し側に知らせる
+func (q *OutQueue) freed() {
+	q.cond.Broadcast()
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+}
+
+// 上限までに入れられる変更の数. 上限がなければ-1
+func (q *OutQueue) Room() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.limit == 0 {
+		return -1
+	}
+	if len(q.pending) >= q.limit {
+		return 0
+	}
+	return q.limit - len(q.pending)
+}
+
+// withdrawだけを取り出す
+func (q *OutQueue) PopWithdrawn() []netip.Prefix {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	withdraw := make([]netip.Prefix, 0)
+	for prefix, entry := range q.pending {
+		if entry == nil {
+			withdraw = append(withdraw, prefix)
+			delete(q.pending, prefix)
+		}
+	}
+	if len(withdraw) != 0 {
+		q.freed()
+	}
+	return withdraw
+}
+
+// それまでに入れた変更の後にEnd-of-RIBを送らせる
+func (q *OutQueue) PushEndOfRIB() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.endOfRIB = true
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 先に入れた変更が全て送られていればEnd-of-RIBを取り出す
+func (q *OutQueue) PopEndOfRIB() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.endOfRIB || len(q.pending) != 0 {
+		return false
+	}
+	q.endOfRIB = false
+	return true
+}
+
+// たまっている変更とEnd-of-RIBを捨てる
+func (q *OutQueue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = make(map[netip.Prefix]*RibAdjEntry)
+	q.endOfRIB = false
+	select {
+	case <-q.notify:
+	default:
+	}
+	q.freed()
+}
+
+func (q *OutQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// 待っているPushを全て失敗させる
+func (q *OutQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
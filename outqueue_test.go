@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+func TestOutQueueCoalesce(t *testing.T) {
+	q := NewOutQueue(10)
+	prefix := netip.MustParsePrefix("192.168.0.0/24")
+	first := RibAdjEntry{LOCAL_PREF: 100}
+	second := RibAdjEntry{LOCAL_PREF: 200}
+	q.Push(prefix, &first)
+	q.Push(prefix, &second)
+	if q.Len() != 1 {
+		t.Fatalf("changes for the same prefix are not coalesced: %v", q.Len())
+	}
+	announce, withdraw := q.Pop()
+	if announce[prefix].LOCAL_PREF != update.LOCAL_PREF(200) || len(withdraw) != 0 {
+		t.Errorf("the last change should be sent: %v %v", announce, withdraw)
+	}
+
+	q.Push(prefix, &first)
+	q.Push(prefix, nil)
+	announce, withdraw = q.Pop()
+	if len(announce) != 0 || len(withdraw) != 1 {
+		t.Errorf("withdraw should replace the announce: %v %v", announce, withdraw)
+	}
+}
+
+func TestOutQueueLimit(t *testing.T) {
+	q := NewOutQueue(1)
+	entry := RibAdjEntry{}
+	q.Push(netip.MustParsePrefix("192.168.0.0/24"), &entry)
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.Push(netip.MustParsePrefix("192.168.1.0/24"), &entry)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("Push should wait while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.Pop()
+	if err := <-pushed; err != nil {
+		t.Fatalf("Push failed after Pop: %v", err)
+	}
+
+	go func() {
+		pushed <- q.Push(netip.MustParsePrefix("192.168.2.0/24"), &entry)
+	}()
+	q.Close()
+	if err := <-pushed; err != errQueueClosed {
+		t.Errorf("Push should fail after Close: %v", err)
+	}
+}
+
+func TestOutQueueUnlimited(t *testing.T) {
+	// LocRibからの変更を入れるキューは上限がないのでブロックしない
+	q := NewOutQueue(0)
+	withdrawn := netip.MustParsePrefix("192.168.0.0/24")
+	entry := RibAdjEntry{}
+	for _, prefix := range []netip.Prefix{withdrawn, netip.MustParsePrefix("192.168.1.0/24"), netip.MustParsePrefix("192.168.2.0/24")} {
+		q.Push(prefix, &entry)
+	}
+	// 読まれる前の変更は最新のものにまとめられる
+	q.Push(withdrawn, nil)
+	announce, withdraw := q.Pop()
+	if len(announce) != 2 || len(withdraw) != 1 || withdraw[0] != withdrawn {
+		t.Errorf("Pop() = %v %v", announce, withdraw)
+	}
+
+	// 前のセッションの間にたまった変更は捨てる
+	q.Push(withdrawn, &entry)
+	q.PushEndOfRIB()
+	q.Clear()
+	if q.Len() != 0 || q.PopEndOfRIB() {
+		t.Errorf("Clear() should drop the pending changes and End-of-RIB")
+	}
+	select {
+	case <-q.notify:
+		t.Errorf("Clear() should drop the notification")
+	default:
+	}
+}
+
+func TestOutQueuePopWithdrawn(t *testing.T) {
+	q := NewOutQueue(10)
+	announced := netip.MustParsePrefix("192.168.0.0/24")
+	withdrawn := netip.MustParsePrefix("192.168.1.0/24")
+	entry := RibAdjEntry{}
+	q.Push(announced, &entry)
+	q.Push(withdrawn, nil)
+	withdraw := q.PopWithdrawn()
+	if len(withdraw) != 1 || withdraw[0] != withdrawn {
+		t.Errorf("PopWithdrawn() = %v", withdraw)
+	}
+	announce, withdraw := q.Pop()
+	if _, ok := announce[announced]; !ok || len(withdraw) != 0 {
+		t.Errorf("announce should stay in the queue: %v %v", announce, withdraw)
+	}
+}
+
+func TestOutQueueEndOfRIB(t *testing.T) {
+	q := NewOutQueue(10)
+	entry := RibAdjEntry{}
+	q.Push(netip.MustParsePrefix("192.168.0.0/24"), &entry)
+	q.PushEndOfRIB()
+	if q.PopEndOfRIB() {
+		t.Fatal("End-of-RIB should be sent after the pending routes")
+	}
+	q.Pop()
+	if !q.PopEndOfRIB() {
+		t.Fatal("End-of-RIB is not sent after the pending routes")
+	}
+	if q.PopEndOfRIB() {
+		t.Error("End-of-RIB is sent twice")
+	}
+}
+
+func TestOutQueuePopN(t *testing.T) {
+	q := NewOutQueue(0)
+	entry := RibAdjEntry{}
+	q.Push(netip.MustParsePrefix("192.168.0.0/24"), &entry)
+	q.Push(netip.MustParsePrefix("192.168.1.0/24"), &entry)
+	q.Push(netip.MustParsePrefix("192.168.2.0/24"), nil)
+	announce, withdraw := q.PopN(1)
+	if len(announce) != 0 || len(withdraw) != 1 {
+		t.Errorf("withdraw should be popped first: %v %v", announce, withdraw)
+	}
+	if announce, withdraw := q.PopN(0); len(announce) != 0 || len(withdraw) != 0 || q.Len() != 2 {
+		t.Errorf("PopN(0) = %v %v", announce, withdraw)
+	}
+	if announce, _ := q.PopN(-1); len(announce) != 2 || q.Len() != 0 {
+		t.Errorf("PopN(-1) = %v", announce)
+	}
+	if q.Room() != -1 {
+		t.Errorf("unlimited queue should have room: %v", q.Room())
+	}
+}
+
+// OutQueueが一杯でもLocRibQueueからの移動で待たない
+func TestPullChanges(t *testing.T) {
+	s := Session{OutQueue: NewOutQueue(2), LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}}
+	entry := RibAdjEntry{}
+	for _, prefix := range []string{"192.168.0.0/24", "192.168.1.0/24", "192.168.2.0/24"} {
+		s.LocRibQueue.Push(netip.MustParsePrefix(prefix), &entry)
+	}
+	s.LocRibQueue.PushEndOfRIB()
+	done := make(chan struct{})
+	go func() {
+		s.pullChanges()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pullChanges() waits for the full OutQueue")
+	}
+	if s.OutQueue.Len() != 2 || s.LocRibQueue.Len() != 1 || s.OutQueue.PopEndOfRIB() {
+		t.Fatalf("out %v, locrib %v", s.OutQueue.Len(), s.LocRibQueue.Len())
+	}
+	s.OutQueue.Pop()
+	select {
+	case <-s.OutQueue.space:
+	default:
+		t.Fatal("Pop() does not notify the space")
+	}
+	s.pullChanges()
+	if s.OutQueue.Len() != 1 || s.LocRibQueue.Len() != 0 {
+		t.Errorf("out %v, locrib %v", s.OutQueue.Len(), s.LocRibQueue.Len())
+	}
+	s.OutQueue.Pop()
+	if !s.OutQueue.PopEndOfRIB() {
+		t.Error("End-of-RIB is not passed after all changes")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+// ルーティングポリシーの設定
+// route_mapsの名前をピアのimport_policyとexport_policyに指定する
+type PolicyConfig struct {
+	PrefixLists    map[string][]PrefixListEntry    `json:"prefix_lists"`
+	ASPathLists    map[string][]ASPathListEntry    `json:"as_path_lists"`
+	CommunityLists map[string][]CommunityListEntry `json:"community_lists"`
+	RouteMaps      map[string][]RouteMapStatement  `json:"route_maps"`
+}
+
+type PolicyAction string
+
+const (
+	POLICYPERMIT PolicyAction = "permit"
+	POLICYDENY   PolicyAction = "deny"
+)
+
+func (a PolicyAction) validate() error {
+	if a != POLICYPERMIT && a != POLICYDENY {
+		return fmt.Errorf("invalid action: %q", a)
+	}
+	return nil
+}
+
+// prefixに含まれ、長さがge以上le以下のプレフィックスに一致する
+// geとleを指定しなければprefixと同じ長さのものだけに一致する
+type PrefixListEntry struct {
+	Action PolicyAction `json:"action"`
+	Prefix netip.Prefix `json:"prefix"`
+	GE     int          `json:"ge"`
+	LE     int          `json:"le"`
+}
+
+// AS_PATHを"65001 65002 {65003,65004} (65010)"のような文字列にして正規表現で調べる
+// _はASの区切りか先頭か末尾に一致する
+type ASPathListEntry struct {
+	Action PolicyAction `json:"action"`
+	Regex  string       `json:"regex"`
+}
+
+// "AS:値"かno-exportなどのwell-known communityを持つ経路に一致する
+type CommunityListEntry struct {
+	Action    PolicyAction `json:"action"`
+	Community string       `json:"community"`
+}
+
+// 上から順に調べ、matchの全ての条件に一致した最初の文で決める
+// どの文にも一致しなければ拒否する
+type RouteMapStatement struct {
+	Action PolicyAction  `json:"action"`
+	Match  RouteMapMatch `json:"match"`
+	Set    RouteMapSet   `json:"set"`
+}
+
+// 指定しなかった条件は調べない
+type RouteMapMatch struct {
+	PrefixList    string `json:"prefix_list"`
+	ASPathList    string `json:"as_path_list"`
+	CommunityList string `json:"community_list"`
+}
+
+// permitの文に一致した経路の属性を書き換える
+type RouteMapSet struct {
+	LocalPref       *uint32    `json:"local_pref"`
+	MED             *uint32    `json:"med"`
+	ASPathPrepend   []uint16   `json:"as_path_prepend"`
+	CommunityAdd    []string   `json:"community_add"`
+	CommunityRemove []string   `json:"community_remove"`
+	NextHop         netip.Addr `json:"next_hop"`
+}
+
+type prefixListEntry struct {
+	action PolicyAction
+	prefix netip.Prefix
+	ge, le int
+}
+
+type prefixList []prefixListEntry
+
+type asPathListEntry struct {
+	action PolicyAction
+	regex  *regexp.Regexp
+}
+
+type asPathList []asPathListEntry
+
+type communityListEntry struct {
+	action    PolicyAction
+	community update.Community
+}
+
+type communityList []communityListEntry
+
+type routeMapSet struct {
+	localPref       *update.LOCAL_PREF
+	med             *update.MULTI_EXIT_DISC
+	asPathPrepend   []uint16
+	communityAdd    []update.Community
+	communityRemove []update.Community
+	nextHop         netip.Addr
+}
+
+type routeMapStatement struct {
+	action        PolicyAction
+	prefixList    prefixList
+	asPathList    asPathList
+	communityList communityList
+	set           routeMapSet
+}
+
+type RouteMap struct {
+	Name       string
+	statements []routeMapStatement
+}
+
+// 設定を読んでルートマップを名前で引けるようにする
+func CompileRouteMaps(config PolicyConfig) (map[string]*RouteMap, error) {
+	prefixLists := make(map[string]prefixList)
+	for name, entries := range config.PrefixLists {
+		list, err := compilePrefixList(entries)
+		if err != nil {
+			return nil, fmt.Errorf("prefix list %v: %v", name, err)
+		}
+		prefixLists[name] = list
+	}
+	asPathLists := make(map[string]asPathList)
+	for name, entries := range config.ASPathLists {
+		list, err := compileASPathList(entries)
+		if err != nil {
+			return nil, fmt.Errorf("as-path list %v: %v", name, err)
+		}
+		asPathLists[name] = list
+	}
+	communityLists := make(map[string]communityList)
+	for name, entries := range config.CommunityLists {
+		list, err := compileCommunityList(entries)
+		if err != nil {
+			return nil, fmt.Errorf("community list %v: %v", name, err)
+		}
+		communityLists[name] = list
+	}
+	routeMaps := make(map[string]*RouteMap)
+	for name, statements := range config.RouteMaps {
+		m := &RouteMap{Name: name}
+		for i, statement := range statements {
+			compiled, err := compileStatement(statement, prefixLists, asPathLists, communityLists)
+			if err != nil {
+				return nil, fmt.Errorf("route map %v statement %d: %v", name, i, err)
+			}
+			m.statements = append(m.statements, compiled)
+		}
+		routeMaps[name] = m
+	}
+	return routeMaps, nil
+}
+
+func compilePrefixList(entries []PrefixListEntry) (prefixList, error) {
+	list := make(prefixList, 0, len(entries))
+	for _, entry := range entries {
+		if err := entry.Action.validate(); err != nil {
+			return nil, err
+		}
+		if !entry.Prefix.IsValid() || !entry.Prefix.Addr().Is4() {
+			return nil, fmt.Errorf("invalid prefix: %v", entry.Prefix)
+		}
+		ge, le := entry.GE, entry.LE
+		if ge == 0 && le == 0 {
+			ge, le = entry.Prefix.Bits(), entry.Prefix.Bits()
+		} else if ge == 0 {
+			ge = entry.Prefix.Bits()
+		} else if le == 0 {
+			le = 32
+		}
+		if ge < entry.Prefix.Bits() || le > 32 || ge > le {
+			return nil, fmt.Errorf("invalid ge/le for %v: %d-%d", entry.Prefix, entry.GE, entry.LE)
+		}
+		list = append(list, prefixListEntry{entry.Action, entry.Prefix.Masked(), ge, le})
+	}
+	return list, nil
+}
+
+// _をASの区切りに置き換えてコンパイルする
+func compileASPathList(entries []ASPathListEntry) (asPathList, error) {
+	list := make(asPathList, 0, len(entries))
+	for _, entry := range entries {
+		if err := entry.Action.validate(); err != nil {
+			return nil, err
+		}
+		regex, err := regexp.Compile(strings.ReplaceAll(entry.Regex, "_", `(^|[ ,{}()\[\]]|$)`))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, asPathListEntry{entry.Action, regex})
+	}
+	return list, nil
+}
+
+func compileCommunityList(entries []CommunityListEntry) (communityList, error) {
+	list := make(communityList, 0, len(entries))
+	for _, entry := range entries {
+		if err := entry.Action.validate(); err != nil {
+			return nil, err
+		}
+		community, err := update.ParseCommunity(entry.Community)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, communityListEntry{entry.Action, community})
+	}
+	return list, nil
+}
+
+func parseCommunities(s []string) ([]update.Community, error) {
+	communities := make([]update.Community, 0, len(s))
+	for _, v := range s {
+		community, err := update.ParseCommunity(v)
+		if err != nil {
+			return nil, err
+		}
+		communities = append(communities, community)
+	}
+	return communities, nil
+}
+
+func compileStatement(statement RouteMapStatement, prefixLists map[string]prefixList, asPathLists map[string]asPathList, communityLists map[string]communityList) (routeMapStatement, error) {
+	compiled := routeMapStatement{action: statement.Action}
+	if err := statement.Action.validate(); err != nil {
+		return compiled, err
+	}
+	var ok bool
+	if name := statement.Match.PrefixList; name != "" {
+		if compiled.prefixList, ok = prefixLists[name]; !ok {
+			return compiled, fmt.Errorf("undefined prefix list: %v", name)
+		}
+	}
+	if name := statement.Match.ASPathList; name != "" {
+		if compiled.asPathList, ok = asPathLists[name]; !ok {
+			return compiled, fmt.Errorf("undefined as-path list: %v", name)
+		}
+	}
+	if name := statement.Match.CommunityList; name != "" {
+		if compiled.communityList, ok = communityLists[name]; !ok {
+			return compiled, fmt.Errorf("undefined community list: %v", name)
+		}
+	}
+	set := statement.Set
+	if set.LocalPref != nil {
+		localPref := update.LOCAL_PREF(*set.LocalPref)
+		compiled.set.localPref = &localPref
+	}
+	if set.MED != nil {
+		med := update.MULTI_EXIT_DISC(*set.MED)
+		compiled.set.med = &med
+	}
+	compiled.set.asPathPrepend = set.ASPathPrepend
+	var err error
+	if compiled.set.communityAdd, err = parseCommunities(set.CommunityAdd); err != nil {
+		return compiled, err
+	}
+	if compiled.set.communityRemove, err = parseCommunities(set.CommunityRemove); err != nil {
+		return compiled, err
+	}
+	if set.NextHop.IsValid() && !set.NextHop.Is4() {
+		return compiled, fmt.Errorf("invalid next_hop: %v", set.NextHop)
+	}
+	compiled.set.nextHop = set.NextHop
+	return compiled, nil
+}
+
+// 上から順に調べ、一致した最初のエントリのactionを返す. どれにも一致しなければ拒否する
+func (l prefixList) permit(prefix netip.Prefix) bool {
+	for _, entry := range l {
+		if prefix.Bits() >= entry.ge && prefix.Bits() <= entry.le && entry.prefix.Contains(prefix.Addr()) {
+			return entry.action == POLICYPERMIT
+		}
+	}
+	return false
+}
+
+func (l asPathList) permit(path update.AS_PATH) bool {
+	s := asPathString(path)
+	for _, entry := range l {
+		if entry.regex.MatchString(s) {
+			return entry.action == POLICYPERMIT
+		}
+	}
+	return false
+}
+
+func (l communityList) permit(communities update.COMMUNITIES) bool {
+	for _, entry := range l {
+		if communities.Contains(entry.community) {
+			return entry.action == POLICYPERMIT
+		}
+	}
+	return false
+}
+
+// AS_SETは{}, AS_CONFED_SEQUENCEは(), AS_CONFED_SETは[]で囲む
+func asPathString(path update.AS_PATH) string {
+	segments := make([]string, 0, len(path))
+	for _, segment := range path {
+		ASes := make([]string, 0, len(segment.AS_SEQUENCE))
+		for _, AS := range segment.AS_SEQUENCE {
+			ASes = append(ASes, strconv.Itoa(int(AS)))
+		}
+		switch segment.VALUE_SEGMENT {
+		case update.VALUE_SEGMENT_AS_SET:
+			segments = append(segments, "{"+strings.Join(ASes, ",")+"}")
+		case update.VALUE_SEGMENT_AS_CONFED_SEQUENCE:
+			segments = append(segments, "("+strings.Join(ASes, " ")+")")
+		case update.VALUE_SEGMENT_AS_CONFED_SET:
+			segments = append(segments, "["+strings.Join(ASes, ",")+"]")
+		default:
+			segments = append(segments, strings.Join(ASes, " "))
+		}
+	}
+	return strings.Join(segments, " ")
+}
+
+func (s routeMapStatement) match(prefix netip.Prefix, entry RibAdjEntry) bool {
+	if s.prefixList != nil && !s.prefixList.permit(prefix) {
+		return false
+	}
+	if s.asPathList != nil && !s.asPathList.permit(entry.AS_PATH) {
+		return false
+	}
+	if s.communityList != nil && !s.communityList.permit(entry.COMMUNITIES) {
+		return false
+	}
+	return true
+}
+
+// 共有しているスライスは書き換えず、新しいスライスを作る
+func (s routeMapSet) apply(entry *RibAdjEntry) {
+	if s.localPref != nil {
+		entry.LOCAL_PREF = *s.localPref
+	}
+	if s.med != nil {
+		entry.MULTI_EXIT_DISC = *s.med
+	}
+	for i := len(s.asPathPrepend) - 1; i >= 0; i-- {
+		entry.AS_PATH = entry.AS_PATH.Prepend(s.asPathPrepend[i])
+	}
+	if len(s.communityRemove) != 0 {
+		var communities update.COMMUNITIES
+		for _, c := range entry.COMMUNITIES {
+			if !update.COMMUNITIES(s.communityRemove).Contains(c) {
+				communities = append(communities, c)
+			}
+		}
+		entry.COMMUNITIES = communities
+	}
+	for _, c := range s.communityAdd {
+		if !entry.COMMUNITIES.Contains(c) {
+			entry.COMMUNITIES = append(entry.COMMUNITIES[:len(entry.COMMUNITIES):len(entry.COMMUNITIES)], c)
+		}
+	}
+	if s.nextHop.IsValid() {
+		entry.NEXT_HOP = update.NEXT_HOP(s.nextHop)
+	}
+}
+
+// matchの経路で条件を調べ、許可されればentryの属性を書き換えてtrueを返す
+// nilのルートマップは全ての経路をそのまま許可する
+func (m *RouteMap) Apply(prefix netip.Prefix, match RibAdjEntry, entry *RibAdjEntry) bool {
+	if m == nil {
+		return true
+	}
+	for _, statement := range m.statements {
+		if !statement.match(prefix, match) {
+			continue
+		}
+		if statement.action == POLICYDENY {
+			return false
+		}
+		statement.set.apply(entry)
+		return true
+	}
+	return false
+}
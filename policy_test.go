@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/81ueman/local-clos/message/update"
+)
+
+func TestPrefixList(t *testing.T) {
+	list, err := compilePrefixList([]PrefixListEntry{
+		{Action: POLICYDENY, Prefix: netip.MustParsePrefix("10.1.1.0/24")},
+		{Action: POLICYPERMIT, Prefix: netip.MustParsePrefix("10.1.0.0/16"), LE: 24},
+		{Action: POLICYPERMIT, Prefix: netip.MustParsePrefix("10.2.0.0/16"), GE: 32},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		want   bool
+	}{
+		{"10.1.0.0/16", true},
+		{"10.1.2.0/24", true},
+		{"10.1.1.0/24", false},
+		{"10.1.2.0/25", false},
+		{"10.2.3.4/32", true},
+		{"10.2.3.0/24", false},
+		{"10.3.0.0/16", false},
+	}
+	for _, tt := range tests {
+		if got := list.permit(netip.MustParsePrefix(tt.prefix)); got != tt.want {
+			t.Errorf("permit(%v) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+	for _, invalid := range []PrefixListEntry{
+		{Action: POLICYPERMIT, Prefix: netip.MustParsePrefix("10.0.0.0/16"), GE: 8},
+		{Action: POLICYPERMIT, Prefix: netip.MustParsePrefix("10.0.0.0/16"), GE: 24, LE: 20},
+		{Action: "accept", Prefix: netip.MustParsePrefix("10.0.0.0/16")},
+	} {
+		if _, err := compilePrefixList([]PrefixListEntry{invalid}); err == nil {
+			t.Errorf("%+v should be rejected", invalid)
+		}
+	}
+}
+
+func TestASPathList(t *testing.T) {
+	tests := []struct {
+		regex string
+		path  update.AS_PATH
+		want  bool
+	}{
+		{"^65001_", path("10.0.0.1", 65001, 65002).AS_PATH, true},
+		{"^65001_", path("10.0.0.1", 65002, 65001).AS_PATH, false},
+		{"_65001$", path("10.0.0.1", 65002, 65001).AS_PATH, true},
+		{"_6500_", path("10.0.0.1", 65001).AS_PATH, false},
+		{"^$", update.AS_PATH{}, true},
+		{"_65003_", update.AS_PATH{
+			{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_CONFED_SEQUENCE, AS_SEQUENCE: []uint16{65010}},
+			{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SET, AS_SEQUENCE: []uint16{65003, 65004}},
+		}, true},
+	}
+	for _, tt := range tests {
+		list, err := compileASPathList([]ASPathListEntry{{Action: POLICYPERMIT, Regex: tt.regex}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := list.permit(tt.path); got != tt.want {
+			t.Errorf("%v matches %q = %v, want %v", tt.regex, asPathString(tt.path), got, tt.want)
+		}
+	}
+	if s := asPathString(tests[5].path); s != "(65010) {65003,65004}" {
+		t.Errorf("asPathString() = %q", s)
+	}
+}
+
+func TestRouteMap(t *testing.T) {
+	localPref := uint32(200)
+	med := uint32(50)
+	routeMaps, err := CompileRouteMaps(PolicyConfig{
+		PrefixLists: map[string][]PrefixListEntry{
+			"customer": {{Action: POLICYPERMIT, Prefix: netip.MustParsePrefix("10.1.0.0/16"), LE: 24}},
+		},
+		ASPathLists: map[string][]ASPathListEntry{
+			"from-65001": {{Action: POLICYPERMIT, Regex: "^65001_"}},
+		},
+		CommunityLists: map[string][]CommunityListEntry{
+			"blackhole": {{Action: POLICYPERMIT, Community: "65000:666"}},
+		},
+		RouteMaps: map[string][]RouteMapStatement{
+			"import": {
+				{Action: POLICYDENY, Match: RouteMapMatch{CommunityList: "blackhole"}},
+				{
+					Action: POLICYPERMIT,
+					Match:  RouteMapMatch{PrefixList: "customer", ASPathList: "from-65001"},
+					Set: RouteMapSet{
+						LocalPref:       &localPref,
+						MED:             &med,
+						ASPathPrepend:   []uint16{65000, 65000},
+						CommunityAdd:    []string{"65000:100", "no-export"},
+						CommunityRemove: []string{"65001:1"},
+						NextHop:         netip.MustParseAddr("10.0.0.254"),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := routeMaps["import"]
+	with := func(e RibAdjEntry, f func(*RibAdjEntry)) RibAdjEntry {
+		f(&e)
+		return e
+	}
+	customer := netip.MustParsePrefix("10.1.2.0/24")
+	tests := []struct {
+		name   string
+		prefix netip.Prefix
+		entry  RibAdjEntry
+		want   bool
+	}{
+		{"permitted", customer, path("10.0.0.1", 65001, 65002), true},
+		{"denied by community", customer, with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.COMMUNITIES = update.COMMUNITIES{0xFDE8029A} }), false},
+		{"other as path", customer, path("10.0.0.1", 65002, 65001), false},
+		{"other prefix", netip.MustParsePrefix("10.2.0.0/24"), path("10.0.0.1", 65001), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := tt.entry
+			if got := m.Apply(tt.prefix, tt.entry, &entry); got != tt.want {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	entry := with(path("10.0.0.1", 65001), func(e *RibAdjEntry) { e.COMMUNITIES = update.COMMUNITIES{0xFDE90001, 0xFDE90002} })
+	original := entry
+	if !m.Apply(customer, entry, &entry) {
+		t.Fatal("route is denied")
+	}
+	if entry.LOCAL_PREF != 200 || entry.MULTI_EXIT_DISC != 50 || netip.Addr(entry.NEXT_HOP) != netip.MustParseAddr("10.0.0.254") {
+		t.Errorf("attributes are not set: %+v", entry)
+	}
+	if !reflect.DeepEqual(entry.AS_PATH[0].AS_SEQUENCE, []uint16{65000, 65000, 65001}) {
+		t.Errorf("as path is not prepended: %v", entry.AS_PATH)
+	}
+	if !reflect.DeepEqual(entry.COMMUNITIES, update.COMMUNITIES{0xFDE90002, 0xFDE80064, update.CommunityNoExport}) {
+		t.Errorf("invalid communities: %v", entry.COMMUNITIES)
+	}
+	if !reflect.DeepEqual(original.COMMUNITIES, update.COMMUNITIES{0xFDE90001, 0xFDE90002}) || len(original.AS_PATH[0].AS_SEQUENCE) != 1 {
+		t.Errorf("original route is modified: %+v", original)
+	}
+
+	var permitAll *RouteMap
+	if !permitAll.Apply(customer, original, &entry) {
+		t.Error("nil route map should permit all routes")
+	}
+	if _, err := CompileRouteMaps(PolicyConfig{RouteMaps: map[string][]RouteMapStatement{
+		"import": {{Action: POLICYPERMIT, Match: RouteMapMatch{PrefixList: "undefined"}}},
+	}}); err == nil {
+		t.Error("undefined prefix list should be rejected")
+	}
+}
+
+func TestLocRibPolicy(t *testing.T) {
+	localPref := uint32(200)
+	routeMaps, err := CompileRouteMaps(PolicyConfig{
+		PrefixLists: map[string][]PrefixListEntry{
+			"allowed": {{Action: POLICYPERMIT, Prefix: netip.MustParsePrefix("10.1.0.0/16"), LE: 24}},
+		},
+		RouteMaps: map[string][]RouteMapStatement{
+			"import": {{Action: POLICYPERMIT, Match: RouteMapMatch{PrefixList: "allowed"}, Set: RouteMapSet{LocalPref: &localPref}}},
+			"export": {{Action: POLICYPERMIT, Set: RouteMapSet{ASPathPrepend: []uint16{65000}}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := netip.MustParsePrefix("10.1.0.0/24")
+	other := netip.MustParsePrefix("10.2.0.0/24")
+	ch1 := make(chan RibDelta, 1)
+	ch2 := make(chan RibDelta, 1)
+	L := LocRib{
+		peers: []Peer{
+			{RibAdjInCh: ch1, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}, ImportPolicy: "import"},
+			{RibAdjInCh: ch2, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}, ExportPolicy: "export"},
+		},
+		routeMaps: routeMaps,
+	}
+	ch2 <- RibDelta{Request: true, Target: &ExportTarget{LocalInfo: LocalInfo{AS: 65000}, PeerAddr: netip.MustParseAddr("10.0.1.1")}}
+	L.Handle()
+	L.peers[1].LocRibQueue.PopEndOfRIB()
+
+	// import policyで拒否した経路は最良経路に選ばない
+	route := path("10.0.0.1", 65001)
+	ch1 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{allowed: &route, other: &route}}
+	L.Handle()
+	if best, ok := L.adjBest[allowed]; !ok || best.LOCAL_PREF != 200 {
+		t.Errorf("import policy is not applied: %+v", best)
+	}
+	if _, ok := L.adjBest[other]; ok {
+		t.Errorf("denied route is selected")
+	}
+	// export policyは広告用に書き換えた経路にさらに適用する
+	announce, _ := L.peers[1].LocRibQueue.Pop()
+	exported, ok := announce[allowed]
+	if len(announce) != 1 || !ok || !reflect.DeepEqual(exported.AS_PATH[0].AS_SEQUENCE, []uint16{65000, 65000, 65001}) {
+		t.Errorf("export policy is not applied: %v", announce)
+	}
+}
@@ -9,102 +9,410 @@ import (
 	"os/exec"
 	"os/signal"
 	"reflect"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/81ueman/local-clos/message/update"
 )
 
+// eBGPで学習した経路や自分で生成した経路に付けるLOCAL_PREF
+const DEFAULTLOCALPREF update.LOCAL_PREF = 100
+
+// 経路の学習元のピア
+// 自分で生成した経路ではゼロ値になる
+type PathSource struct {
+	PeerAS       uint16
+	PeerRouterID netip.Addr
+	PeerAddr     netip.Addr
+	IBGP         bool
+	// ルートリフレクタのクライアントから学習したか
+	RRClient bool
+	// 同じコンフェデレーションの別のメンバーASから学習したか
+	ConfedEBGP bool
+	// 自分で生成した経路の種類
+	Kind LocalRouteKind
+	// 自分で生成した経路をピアに広告しない
+	NoAdvertise bool
+}
+
 type RibAdjEntry struct {
 	ORIGIN           update.Origin
 	AS_PATH          update.AS_PATH
 	NEXT_HOP         update.NEXT_HOP
+	MULTI_EXIT_DISC  update.MULTI_EXIT_DISC
 	LOCAL_PREF       update.LOCAL_PREF
 	ATOMIC_AGGREGATE update.ATOMIC_AGGREGATE
+	// Addressが無効なら付けない
+	AGGREGATOR    update.AGGREGATOR
+	ORIGINATOR_ID update.ORIGINATOR_ID
+	CLUSTER_LIST  update.CLUSTER_LIST
+	COMMUNITIES   update.COMMUNITIES
+	// Link Bandwidthなど
+	EXTENDED_COMMUNITIES update.EXTENDED_COMMUNITIES
+	Source               PathSource
+	// フラップダンピングで抑制中. Adj-RIB-Inには残すが最良経路には選ばない
+	Suppressed bool
+	// Graceful Restart中のピアから以前に受け取った経路
+	Stale bool
+	// 最後に属性が変わった時刻. 最良経路の選択で古い経路を選ぶのに使う
+	Received time.Time
+	// NEXT_HOPまでのIGPコスト. LocRibがピアの経路を入れるときに決める
+	IGPCost uint32
+}
+
+// 自分で生成した経路かどうか
+func (e RibAdjEntry) Local() bool {
+	return !e.Source.PeerAddr.IsValid()
+}
+
+// 最良経路の選択ではORIGINATOR_IDがあればrouter-idの代わりに使う (RFC 4456 9)
+func (e RibAdjEntry) routerID() netip.Addr {
+	if netip.Addr(e.ORIGINATOR_ID).IsValid() {
+		return netip.Addr(e.ORIGINATOR_ID)
+	}
+	return e.Source.PeerRouterID
 }
 
 type RibAdj map[netip.Prefix]RibAdjEntry
 
-func ASLoop(AS_PATH update.AS_PATH, localAS uint16) bool {
-	for _, AS := range AS_PATH.AS_SEQUENCE {
-		if AS == localAS {
-			log.Printf("AS loop detected")
+// ループ検出や広告に使う自分自身の情報
+// コンフェデレーションを使う場合ASはメンバーASになる
+type LocalInfo struct {
+	AS          uint16
+	RouterID    netip.Addr
+	ClusterID   netip.Addr
+	ConfedID    uint16
+	ConfedPeers []uint16
+	// Graceful Restartを使わなければnil
+	GR *GracefulRestartState
+}
+
+// コンフェデレーションの外から見える自AS
+func (l LocalInfo) ExternalAS() uint16 {
+	if l.ConfedID != 0 {
+		return l.ConfedID
+	}
+	return l.AS
+}
+
+// 同じコンフェデレーションの別のメンバーASかどうか
+func (l LocalInfo) ConfedMember(AS uint16) bool {
+	if l.ConfedID == 0 {
+		return false
+	}
+	for _, peer := range l.ConfedPeers {
+		if peer == AS {
 			return true
 		}
 	}
 	return false
 }
 
-func (R *RibAdj) Update(msg update.Update, AS uint16) {
+// 広告先のピア
+type ExportTarget struct {
+	LocalInfo
+	// 広告に使う自分のアドレス
+	NextHop netip.Addr
+	// 広告先のピアのアドレス. このピアから学習した経路は送り返さない
+	PeerAddr    netip.Addr
+	IBGP        bool
+	NextHopSelf bool
+	RRClient    bool
+	ConfedEBGP  bool
+	// eBGPピアに広告する経路に付けるLink Bandwidth (byte/s). 0なら付けない
+	LinkBandwidth float32
+}
+
+// LOCAL_PREFを送るのはAS内かコンフェデレーション内のピア
+func (t ExportTarget) Internal() bool {
+	return t.IBGP || t.ConfedEBGP
+}
+
+// iBGPのピアから受け取った経路もAS_PATHに自ASが入っていればループしている
+// コンフェデレーションではメンバーASがどこかに、コンフェデレーションIDがその外側にあればループ
+func ASLoop(AS_PATH update.AS_PATH, local LocalInfo) bool {
+	if AS_PATH.Contains(local.AS) {
+		log.Printf("AS loop detected")
+		return true
+	}
+	if local.ConfedID != 0 && AS_PATH.ContainsOutsideConfed(local.ConfedID) {
+		log.Printf("confederation loop detected")
+		return true
+	}
+	return false
+}
+
+// 自分が反射した経路が戻ってきたかどうか (RFC 4456 8)
+func reflectionLoop(msg update.Update, local LocalInfo) bool {
+	if msg.PathAttrOriginatorID != nil && netip.Addr(*msg.PathAttrOriginatorID) == local.RouterID {
+		log.Printf("originator id loop detected")
+		return true
+	}
+	for _, id := range msg.PathAttrClusterList {
+		if id == local.ClusterID {
+			log.Printf("cluster list loop detected")
+			return true
+		}
+	}
+	return false
+}
+
+// dがnilでなければ取り消しや属性の変更をフラップとしてペナルティを加える
+// 経路が追加、変更、削除されたプレフィックスを返す
+func (R *RibAdj) Update(msg update.Update, local LocalInfo, src PathSource, d *Damper) []netip.Prefix {
+	changed := make([]netip.Prefix, 0)
 	for _, prefix := range msg.WithdrawnRoutes {
-		delete(*R, prefix)
+		if R.withdraw(prefix, d) {
+			changed = append(changed, prefix)
+		}
 	}
-	if ASLoop(msg.PathAttrASPath, AS) {
-		return
+	// ループしている経路は受け取らず、以前の経路も取り消されたものとして扱う
+	if ASLoop(msg.PathAttrASPath, local) || reflectionLoop(msg, local) {
+		for _, prefix := range msg.NetworkLayerReachabilityInformation {
+			if R.withdraw(prefix, d) {
+				changed = append(changed, prefix)
+			}
+		}
+		return changed
+	}
+	// eBGPピアから来たLOCAL_PREFは無視する
+	localPref := DEFAULTLOCALPREF
+	if (src.IBGP || src.ConfedEBGP) && msg.PathAttrLocalPref != nil {
+		localPref = *msg.PathAttrLocalPref
 	}
 	entry := RibAdjEntry{
-		ORIGIN:     msg.PathAttrOrigin,
-		AS_PATH:    msg.PathAttrASPath,
-		NEXT_HOP:   msg.PathAttrNextHop,
-		LOCAL_PREF: msg.PathAttrLocalPref,
+		ORIGIN:               msg.PathAttrOrigin,
+		AS_PATH:              msg.PathAttrASPath,
+		NEXT_HOP:             msg.PathAttrNextHop,
+		LOCAL_PREF:           localPref,
+		ATOMIC_AGGREGATE:     msg.PathAttrAtomicAggregate,
+		CLUSTER_LIST:         msg.PathAttrClusterList,
+		COMMUNITIES:          msg.PathAttrCommunities,
+		EXTENDED_COMMUNITIES: msg.PathAttrExtCommunities,
+		Source:               src,
 	}
+	if msg.PathAttrMED != nil {
+		entry.MULTI_EXIT_DISC = *msg.PathAttrMED
+	}
+	if msg.PathAttrOriginatorID != nil {
+		entry.ORIGINATOR_ID = *msg.PathAttrOriginatorID
+	}
+	if msg.PathAttrAggregator != nil {
+		entry.AGGREGATOR = *msg.PathAttrAggregator
+	}
+	now := time.Now()
 	for _, prefix := range msg.NetworkLayerReachabilityInformation {
-		_, ok := (*R)[prefix]
-		if !ok || ok && !reflect.DeepEqual((*R)[prefix], entry) {
-			(*R)[prefix] = entry
+		entry := entry
+		old, ok := (*R)[prefix]
+		if ok {
+			cmp := old
+			cmp.Suppressed = false
+			cmp.Stale = false
+			entry.Received = old.Received
+			if reflect.DeepEqual(cmp, entry) {
+				// 再接続したピアから同じ経路が届いたらstaleでなくなる
+				old.Stale = false
+				(*R)[prefix] = old
+				continue
+			}
+			d.penalize(prefix, ATTRCHANGEPENALTY)
 		}
+		entry.Received = now
+		entry.Suppressed = d.Suppressed(prefix)
+		(*R)[prefix] = entry
+		changed = append(changed, prefix)
 	}
+	return changed
 }
 
-// prefix s.t.
-// prefix in R && prefix not in other
-// or
-// prefix in R && prefix in other && R[prefix] != other[prefix]
-func (R *RibAdj) diff(other RibAdj) (RibAdj, []netip.Prefix) {
-	log.Printf("compare %v and %v", R, other)
-	diff := make(RibAdj)
-	deleteroute := make([]netip.Prefix, 0)
-	for prefix, entry := range *R {
-		otherEntry, ok := other[prefix]
-		if !ok {
-			diff[prefix] = entry
+// 経路があって取り消した場合はtrueを返す
+func (R *RibAdj) withdraw(prefix netip.Prefix, d *Damper) bool {
+	if _, ok := (*R)[prefix]; !ok {
+		return false
+	}
+	d.penalize(prefix, WITHDRAWPENALTY)
+	delete(*R, prefix)
+	return true
+}
+
+// セッションからLocRibへ送るAdj-RIB-Inの変更
+type RibDelta struct {
+	// 変わったプレフィックスの経路. nilは取り消し
+	Changes map[netip.Prefix]*RibAdjEntry
+	// 以前に送った経路を全て取り消してからChangesを反映する
+	Reset bool
+	// Establishedになったセッションからの今のLoc-RIBの要求
+	Request bool
+	// Requestで送る広告先のピア. これに合わせてAdj-RIB-Outを作る
+	Target *ExportTarget
+}
+
+// prefixesの今の経路をRibDeltaにする
+func (R RibAdj) delta(prefixes []netip.Prefix) RibDelta {
+	changes := make(map[netip.Prefix]*RibAdjEntry, len(prefixes))
+	for _, prefix := range prefixes {
+		if entry, ok := R[prefix]; ok {
+			changes[prefix] = &entry
+		} else {
+			changes[prefix] = nil
 		}
-		if ok && !reflect.DeepEqual(entry, otherEntry) {
-			diff[prefix] = entry
+	}
+	return RibDelta{Changes: changes}
+}
+
+// ピアに広告する経路を選び、広告用に属性を書き換えたRibAdjを返す
+func (R RibAdj) Export(t ExportTarget) RibAdj {
+	exported := make(RibAdj)
+	for prefix, entry := range R {
+		if entry, ok := exportEntry(entry, t); ok {
+			exported[prefix] = entry
 		}
 	}
-	for prefix := range other {
-		_, ok := (*R)[prefix]
-		if !ok {
-			deleteroute = append(deleteroute, prefix)
+	return exported
+}
+
+// 広告用に属性を書き換えた経路を返す. 広告しない経路ならfalseを返す
+func exportEntry(entry RibAdjEntry, t ExportTarget) (RibAdjEntry, bool) {
+	// 同じピアから学習した経路は送り返さない (split horizon)
+	if t.PeerAddr.IsValid() && entry.Source.PeerAddr == t.PeerAddr {
+		return entry, false
+	}
+	if entry.Source.NoAdvertise {
+		return entry, false
+	}
+	// well-known communityで広告先を制限する (RFC 1997)
+	if entry.COMMUNITIES.Contains(update.CommunityNoAdvertise) {
+		return entry, false
+	}
+	if entry.COMMUNITIES.Contains(update.CommunityNoExport) && !t.Internal() {
+		return entry, false
+	}
+	if entry.COMMUNITIES.Contains(update.CommunityNoExportSubconfed) && !t.IBGP {
+		return entry, false
+	}
+	if t.IBGP {
+		// iBGPで学習した経路はルートリフレクタとして反射する場合だけ他のiBGPピアに広告する
+		// クライアントからの経路は全てのiBGPピアへ、それ以外からの経路はクライアントへのみ反射する
+		if entry.Source.IBGP {
+			if !entry.Source.RRClient && !t.RRClient {
+				return entry, false
+			}
+			if !netip.Addr(entry.ORIGINATOR_ID).IsValid() {
+				entry.ORIGINATOR_ID = update.ORIGINATOR_ID(entry.Source.PeerRouterID)
+			}
+			entry.CLUSTER_LIST = append(update.CLUSTER_LIST{t.ClusterID}, entry.CLUSTER_LIST...)
 		}
+		// NEXT_HOPはそのまま. 自分で生成した経路は自分を指す
+		if entry.Local() || t.NextHopSelf {
+			entry.NEXT_HOP = update.NEXT_HOP(t.NextHop)
+		}
+	} else {
+		// コンフェデレーション内ではAS_CONFED_SEQUENCEにメンバーASを、
+		// 外に出すときはコンフェデレーションのセグメントを取り除いてコンフェデレーションIDを付ける
+		if t.ConfedEBGP {
+			entry.AS_PATH = entry.AS_PATH.PrependConfed(t.AS)
+		} else {
+			entry.AS_PATH = entry.AS_PATH.WithoutConfed().Prepend(t.ExternalAS())
+		}
+		entry.NEXT_HOP = update.NEXT_HOP(t.NextHop)
+		// ORIGINATOR_IDとCLUSTER_LISTはAS内だけで使う
+		entry.ORIGINATOR_ID = update.ORIGINATOR_ID{}
+		entry.CLUSTER_LIST = nil
+	}
+	entry.EXTENDED_COMMUNITIES = exportExtCommunities(entry, t)
+	// MEDは別の隣接ASへは伝えない (RFC 4271 5.1.4)
+	if !t.Internal() {
+		entry.MULTI_EXIT_DISC = 0
 	}
-	return diff, deleteroute
+	// 受信側の状態は広告しない
+	entry.Suppressed = false
+	entry.Stale = false
+	entry.Received = time.Time{}
+	return entry, true
 }
 
-func (R *RibAdj) ToUpdateMsg(adjRibOut RibAdj, nexthop netip.Addr) []update.Update {
-	ribdiff, deleteroute := R.diff(adjRibOut)
-	log.Printf("ribdiff: %v", ribdiff)
-	msgs := make([]update.Update, 0)
-	for prefix, entry := range ribdiff {
+// LOCAL_PREFはAS内かコンフェデレーション内のピアに送る場合のみ付ける
+// ORIGINATOR_IDとCLUSTER_LISTはExportでiBGPピア向けにだけ残される
+// 属性が同じ経路は1つのUPDATEにまとめ、どのメッセージもMAXMESSAGELENGTHに収める
+func updateMsgs(announce RibAdj, deleteroute []netip.Prefix, internal bool) []update.Update {
+	// 経路が多いと全部を表示するのに時間がかかるので数だけ出す
+	log.Printf("announce %d prefixes, withdraw %d prefixes", len(announce), len(deleteroute))
+	prefixes := make([]netip.Prefix, 0, len(announce))
+	for prefix := range announce {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixLess(prefixes[i], prefixes[j]) })
+	// エンコードした属性ごとにまとめる
+	groups := make([]update.Update, 0)
+	index := make(map[string]int)
+	for _, prefix := range prefixes {
+		entry := announce[prefix]
 		msg := update.Update{
 			NetworkLayerReachabilityInformation: []netip.Prefix{prefix},
 			PathAttrOrigin:                      entry.ORIGIN,
 			PathAttrASPath:                      entry.AS_PATH,
-			PathAttrNextHop:                     update.NEXT_HOP(nexthop),
-			PathAttrLocalPref:                   entry.LOCAL_PREF,
+			PathAttrNextHop:                     entry.NEXT_HOP,
+		}
+		if internal {
+			localPref := entry.LOCAL_PREF
+			msg.PathAttrLocalPref = &localPref
+		}
+		if entry.MULTI_EXIT_DISC != 0 {
+			med := entry.MULTI_EXIT_DISC
+			msg.PathAttrMED = &med
+		}
+		msg.PathAttrAtomicAggregate = entry.ATOMIC_AGGREGATE
+		if entry.AGGREGATOR.Address.IsValid() {
+			aggregator := entry.AGGREGATOR
+			msg.PathAttrAggregator = &aggregator
 		}
-		msgs = append(msgs, msg)
+		if netip.Addr(entry.ORIGINATOR_ID).IsValid() {
+			originatorID := entry.ORIGINATOR_ID
+			msg.PathAttrOriginatorID = &originatorID
+		}
+		msg.PathAttrClusterList = entry.CLUSTER_LIST
+		msg.PathAttrCommunities = entry.COMMUNITIES
+		msg.PathAttrExtCommunities = entry.EXTENDED_COMMUNITIES
+		b, err := msg.Marshal()
+		if err != nil {
+			log.Printf("failed to marshal %v: %v", prefix, err)
+			continue
+		}
+		key := string(b[:len(b)-update.PrefixLength(prefix)])
+		if i, ok := index[key]; ok {
+			groups[i].NetworkLayerReachabilityInformation = append(groups[i].NetworkLayerReachabilityInformation, prefix)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, msg)
 	}
 	if len(deleteroute) != 0 {
-		deletemsg := update.Update{
-			WithdrawnRoutes: deleteroute,
+		groups = append(groups, update.Update{WithdrawnRoutes: deleteroute})
+	}
+	msgs := make([]update.Update, 0, len(groups))
+	for _, group := range groups {
+		split, err := group.Split()
+		if err != nil {
+			log.Printf("failed to split update: %v", err)
+			continue
 		}
-		msgs = append(msgs, deletemsg)
+		msgs = append(msgs, split...)
 	}
 	return msgs
 }
 
-func AdjFromLocal(AS uint16) (RibAdj, error) {
+// アドレス、プレフィックス長の順に並べる
+func prefixLess(a, b netip.Prefix) bool {
+	if a.Addr() != b.Addr() {
+		return a.Addr().Less(b.Addr())
+	}
+	return a.Bits() < b.Bits()
+}
+
+// AS_PATHは空にしておき、eBGPピアに広告するときに自ASを付ける
+func AdjFromLocal() (RibAdj, error) {
 	ifis, err := net.Interfaces()
 	if err != nil {
 		return nil, err
@@ -127,13 +435,10 @@ func AdjFromLocal(AS uint16) (RibAdj, error) {
 		}
 
 		adjBest[prefix] = RibAdjEntry{
-			ORIGIN: update.OriginIGP,
-			AS_PATH: update.AS_PATH{
-				VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE,
-				AS_SEQUENCE:   []uint16{AS},
-			},
+			ORIGIN:     update.OriginIGP,
+			AS_PATH:    update.AS_PATH{},
 			NEXT_HOP:   update.NEXT_HOP(netipIP),
-			LOCAL_PREF: update.LOCAL_PREF(100),
+			LOCAL_PREF: DEFAULTLOCALPREF,
 		}
 	}
 	return adjBest, nil
@@ -147,95 +452,579 @@ func (R RibAdj) String() string {
 }
 
 type Peer struct {
+	// LocRib側で受け取ったRibDeltaを反映したこのピアの経路
 	RibAdjIn   RibAdj
-	RibAdjInCh <-chan RibAdj
-	LocRibCh   chan<- RibAdj
+	RibAdjInCh <-chan RibDelta
+	// 広告する経路の変更をためておく. LocRibはブロックせずに入れる
+	LocRibQueue *OutQueue
+	// Establishedのセッションの広告先. セッションがなければnil
+	target *ExportTarget
+	// このピアに広告した経路
+	AdjRibOut  RibAdj
+	ShutdownCh chan<- string
+	ClearCh    chan<- struct{}
+	Status     *PeerStatus
+	Damper     *Damper
+	Done       <-chan struct{}
+	// 受け取った経路と広告する経路に適用するルートマップの名前. 空なら全て許可する
+	ImportPolicy string
+	ExportPolicy string
 }
 
+// LocRibの状態はHandleを呼ぶgoroutineだけが読み書きする
+// 他のgoroutineはSnapshotで変更の合間に作った写しを読む
 type LocRib struct {
-	adjBest      RibAdj
+	adjBest RibAdj
+	// 自分で生成した経路. 接続しているサブネット, networks, 静的経路
 	adjConnected RibAdj
-	peers        []Peer
+	// 作り直した自分で生成する経路
+	localCh <-chan RibAdj
+	// 集約経路の設定と、生成している集約経路
+	aggregates   []AggregateConfig
+	adjAggregate RibAdj
+	// AGGREGATORに入れる自分のAS
+	AS       uint16
+	peers    []Peer
+	routerID netip.Addr
+	stopCh   <-chan os.Signal
+	// 最初の変更からこの時間の間に届いた変更をまとめて処理する
+	batchInterval time.Duration
+	// ダイナミックネイバーのセッションの追加と削除
+	addPeerCh <-chan Peer
+	delPeerCh <-chan Peer
+	// ROUTINGTABLEに入れてある経路
+	fib FIB
+	// 起動した直後は全てのピアからEnd-of-RIBが届くかこのタイマーが切れるまでFIBを更新しない
+	// Graceful Restartで再起動した場合とinitial_sync_timeoutを設定した場合に使う
+	syncTimer <-chan time.Time
+	// 最後に最良経路を選んでからAdj-RIB-Inの経路が変わったプレフィックス
+	dirty map[netip.Prefix]struct{}
+	// FIBに入れ直す必要があるプレフィックス
+	fibDirty map[netip.Prefix]struct{}
+	// 一度FIB全体をLoc-RIBに合わせたか. それまでは起動前からある経路も調べる
+	fibSynced bool
+	// Handleを終わらせたシグナル
+	stopSignal os.Signal
+	bestPath   BestPathConfig
+	// ピアのImportPolicyとExportPolicyで指定するルートマップ
+	routeMaps map[string]*RouteMap
+	// 各プレフィックスの最良経路が選ばれた理由
+	reasons map[netip.Prefix]BestPathReason
+	// FIBに入れる等コストの経路. 先頭はadjBestと同じ
+	// 変わったときは新しいスライスに置き換え、写しと共有しているスライスは書き換えない
+	multipaths map[netip.Prefix][]RibAdjEntry
+	// 他のgoroutineからの写しの要求
+	queryCh chan chan *LocRibSnapshot
+	// 最良経路かピアが変わるたびに増やす
+	version uint64
+	// 最後に作った写し. versionが変わるまで使い回す
+	snapshot *LocRibSnapshot
 }
 
-// compare two RibAdjEntry and return best one
-func betterEntry(a, b RibAdjEntry) RibAdjEntry {
-	if a.LOCAL_PREF > b.LOCAL_PREF {
-		return a
-	} else if a.LOCAL_PREF < b.LOCAL_PREF {
-		return b
-	}
-	if len(a.AS_PATH.AS_SEQUENCE) < len(b.AS_PATH.AS_SEQUENCE) {
-		return a
-	} else if len(a.AS_PATH.AS_SEQUENCE) > len(b.AS_PATH.AS_SEQUENCE) {
-		return b
+// LocRibの外から読む最良経路とピアの写し
+// 作った後は変更しないので、読む側が途中まで更新された状態を見ることはない
+type LocRibSnapshot struct {
+	Version    uint64
+	Best       RibAdj
+	Reasons    map[netip.Prefix]BestPathReason
+	Multipaths map[netip.Prefix][]RibAdjEntry
+	// RibAdjInとAdjRibOutは含めない
+	Peers []Peer
+}
+
+// NOTIFICATIONの送信を待つ最大時間
+const SHUTDOWNTIMEOUT time.Duration = 3 * time.Second
+
+// 接続しているネットワーク上のNEXT_HOPは0
+// IGPを動かしていないので、それ以外はBGPの経路などで届くものとして一律に1とする
+func (l *LocRib) igpCost(nextHop netip.Addr) uint32 {
+	for prefix, entry := range l.adjConnected {
+		if entry.Source.Kind == LOCALCONNECTED && prefix.Contains(nextHop) {
+			return 0
+		}
 	}
-	if a.ORIGIN < b.ORIGIN {
-		return a
-	} else if a.ORIGIN > b.ORIGIN {
-		return b
+	return 1
+}
+
+func (l *LocRib) markDirty(prefix netip.Prefix) {
+	if l.dirty == nil {
+		l.dirty = make(map[netip.Prefix]struct{})
 	}
-	// TODO: まだいろいろ
-	return a
+	l.dirty[prefix] = struct{}{}
 }
 
-func (l *LocRib) updateBestPath() {
-	l.adjBest = l.adjConnected
+// 接続しているネットワークと全てのピアの経路から最良経路を選び直す
+func (l *LocRib) updateBestPath() []netip.Prefix {
+	for prefix := range l.adjConnected {
+		l.markDirty(prefix)
+	}
+	for prefix := range l.adjBest {
+		l.markDirty(prefix)
+	}
 	for _, peer := range l.peers {
-		for prefix, entry := range peer.RibAdjIn {
-			_, ok := l.adjBest[prefix]
-			if !ok {
-				l.adjBest[prefix] = entry
-			} else {
-				l.adjBest[prefix] = betterEntry(l.adjBest[prefix], entry)
+		for prefix := range peer.RibAdjIn {
+			l.markDirty(prefix)
+		}
+	}
+	changed := l.updateDirty()
+	return append(changed, l.updateAggregates(changed)...)
+}
+
+// 経路が変わったプレフィックスだけ最良経路を選び直し、Loc-RIBの経路が変わったプレフィックスを返す
+func (l *LocRib) updateDirty() []netip.Prefix {
+	if l.adjBest == nil {
+		l.adjBest = make(RibAdj)
+		l.reasons = make(map[netip.Prefix]BestPathReason)
+		l.multipaths = make(map[netip.Prefix][]RibAdjEntry)
+	}
+	if l.fibDirty == nil {
+		l.fibDirty = make(map[netip.Prefix]struct{})
+	}
+	d := decision{config: l.bestPath}
+	changed := make([]netip.Prefix, 0, len(l.dirty))
+	for prefix := range l.dirty {
+		paths := l.candidates(prefix)
+		old, ok := l.adjBest[prefix]
+		if len(paths) == 0 {
+			delete(l.adjBest, prefix)
+			delete(l.reasons, prefix)
+			delete(l.multipaths, prefix)
+			if ok {
+				changed = append(changed, prefix)
+				l.fibDirty[prefix] = struct{}{}
 			}
+			continue
+		}
+		best, reason := d.best(paths)
+		multipaths := d.multipath(best, paths)
+		best = aggregatedBest(best, multipaths)
+		l.reasons[prefix] = reason
+		if !reflect.DeepEqual(l.multipaths[prefix], multipaths) {
+			l.multipaths[prefix] = multipaths
+			l.fibDirty[prefix] = struct{}{}
+		}
+		if ok && reflect.DeepEqual(old, best) {
+			continue
+		}
+		l.adjBest[prefix] = best
+		changed = append(changed, prefix)
+	}
+	if len(l.dirty) != 0 {
+		l.version++
+	}
+	l.dirty = nil
+	return changed
+}
+
+// 接続しているネットワークと各ピアから受け取ったprefixの経路
+func (l *LocRib) candidates(prefix netip.Prefix) []RibAdjEntry {
+	paths := make([]RibAdjEntry, 0, len(l.peers)+1)
+	if entry, ok := l.adjConnected[prefix]; ok {
+		paths = append(paths, entry)
+	}
+	if entry, ok := l.adjAggregate[prefix]; ok {
+		paths = append(paths, entry)
+	}
+	for _, peer := range l.peers {
+		if entry, ok := peer.RibAdjIn[prefix]; ok && !entry.Suppressed {
+			paths = append(paths, entry)
+		}
+	}
+	return paths
+}
+
+// 今の状態の写しを作る. 前に作ってから変わっていなければ同じものを返す
+func (l *LocRib) takeSnapshot() *LocRibSnapshot {
+	if l.snapshot != nil && l.snapshot.Version == l.version {
+		return l.snapshot
+	}
+	snapshot := &LocRibSnapshot{
+		Version:    l.version,
+		Best:       make(RibAdj, len(l.adjBest)),
+		Reasons:    make(map[netip.Prefix]BestPathReason, len(l.reasons)),
+		Multipaths: make(map[netip.Prefix][]RibAdjEntry, len(l.multipaths)),
+		Peers:      make([]Peer, 0, len(l.peers)),
+	}
+	for prefix, entry := range l.adjBest {
+		snapshot.Best[prefix] = entry
+	}
+	for prefix, reason := range l.reasons {
+		snapshot.Reasons[prefix] = reason
+	}
+	for prefix, paths := range l.multipaths {
+		snapshot.Multipaths[prefix] = paths
+	}
+	for _, peer := range l.peers {
+		peer.RibAdjIn = nil
+		peer.AdjRibOut = nil
+		snapshot.Peers = append(snapshot.Peers, peer)
+	}
+	l.snapshot = snapshot
+	return snapshot
+}
+
+// 他のgoroutineから今の状態を読む. Handleが要求を受け取るまで待つ
+func (l *LocRib) Snapshot() *LocRibSnapshot {
+	reply := make(chan *LocRibSnapshot, 1)
+	l.queryCh <- reply
+	return <-reply
+}
+
+// 最良経路と選ばれた理由を並べる
+func (s *LocRibSnapshot) explain() string {
+	str := ""
+	for prefix, entry := range s.Best {
+		str += fmt.Sprintf("%s: %v (%s)\n", prefix.String(), entry, s.Reasons[prefix])
+		for _, path := range s.Multipaths[prefix][1:] {
+			str += fmt.Sprintf("  multipath: %v\n", path)
+		}
+	}
+	return str
+}
+
+// 各ピアのRibAdjInCh, stopCh, addPeerCh, delPeerCh, syncTimer, queryChの順に並べる
+func (L *LocRib) selectCases() []reflect.SelectCase {
+	cases := make([]reflect.SelectCase, 0, len(L.peers)+6)
+	for _, peer := range L.peers {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(peer.RibAdjInCh)})
+	}
+	for _, ch := range []reflect.Value{reflect.ValueOf(L.stopCh), reflect.ValueOf(L.addPeerCh), reflect.ValueOf(L.delPeerCh), reflect.ValueOf(L.syncTimer), reflect.ValueOf(L.queryCh), reflect.ValueOf(L.localCh)} {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: ch})
+	}
+	return cases
+}
+
+// selectCasesで受け取った値を反映する
+// stopChにシグナルが来た場合はfalseを返す
+func (L *LocRib) receive(chosen int, value reflect.Value, ok bool) bool {
+	switch chosen - len(L.peers) {
+	case 0:
+		log.Printf("signal received: %v", value)
+		L.stopSignal = value.Interface().(os.Signal)
+		return false
+	case 1:
+		L.addPeer(value.Interface().(Peer))
+	case 2:
+		L.delPeer(value.Interface().(Peer))
+	case 3:
+		log.Printf("initial sync timer expired")
+		L.syncTimer = nil
+	case 4:
+		value.Interface().(chan *LocRibSnapshot) <- L.takeSnapshot()
+	case 5:
+		L.setLocalRoutes(value.Interface().(RibAdj))
+	default:
+		if !ok {
+			log.Printf("reflect.Select failed: %v", ok)
+			return true
 		}
+		L.apply(&L.peers[chosen], value.Interface().(RibDelta))
 	}
+	return true
 }
 
-func (L *LocRib) Handle() {
-	cases := make([]reflect.SelectCase, len(L.peers))
-	for i, peer := range L.peers {
-		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(peer.RibAdjInCh)}
+// ピアから届いた変更をRibAdjInに反映し、変わったプレフィックスを覚えておく
+func (L *LocRib) apply(peer *Peer, delta RibDelta) {
+	if delta.Request {
+		// 新しいセッションには何も広告していないので、Loc-RIBを全て広告し直す
+		peer.target = delta.Target
+		peer.AdjRibOut = make(RibAdj)
+		prefixes := make([]netip.Prefix, 0, len(L.adjBest))
+		for prefix := range L.adjBest {
+			prefixes = append(prefixes, prefix)
+		}
+		L.advertise(peer, prefixes)
+		peer.LocRibQueue.PushEndOfRIB()
+		return
+	}
+	if delta.Reset {
+		// セッションが切れたので広告もやめる
+		peer.target = nil
+		peer.AdjRibOut = nil
+		peer.Status.SetAdvertised(0)
 	}
-	chosen, value, ok := reflect.Select(cases)
+	if delta.Reset || peer.RibAdjIn == nil {
+		for prefix := range peer.RibAdjIn {
+			L.markDirty(prefix)
+		}
+		peer.RibAdjIn = make(RibAdj)
+	}
+	// import policyで拒否された経路は取り消されたものとして扱う
+	importPolicy := L.routeMaps[peer.ImportPolicy]
+	for prefix, entry := range delta.Changes {
+		L.markDirty(prefix)
+		if entry == nil {
+			delete(peer.RibAdjIn, prefix)
+			continue
+		}
+		imported := *entry
+		if !importPolicy.Apply(prefix, *entry, &imported) {
+			delete(peer.RibAdjIn, prefix)
+			continue
+		}
+		// 比べるたびに接続しているネットワークを探さないよう、ここで一度だけ決める
+		imported.IGPCost = L.igpCost(netip.Addr(imported.NEXT_HOP))
+		peer.RibAdjIn[prefix] = imported
+	}
+}
+
+// 新しいピアにはEstablishedになってから要求されたときにLoc-RIBを送る
+func (L *LocRib) addPeer(peer Peer) {
+	log.Printf("add peer %v", peer.Status)
+	L.peers = append(L.peers, peer)
+	L.version++
+}
+
+// 削除したピアから受け取った経路は次のupdateDirtyで消える
+func (L *LocRib) delPeer(peer Peer) {
+	for i, p := range L.peers {
+		if p.Status == peer.Status {
+			log.Printf("delete peer %v", peer.Status)
+			for prefix := range p.RibAdjIn {
+				L.markDirty(prefix)
+			}
+			L.peers = append(L.peers[:i:i], L.peers[i+1:]...)
+			L.version++
+			return
+		}
+	}
+}
+
+// stopChにシグナルが来た場合はfalseを返す
+func (L *LocRib) Handle() bool {
+	chosen, value, ok := reflect.Select(L.selectCases())
 	log.Printf("chosen: %v, value: %v, ok: %v", chosen, value, ok)
-	if !ok {
-		log.Printf("reflect.Select failed: %v", ok)
+	if !L.receive(chosen, value, ok) {
+		return false
+	}
+	if !L.collect() {
+		return false
+	}
+	if len(L.dirty) == 0 {
+		return true
+	}
+	changed := L.updateDirty()
+	changed = append(changed, L.updateAggregates(changed)...)
+	log.Printf("updated %d prefixes in adjBest", len(changed))
+	if len(changed) == 0 {
+		return true
+	}
+	// 変わった経路だけを各ピアに送る
+	for i := range L.peers {
+		L.advertise(&L.peers[i], changed)
+	}
+	return true
+}
+
+// prefixesの最良経路をピアに広告する形にして、Adj-RIB-Outと違うものだけをキューに入れる
+// 広告しなくなった経路は広告していた場合だけ取り消す
+func (L *LocRib) advertise(peer *Peer, prefixes []netip.Prefix) {
+	if peer.target == nil {
 		return
 	}
-	L.peers[chosen].RibAdjIn = value.Interface().(RibAdj)
-	L.updateBestPath()
-	log.Printf("updated adjBest: %v", L.adjBest)
+	exportPolicy := L.routeMaps[peer.ExportPolicy]
+	for _, prefix := range prefixes {
+		old, advertised := peer.AdjRibOut[prefix]
+		best, ok := L.adjBest[prefix]
+		var entry RibAdjEntry
+		// summary-onlyの集約に含まれる経路は広告しない
+		if ok && L.suppressedByAggregate(prefix) {
+			ok = false
+		}
+		if ok {
+			entry, ok = exportEntry(best, *peer.target)
+		}
+		// export policyは書き換える前の最良経路で条件を調べる
+		if ok {
+			ok = exportPolicy.Apply(prefix, best, &entry)
+		}
+		if !ok {
+			if advertised {
+				delete(peer.AdjRibOut, prefix)
+				peer.LocRibQueue.Push(prefix, nil)
+			}
+			continue
+		}
+		if advertised && reflect.DeepEqual(old, entry) {
+			continue
+		}
+		peer.AdjRibOut[prefix] = entry
+		peer.LocRibQueue.Push(prefix, &entry)
+	}
+	peer.Status.SetAdvertised(len(peer.AdjRibOut))
+}
+
+// 最良経路の計算やFIBの更新を変更ごとに行わないように
+// batchIntervalの間(0ならすでに届いている分だけ)の変更をまとめて受け取る
+// stopChにシグナルが来た場合はfalseを返す
+func (L *LocRib) collect() bool {
+	var wait reflect.SelectCase
+	if L.batchInterval > 0 {
+		timer := time.NewTimer(L.batchInterval)
+		defer timer.Stop()
+		wait = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)}
+	} else {
+		wait = reflect.SelectCase{Dir: reflect.SelectDefault}
+	}
+	for {
+		// ピアが増減すると添字が変わるので毎回作り直す
+		cases := append(L.selectCases(), wait)
+		chosen, value, ok := reflect.Select(cases)
+		if chosen == len(cases)-1 {
+			return true
+		}
+		if !L.receive(chosen, value, ok) {
+			return false
+		}
+	}
+}
+
+// 全てのピアにCease NOTIFICATIONを送らせ、書き込みが終わるまで待つ
+// Handleを終えた後に同じgoroutineから呼ぶ
+func (L *LocRib) Shutdown(communication string) {
 	for _, peer := range L.peers {
-		peer.LocRibCh <- L.adjBest
+		select {
+		case peer.ShutdownCh <- communication:
+		default:
+		}
+	}
+	timeout := time.After(SHUTDOWNTIMEOUT)
+	for _, peer := range L.peers {
+		select {
+		case <-peer.Done:
+		case <-timeout:
+			log.Printf("timed out waiting for sessions to shut down")
+			return
+		}
 	}
 }
 
+// 起動した直後で、まだ全てのピアからEnd-of-RIBを受け取っていないか
+func (L *LocRib) waitingSync() bool {
+	if L.syncTimer == nil {
+		return false
+	}
+	for _, peer := range L.peers {
+		if !peer.Status.Synced() {
+			return true
+		}
+	}
+	log.Printf("all peers have sent End-of-RIB")
+	L.syncTimer = nil
+	return false
+}
+
+// 変わった経路だけを入れ替える
+// テーブルを消してから入れ直すと、その間転送が止まってしまう
+// 最初の1回は起動前から残っている経路も含めて全てのプレフィックスを調べる
 func (L *LocRib) UpdateRoutingTable() {
-	err := exec.Command("ip", "route", "flush", "table", ROUTINGTABLE).Run()
-	if err != nil {
-		log.Printf("failed to flush routing table: %v", err)
+	if L.waitingSync() {
+		log.Printf("deferring routing table update until End-of-RIB")
+		return
+	}
+	if L.fib == nil {
+		L.fib = make(FIB)
+	}
+	prefixes := L.fibDirty
+	if !L.fibSynced {
+		prefixes = make(map[netip.Prefix]struct{}, len(L.multipaths)+len(L.fib))
+		for prefix := range L.multipaths {
+			prefixes[prefix] = struct{}{}
+		}
+		for prefix := range L.fib {
+			prefixes[prefix] = struct{}{}
+		}
+		L.fibSynced = true
+	}
+	L.fibDirty = nil
+	for prefix := range prefixes {
+		L.installRoute(prefix)
+	}
+}
+
+// マルチパスの経路をFIBに入れるネクストホップ
+// 接続しているサブネットやnetworksなどmainテーブルにある経路はthrowにしてmainテーブルを引かせる
+// 集約経路はblackholeにして、より長い経路のない宛先を捨てる
+func fibNextHops(paths []RibAdjEntry) []FIBNextHop {
+	if best := paths[0]; best.Local() {
+		switch best.Source.Kind {
+		case LOCALSTATIC:
+			return []FIBNextHop{{Addr: netip.Addr(best.NEXT_HOP)}}
+		case LOCALAGGREGATE:
+			return []FIBNextHop{{Type: ROUTEBLACKHOLE}}
+		default:
+			return []FIBNextHop{{Type: ROUTETHROW}}
+		}
+	}
+	nextHops := make([]FIBNextHop, 0, len(paths))
+	if len(paths) == 1 {
+		return append(nextHops, FIBNextHop{Addr: netip.Addr(paths[0].NEXT_HOP)})
 	}
-	for prefix, entry := range L.adjBest {
-		nextHop := netip.Addr(entry.NEXT_HOP).String()
-		cmdStr := fmt.Sprintf("ip route add %s via %s table %s", prefix.String(), nextHop, ROUTINGTABLE)
-		log.Printf("cmdStr: %s", cmdStr)
-		err := exec.Command("ip", "route", "add", prefix.String(), "via", nextHop, "table", ROUTINGTABLE).Run()
+	for i, weight := range nextHopWeights(paths) {
+		nextHops = append(nextHops, FIBNextHop{Addr: netip.Addr(paths[i].NEXT_HOP), Weight: weight})
+	}
+	sortNextHops(nextHops)
+	return nextHops
+}
+
+// prefixのマルチパスの経路をFIBに入れる. 経路がなければ消す
+func (L *LocRib) installRoute(prefix netip.Prefix) {
+	paths, ok := L.multipaths[prefix]
+	if !ok {
+		if _, ok := L.fib[prefix]; !ok {
+			return
+		}
+		err := exec.Command("ip", "route", "del", prefix.String(), "table", ROUTINGTABLE).Run()
 		if err != nil {
-			log.Printf("failed to add routing table: %v", err)
+			log.Printf("failed to delete route %v: %v", prefix, err)
 		}
+		delete(L.fib, prefix)
+		return
 	}
+	nextHops := fibNextHops(paths)
+	if installed, ok := L.fib[prefix]; ok && sameNextHops(installed, nextHops) {
+		return
+	}
+	args := route_replace_args(prefix, nextHops)
+	log.Printf("cmdStr: ip %s", strings.Join(args, " "))
+	err := exec.Command("ip", args...).Run()
+	if err != nil {
+		log.Printf("failed to add routing table: %v", err)
+		return
+	}
+	L.fib[prefix] = nextHops
 }
 
+// SIGHUPで状態を表示し、SIGUSR1でmax-prefixで止まっているピアを再開させる
+// LocRibとは別のgoroutineで動くので、状態はSnapshotで読む
 func (L *LocRib) Sig() {
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGHUP)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGUSR1)
 	for {
-		<-sig
-		log.Println("SIGHUP received")
-		log.Println("Print adjBest")
-		log.Print(L.adjBest)
+		switch <-sig {
+		case syscall.SIGHUP:
+			log.Println("SIGHUP received")
+			snapshot := L.Snapshot()
+			log.Printf("router-id: %v", L.routerID)
+			for _, peer := range snapshot.Peers {
+				log.Printf("peer %v", peer.Status)
+				for _, damped := range peer.Damper.Damped() {
+					log.Printf("  damped %v", damped)
+				}
+			}
+			if failures := auth_failures(nil, tcp_auth_counters()); failures != "" {
+				log.Printf("tcp authentication counters: %s", failures)
+			}
+			log.Printf("Print adjBest (version %d)", snapshot.Version)
+			log.Print(snapshot.explain())
+		case syscall.SIGUSR1:
+			log.Println("SIGUSR1 received")
+			for _, peer := range L.Snapshot().Peers {
+				select {
+				case peer.ClearCh <- struct{}{}:
+				default:
+				}
+			}
+		}
 	}
-
 }
@@ -1,29 +1,41 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"log"
 	"net/netip"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/81ueman/local-clos/message"
 	"github.com/81ueman/local-clos/message/update"
 )
 
 func TestUpdate(t *testing.T) {
 	RibAdj := RibAdj{}
+	localPref := update.LOCAL_PREF(200)
 	msg := update.Update{
 		WithdrawnRoutes: []netip.Prefix{},
 		PathAttrOrigin:  update.Origin(1),
-		PathAttrASPath: update.AS_PATH{
+		PathAttrASPath: update.AS_PATH{{
 			VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE,
 			AS_SEQUENCE:   []uint16{1, 2, 3},
-		},
+		}},
 		PathAttrNextHop:   update.NEXT_HOP(netip.MustParseAddr("192.168.0.1")),
-		PathAttrLocalPref: update.LOCAL_PREF(100),
+		PathAttrLocalPref: &localPref,
 		NetworkLayerReachabilityInformation: []netip.Prefix{
 			netip.MustParsePrefix("192.168.0.0/24"),
 		},
 	}
-	RibAdj.Update(msg)
+	src := PathSource{
+		PeerAS:   65000,
+		PeerAddr: netip.MustParseAddr("192.168.0.1"),
+		IBGP:     true,
+	}
+	RibAdj.Update(msg, LocalInfo{AS: 65000}, src, nil)
 	if len(RibAdj) != 1 {
 		t.Fatal("invalid len")
 	}
@@ -41,9 +53,541 @@ func TestUpdate(t *testing.T) {
 		if entry.NEXT_HOP != msg.PathAttrNextHop {
 			t.Fatal("invalid next hop")
 		}
-		if entry.LOCAL_PREF != msg.PathAttrLocalPref {
+		if entry.LOCAL_PREF != *msg.PathAttrLocalPref {
 			t.Fatal("invalid local pref")
 		}
 
 	}
 }
+
+func TestExport(t *testing.T) {
+	self := netip.MustParseAddr("10.0.0.1")
+	ebgpPeer := PathSource{PeerAS: 65001, PeerAddr: netip.MustParseAddr("10.0.0.2")}
+	ibgpPeer := PathSource{PeerAS: 65000, PeerAddr: netip.MustParseAddr("10.0.1.2"), IBGP: true}
+	rib := RibAdj{
+		netip.MustParsePrefix("192.168.0.0/24"): {
+			AS_PATH:  update.AS_PATH{},
+			NEXT_HOP: update.NEXT_HOP(netip.MustParseAddr("192.168.0.1")),
+		},
+		netip.MustParsePrefix("192.168.1.0/24"): {
+			AS_PATH:  update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65001}}},
+			NEXT_HOP: update.NEXT_HOP(ebgpPeer.PeerAddr),
+			Source:   ebgpPeer,
+		},
+		netip.MustParsePrefix("192.168.2.0/24"): {
+			AS_PATH:  update.AS_PATH{},
+			NEXT_HOP: update.NEXT_HOP(ibgpPeer.PeerAddr),
+			Source:   ibgpPeer,
+		},
+	}
+
+	ebgp := rib.Export(ExportTarget{LocalInfo: LocalInfo{AS: 65000}, NextHop: self})
+	if len(ebgp) != 3 {
+		t.Fatalf("invalid number of routes to ebgp peer: %v", ebgp)
+	}
+	for prefix, entry := range ebgp {
+		if entry.AS_PATH[0].AS_SEQUENCE[0] != 65000 {
+			t.Errorf("%v: local AS is not prepended: %v", prefix, entry.AS_PATH)
+		}
+		if netip.Addr(entry.NEXT_HOP) != self {
+			t.Errorf("%v: next hop is not self: %v", prefix, netip.Addr(entry.NEXT_HOP))
+		}
+	}
+
+	ibgp := rib.Export(ExportTarget{LocalInfo: LocalInfo{AS: 65000}, NextHop: self, IBGP: true})
+	if _, ok := ibgp[netip.MustParsePrefix("192.168.2.0/24")]; ok {
+		t.Error("ibgp route is advertised to ibgp peer")
+	}
+	learned := ibgp[netip.MustParsePrefix("192.168.1.0/24")]
+	if !reflect.DeepEqual(learned.AS_PATH[0].AS_SEQUENCE, []uint16{65001}) {
+		t.Errorf("local AS is prepended toward ibgp peer: %v", learned.AS_PATH)
+	}
+	if netip.Addr(learned.NEXT_HOP) != ebgpPeer.PeerAddr {
+		t.Errorf("next hop is changed toward ibgp peer: %v", netip.Addr(learned.NEXT_HOP))
+	}
+	local := ibgp[netip.MustParsePrefix("192.168.0.0/24")]
+	if netip.Addr(local.NEXT_HOP) != self {
+		t.Errorf("next hop of local route is not self: %v", netip.Addr(local.NEXT_HOP))
+	}
+
+	nhself := rib.Export(ExportTarget{LocalInfo: LocalInfo{AS: 65000}, NextHop: self, IBGP: true, NextHopSelf: true})
+	if netip.Addr(nhself[netip.MustParsePrefix("192.168.1.0/24")].NEXT_HOP) != self {
+		t.Error("next-hop-self is not applied")
+	}
+}
+
+func TestExportWellKnownCommunities(t *testing.T) {
+	ibgp := ExportTarget{LocalInfo: LocalInfo{AS: 65000}, IBGP: true}
+	confed := ExportTarget{LocalInfo: LocalInfo{AS: 65010, ConfedID: 65000}, ConfedEBGP: true}
+	ebgp := ExportTarget{LocalInfo: LocalInfo{AS: 65000}}
+	tests := []struct {
+		community update.Community
+		want      []bool
+	}{
+		{update.CommunityNoAdvertise, []bool{false, false, false}},
+		{update.CommunityNoExport, []bool{true, true, false}},
+		{update.CommunityNoExportSubconfed, []bool{true, false, false}},
+		{0xFDE90064, []bool{true, true, true}},
+	}
+	for _, tt := range tests {
+		entry := path("10.0.0.1", 65001)
+		entry.COMMUNITIES = update.COMMUNITIES{tt.community}
+		for i, target := range []ExportTarget{ibgp, confed, ebgp} {
+			if _, ok := exportEntry(entry, target); ok != tt.want[i] {
+				t.Errorf("%v to target %d: exported = %v, want %v", tt.community, i, ok, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestExportRouteReflector(t *testing.T) {
+	local := LocalInfo{AS: 65000, RouterID: netip.MustParseAddr("1.1.1.1"), ClusterID: netip.MustParseAddr("1.1.1.1")}
+	client := PathSource{PeerAS: 65000, PeerRouterID: netip.MustParseAddr("2.2.2.2"), PeerAddr: netip.MustParseAddr("10.0.0.2"), IBGP: true, RRClient: true}
+	nonClient := PathSource{PeerAS: 65000, PeerRouterID: netip.MustParseAddr("3.3.3.3"), PeerAddr: netip.MustParseAddr("10.0.1.2"), IBGP: true}
+	fromClient := netip.MustParsePrefix("192.168.0.0/24")
+	fromNonClient := netip.MustParsePrefix("192.168.1.0/24")
+	rib := RibAdj{
+		fromClient:    {NEXT_HOP: update.NEXT_HOP(client.PeerAddr), Source: client},
+		fromNonClient: {NEXT_HOP: update.NEXT_HOP(nonClient.PeerAddr), Source: nonClient},
+	}
+
+	toNonClient := rib.Export(ExportTarget{LocalInfo: local, IBGP: true})
+	if _, ok := toNonClient[fromNonClient]; ok {
+		t.Error("route from non-client is reflected to non-client")
+	}
+	reflected, ok := toNonClient[fromClient]
+	if !ok {
+		t.Fatal("route from client is not reflected to non-client")
+	}
+	if netip.Addr(reflected.ORIGINATOR_ID) != client.PeerRouterID {
+		t.Errorf("invalid originator id: %v", netip.Addr(reflected.ORIGINATOR_ID))
+	}
+	if !reflect.DeepEqual(reflected.CLUSTER_LIST, update.CLUSTER_LIST{local.ClusterID}) {
+		t.Errorf("invalid cluster list: %v", reflected.CLUSTER_LIST)
+	}
+
+	toClient := rib.Export(ExportTarget{LocalInfo: local, IBGP: true, RRClient: true})
+	if len(toClient) != 2 {
+		t.Errorf("all routes should be reflected to client: %v", toClient)
+	}
+
+	toEBGP := rib.Export(ExportTarget{LocalInfo: local})
+	for prefix, entry := range toEBGP {
+		if netip.Addr(entry.ORIGINATOR_ID).IsValid() || entry.CLUSTER_LIST != nil {
+			t.Errorf("%v: route reflector attributes are sent to ebgp peer", prefix)
+		}
+	}
+}
+
+func TestUpdateReflectionLoop(t *testing.T) {
+	local := LocalInfo{AS: 65000, RouterID: netip.MustParseAddr("1.1.1.1"), ClusterID: netip.MustParseAddr("9.9.9.9")}
+	src := PathSource{PeerAS: 65000, PeerAddr: netip.MustParseAddr("10.0.0.2"), IBGP: true}
+	prefix := netip.MustParsePrefix("192.168.0.0/24")
+	originatorID := update.ORIGINATOR_ID(local.RouterID)
+	tests := []struct {
+		name string
+		msg  update.Update
+	}{
+		{
+			name: "originator_id",
+			msg: update.Update{
+				PathAttrOriginatorID:                &originatorID,
+				NetworkLayerReachabilityInformation: []netip.Prefix{prefix},
+			},
+		},
+		{
+			name: "cluster_list",
+			msg: update.Update{
+				PathAttrClusterList:                 update.CLUSTER_LIST{netip.MustParseAddr("8.8.8.8"), local.ClusterID},
+				NetworkLayerReachabilityInformation: []netip.Prefix{prefix},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rib := RibAdj{prefix: {Source: src}}
+			rib.Update(tt.msg, local, src, nil)
+			if _, ok := rib[prefix]; ok {
+				t.Error("looped route is accepted")
+			}
+		})
+	}
+}
+
+func TestExportConfederation(t *testing.T) {
+	local := LocalInfo{AS: 65001, ConfedID: 65000, ConfedPeers: []uint16{65002}}
+	prefix := netip.MustParsePrefix("192.168.0.0/24")
+	rib := RibAdj{
+		prefix: {
+			AS_PATH: update.AS_PATH{
+				{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_CONFED_SEQUENCE, AS_SEQUENCE: []uint16{65002}},
+				{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65100}},
+			},
+			Source: PathSource{PeerAS: 65002, PeerAddr: netip.MustParseAddr("10.0.0.2"), ConfedEBGP: true},
+		},
+	}
+
+	member := rib.Export(ExportTarget{LocalInfo: local, ConfedEBGP: true})
+	want := update.AS_PATH{
+		{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_CONFED_SEQUENCE, AS_SEQUENCE: []uint16{65001, 65002}},
+		{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65100}},
+	}
+	if !reflect.DeepEqual(member[prefix].AS_PATH, want) {
+		t.Errorf("as path to confederation peer = %v, want %v", member[prefix].AS_PATH, want)
+	}
+
+	external := rib.Export(ExportTarget{LocalInfo: local})
+	want = update.AS_PATH{
+		{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65000, 65100}},
+	}
+	if !reflect.DeepEqual(external[prefix].AS_PATH, want) {
+		t.Errorf("as path to external peer = %v, want %v", external[prefix].AS_PATH, want)
+	}
+}
+
+func TestASLoopConfederation(t *testing.T) {
+	local := LocalInfo{AS: 65001, ConfedID: 65000, ConfedPeers: []uint16{65002}}
+	tests := []struct {
+		name string
+		path update.AS_PATH
+		want bool
+	}{
+		{
+			name: "member_as_in_confed_segment",
+			path: update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_CONFED_SEQUENCE, AS_SEQUENCE: []uint16{65002, 65001}}},
+			want: true,
+		},
+		{
+			name: "confed_id_from_outside",
+			path: update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_SEQUENCE, AS_SEQUENCE: []uint16{65100, 65000}}},
+			want: true,
+		},
+		{
+			name: "other_member_as",
+			path: update.AS_PATH{{VALUE_SEGMENT: update.VALUE_SEGMENT_AS_CONFED_SEQUENCE, AS_SEQUENCE: []uint16{65002}}},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ASLoop(tt.path, local); got != tt.want {
+				t.Errorf("ASLoop() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocRibRequest(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+	ribAdjInCh := make(chan RibDelta, 1)
+	peer := Peer{
+		RibAdjInCh:  ribAdjInCh,
+		LocRibQueue: NewOutQueue(0),
+		Status:      &PeerStatus{},
+	}
+	L := LocRib{adjBest: RibAdj{prefix: {}}, peers: []Peer{peer}}
+	// Adj-RIB-Inを変えずに今のLoc-RIBを全て要求する
+	ribAdjInCh <- RibDelta{Request: true, Target: &ExportTarget{}}
+	if !L.Handle() {
+		t.Fatal("Handle() = false")
+	}
+	rib, _ := peer.LocRibQueue.Pop()
+	if _, ok := rib[prefix]; !ok {
+		t.Errorf("invalid Loc-RIB: %v", rib)
+	}
+	if !peer.LocRibQueue.PopEndOfRIB() {
+		t.Errorf("End-of-RIB should follow the Loc-RIB")
+	}
+	if _, ok := L.peers[0].AdjRibOut[prefix]; !ok {
+		t.Errorf("advertised route is not recorded in the Adj-RIB-Out")
+	}
+	if len(L.dirty) != 0 || L.peers[0].RibAdjIn != nil {
+		t.Errorf("Loc-RIB request should not change the Adj-RIB-In")
+	}
+}
+
+func TestLocRibDelta(t *testing.T) {
+	kept := netip.MustParsePrefix("10.1.0.0/24")
+	changed := netip.MustParsePrefix("10.2.0.0/24")
+	withdrawn := netip.MustParsePrefix("10.3.0.0/24")
+	ch1 := make(chan RibDelta, 1)
+	ch2 := make(chan RibDelta, 1)
+	L := LocRib{peers: []Peer{
+		{RibAdjInCh: ch1, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}, target: &ExportTarget{}, AdjRibOut: RibAdj{}},
+		{RibAdjInCh: ch2, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}, target: &ExportTarget{}, AdjRibOut: RibAdj{}},
+	}}
+	spine1 := path("10.0.0.1", 65001)
+	spine2 := path("10.0.1.1", 65002, 65003)
+	ch1 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{kept: &spine1, changed: &spine2, withdrawn: &spine1}}
+	L.Handle()
+	for _, peer := range L.peers {
+		if announce, _ := peer.LocRibQueue.Pop(); len(announce) != 3 {
+			t.Fatalf("initial routes are not sent: %v", announce)
+		}
+	}
+	L.fibDirty = nil
+
+	// 短いAS_PATHの経路が届いたプレフィックスと取り消されたプレフィックスだけが変わる
+	better := path("10.0.1.1", 65002)
+	ch2 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{kept: &spine2, changed: &better}}
+	L.Handle()
+	ch1 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{withdrawn: nil}}
+	L.Handle()
+	announce, withdraw := L.peers[0].LocRibQueue.Pop()
+	if len(announce) != 1 || announce[changed].Source.PeerAddr != better.Source.PeerAddr {
+		t.Errorf("only the changed best path should be sent: %v", announce)
+	}
+	if len(withdraw) != 1 || withdraw[0] != withdrawn {
+		t.Errorf("withdrawn prefix should be sent: %v", withdraw)
+	}
+	if _, ok := L.fibDirty[kept]; ok {
+		t.Errorf("unchanged prefix should not be reinstalled")
+	}
+
+	// セッションが切れたピアの経路は全て取り消す
+	ch1 <- RibDelta{Reset: true}
+	L.Handle()
+	if L.adjBest[kept].Source.PeerAddr != spine2.Source.PeerAddr {
+		t.Errorf("best path should move to the other peer: %v", L.adjBest[kept])
+	}
+	if len(L.peers[0].RibAdjIn) != 0 {
+		t.Errorf("Adj-RIB-In should be empty after reset: %v", L.peers[0].RibAdjIn)
+	}
+}
+
+func TestSplitHorizon(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.1.0.0/24")
+	peer1 := netip.MustParseAddr("10.0.0.1")
+	peer2 := netip.MustParseAddr("10.0.1.1")
+	ch1 := make(chan RibDelta, 1)
+	ch2 := make(chan RibDelta, 1)
+	L := LocRib{peers: []Peer{
+		{RibAdjInCh: ch1, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}},
+		{RibAdjInCh: ch2, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}},
+	}}
+	ch1 <- RibDelta{Request: true, Target: &ExportTarget{PeerAddr: peer1}}
+	L.Handle()
+	ch2 <- RibDelta{Request: true, Target: &ExportTarget{PeerAddr: peer2}}
+	L.Handle()
+
+	// peer1から学習した経路はpeer1には送らない
+	long := path(peer1.String(), 65001, 65003)
+	ch1 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{prefix: &long}}
+	L.Handle()
+	if announce, _ := L.peers[0].LocRibQueue.Pop(); len(announce) != 0 {
+		t.Errorf("route is sent back to the peer it was learned from: %v", announce)
+	}
+	if announce, _ := L.peers[1].LocRibQueue.Pop(); len(announce) != 1 {
+		t.Errorf("route is not sent to the other peer: %v", announce)
+	}
+
+	// 最良経路がpeer2の経路に変わると、peer1には広告し、peer2には広告していた経路を取り消す
+	short := path(peer2.String(), 65002)
+	ch2 <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{prefix: &short}}
+	L.Handle()
+	if announce, withdraw := L.peers[0].LocRibQueue.Pop(); len(announce) != 1 || len(withdraw) != 0 {
+		t.Errorf("peer1: %v %v", announce, withdraw)
+	}
+	if announce, withdraw := L.peers[1].LocRibQueue.Pop(); len(announce) != 0 || len(withdraw) != 1 {
+		t.Errorf("peer2: %v %v", announce, withdraw)
+	}
+	if _, ok := L.peers[1].AdjRibOut[prefix]; ok || L.peers[1].Status.Advertised != 0 {
+		t.Errorf("withdrawn route remains in the Adj-RIB-Out of peer2")
+	}
+
+	// 一度も広告していないピアには取り消しを送らない
+	ch2 <- RibDelta{Reset: true}
+	L.Handle()
+	ch1 <- RibDelta{Reset: true}
+	L.Handle()
+	if _, withdraw := L.peers[1].LocRibQueue.Pop(); len(withdraw) != 0 {
+		t.Errorf("withdraw is sent to a peer without a session: %v", withdraw)
+	}
+}
+
+func TestLocRibSnapshot(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	// 1つのRibDeltaで追加と取り消しを繰り返すプレフィックス
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/24"), netip.MustParsePrefix("10.2.0.0/24"), netip.MustParsePrefix("10.3.0.0/24")}
+	ch := make(chan RibDelta, 1)
+	stopCh := make(chan os.Signal, 1)
+	L := LocRib{
+		peers:   []Peer{{RibAdjInCh: ch, LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}}},
+		stopCh:  stopCh,
+		queryCh: make(chan chan *LocRibSnapshot),
+	}
+	// 変更を送り終えたらfedを閉じる
+	fed := make(chan struct{})
+	go func() {
+		defer close(fed)
+		entry := path("10.0.0.1", 65001)
+		for i := 0; i < 200; i++ {
+			changes := make(map[netip.Prefix]*RibAdjEntry)
+			for _, prefix := range prefixes {
+				if i%2 == 0 {
+					changes[prefix] = &entry
+				} else {
+					changes[prefix] = nil
+				}
+			}
+			ch <- RibDelta{Changes: changes}
+		}
+	}()
+	errs := make(chan string, 1)
+	go func() {
+		defer func() { stopCh <- os.Interrupt }()
+		var prev *LocRibSnapshot
+		var prevLen int
+		for {
+			select {
+			case <-fed:
+				return
+			default:
+			}
+			snapshot := L.Snapshot()
+			// 途中まで更新された状態は見えない
+			if n := len(snapshot.Best); n != 0 && n != len(prefixes) {
+				errs <- fmt.Sprintf("half-updated snapshot: %v", snapshot.Best)
+				return
+			}
+			for prefix := range snapshot.Best {
+				if len(snapshot.Multipaths[prefix]) == 0 || snapshot.Reasons[prefix] == "" {
+					errs <- fmt.Sprintf("inconsistent snapshot for %v", prefix)
+					return
+				}
+			}
+			// 前に受け取った写しは後の変更で書き換わらない
+			if prev != nil && (len(prev.Best) != prevLen || snapshot.Version < prev.Version) {
+				errs <- "snapshot is modified after it was taken"
+				return
+			}
+			snapshot.explain()
+			prev, prevLen = snapshot, len(snapshot.Best)
+		}
+	}()
+	for L.Handle() {
+	}
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestWaitingSync(t *testing.T) {
+	synced := &PeerStatus{}
+	synced.SetSynced(true)
+	notSynced := &PeerStatus{}
+	L := LocRib{peers: []Peer{{Status: synced}, {Status: notSynced}}}
+	if L.waitingSync() {
+		t.Error("should not wait without the sync timer")
+	}
+	L.syncTimer = make(chan time.Time)
+	if !L.waitingSync() {
+		t.Error("should wait until every peer sends End-of-RIB")
+	}
+	notSynced.SetSynced(true)
+	if L.waitingSync() || L.syncTimer != nil {
+		t.Error("should stop waiting after every peer sends End-of-RIB")
+	}
+}
+
+const (
+	BENCHPREFIXES = 100000
+	BENCHPEERS    = 8
+)
+
+func benchPrefix(i int) netip.Prefix {
+	return netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(10 + i>>16), byte(i >> 8), byte(i), 0}), 24)
+}
+
+// 8つのピアからそれぞれ100kのプレフィックスを受け取り、全てのピアに広告しているLocRib
+func benchLocRib(b *testing.B) (*LocRib, []chan RibDelta) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	L := &LocRib{adjConnected: RibAdj{}}
+	chs := make([]chan RibDelta, BENCHPEERS)
+	for i := range chs {
+		chs[i] = make(chan RibDelta, 1)
+		peer := Peer{RibAdjInCh: chs[i], LocRibQueue: NewOutQueue(0), Status: &PeerStatus{}}
+		changes := make(map[netip.Prefix]*RibAdjEntry, BENCHPREFIXES)
+		entry := path(fmt.Sprintf("10.255.0.%d", i+1), uint16(65001+i), 65100)
+		for j := 0; j < BENCHPREFIXES; j++ {
+			changes[benchPrefix(j)] = &entry
+		}
+		L.peers = append(L.peers, peer)
+		L.apply(&L.peers[i], RibDelta{Changes: changes})
+	}
+	L.updateBestPath()
+	// 全てのピアがEstablishedでAdj-RIB-Outを持っている
+	for i := range L.peers {
+		L.apply(&L.peers[i], RibDelta{Request: true, Target: &ExportTarget{PeerAddr: netip.MustParseAddr(fmt.Sprintf("10.255.0.%d", i+1))}})
+		L.peers[i].LocRibQueue.Pop()
+	}
+	return L, chs
+}
+
+// 1つのプレフィックスが変わるたびに最良経路を選び直して下流に送る
+func BenchmarkLocRibDelta(b *testing.B) {
+	L, chs := benchLocRib(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry := path("10.255.0.1", 65001, 65100)
+		entry.MULTI_EXIT_DISC = update.MULTI_EXIT_DISC(i)
+		chs[0] <- RibDelta{Changes: map[netip.Prefix]*RibAdjEntry{benchPrefix(i % BENCHPREFIXES): &entry}}
+		L.Handle()
+	}
+}
+
+// 比較のため全てのプレフィックスの最良経路を選び直す
+func BenchmarkLocRibFullRecompute(b *testing.B) {
+	L, _ := benchLocRib(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		L.updateBestPath()
+	}
+}
+
+// 大量の経路の変更もRFC 4271の最大長に収まるUPDATEに分ける
+func TestUpdateMsgsLength(t *testing.T) {
+	withdraw := make([]netip.Prefix, 0, 10000)
+	announce := make(RibAdj)
+	for i := 0; i < 10000; i++ {
+		withdraw = append(withdraw, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24))
+		entry := path("10.0.0.1", 65001)
+		// 属性の違う経路は別のUPDATEにする
+		if i%2 == 0 {
+			entry = path("10.0.0.1", 65001, 65002)
+		}
+		announce[netip.PrefixFrom(netip.AddrFrom4([4]byte{172, 16 + byte(i>>14), byte(i >> 6), byte(i << 2)}), 30)] = entry
+	}
+	msgs := updateMsgs(announce, withdraw, false)
+	withdrawn := make(map[netip.Prefix]bool)
+	announced := make(map[netip.Prefix]bool)
+	for _, msg := range msgs {
+		b, err := message.Marshal(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > update.MAXMESSAGELENGTH {
+			t.Fatalf("message length %v exceeds %v", len(b), update.MAXMESSAGELENGTH)
+		}
+		for _, prefix := range msg.WithdrawnRoutes {
+			withdrawn[prefix] = true
+		}
+		for _, prefix := range msg.NetworkLayerReachabilityInformation {
+			if want := announce[prefix].AS_PATH; !reflect.DeepEqual(msg.PathAttrASPath, want) {
+				t.Errorf("%v is sent with %v, want %v", prefix, msg.PathAttrASPath, want)
+			}
+			announced[prefix] = true
+		}
+	}
+	if len(withdrawn) != len(withdraw) || len(announced) != len(announce) {
+		t.Errorf("withdrawn %d/%d, announced %d/%d", len(withdrawn), len(withdraw), len(announced), len(announce))
+	}
+	// まとめて送るので経路ごとのUPDATEにはならない
+	if len(msgs) > 40 {
+		t.Errorf("too many messages: %d", len(msgs))
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/netip"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/81ueman/local-clos/message"
+	"github.com/81ueman/local-clos/message/open"
+	"github.com/81ueman/local-clos/message/update"
 )
 
 type State string
@@ -21,6 +27,7 @@ const (
 )
 
 type Session struct {
+	LocalInfo
 	State               State
 	ConnectRetryCounter int
 	ConnectRetryTimer   time.Timer
@@ -29,6 +36,7 @@ type Session struct {
 	HoldTime            time.Duration
 	KeepaliveTimer      time.Timer
 	KeepaliveTime       time.Duration
+	SendHoldTime        time.Duration
 	ActiveMode          bool
 	Ifi                 net.Interface
 	NetipAddr           netip.Addr
@@ -36,13 +44,295 @@ type Session struct {
 	MsgCh               chan message.Message
 	Addr                net.Addr
 	Events              chan Event
-	AS                  uint16
-	AdjRIBsIn           RibAdj
-	AdjRIBsOut          RibAdj
-	AdjRibCh            chan<- RibAdj
-	LocRibCh            <-chan RibAdj
-	Ctx                 context.Context
-	Cancel              context.CancelFunc
+	PeerRouterID        netip.Addr
+	PeerAS              uint16
+	PeerAddr            netip.Addr
+	Config              PeerConfig
+	Status              *PeerStatus
+	// OPENで受け取ったピアのGraceful Restart Capability
+	PeerGR     *open.GracefulRestart
+	StaleTimer <-chan time.Time
+	// eBGPピアに広告する経路に付けるLink Bandwidth
+	LinkBandwidth float32
+	Damper        *Damper
+	DampingTick   <-chan time.Time
+	AdjRIBsIn     RibAdj
+	OutQueue      *OutQueue
+	AdjRibCh      chan<- RibDelta
+	// LocRibから届いたLoc-RIBの変更
+	LocRibQueue *OutQueue
+	ShutdownCh  <-chan string
+	Ctx         context.Context
+	Cancel      context.CancelFunc
+	// セッションが終わった理由
+	Err             error
+	maxPrefixWarned bool
+	// writerとそれ以外からの書き込みが混ざらないようにする
+	writeMu  sync.Mutex
+	neighbor *Neighbor
+}
+
+// ピアと交換するアドレスファミリ. 今はIPv4ユニキャストだけ
+var FAMILIES = []struct {
+	AFI  uint16
+	SAFI uint8
+}{
+	{update.AFIIPv4, update.SAFIUnicast},
+}
+
+var (
+	errShutdown      = errors.New("session is shut down")
+	errMaxPrefix     = errors.New("max-prefix exceeded")
+	errSendHoldTimer = errors.New("send hold timer expired")
+	errNotification  = errors.New("notification received")
+)
+
+// メッセージを1つ書き込む
+// SendHoldTimeの間書き込めなければ相手が受信していないとみなす (RFC 9687)
+func (s *Session) send(m message.Message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.SendHoldTime > 0 {
+		s.Conn.SetWriteDeadline(time.Now().Add(s.SendHoldTime))
+	}
+	err := message.Send_message(s.Conn, m)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return errSendHoldTimer
+	}
+	return err
+}
+
+// Adj-RIB-Inに入っている経路数
+func (s *Session) PrefixCount() int {
+	return len(s.AdjRIBsIn)
+}
+
+// OPENで受け取ったピアのASが自ASと同じならiBGP
+func (s *Session) IBGP() bool {
+	return s.PeerAS == s.AS
+}
+
+// 同じコンフェデレーションの別のメンバーASのピアかどうか
+func (s *Session) ConfedEBGP() bool {
+	return !s.IBGP() && s.ConfedMember(s.PeerAS)
+}
+
+// 設定がなければeBGPはすぐに送り、iBGPは5秒待つ
+// RFC 4271の30秒はClosの収束を遅らせるのでeBGPでは使わない
+func (s *Session) mrai() time.Duration {
+	if s.Config.MRAI != nil {
+		return time.Duration(*s.Config.MRAI)
+	}
+	if s.IBGP() || s.ConfedEBGP() {
+		return time.Duration(DEFAULTIBGPMRAI)
+	}
+	return time.Duration(DEFAULTEBGPMRAI)
+}
+
+// OPENで名乗るAS
+// コンフェデレーションの外のピアにはコンフェデレーションIDを名乗る
+func (s *Session) openAS() uint16 {
+	remoteAS := s.Config.RemoteAS
+	if remoteAS == 0 || remoteAS == s.AS || s.ConfedMember(remoteAS) {
+		return s.AS
+	}
+	return s.ExternalAS()
+}
+
+func (s *Session) pathSource() PathSource {
+	return PathSource{
+		PeerAS:       s.PeerAS,
+		PeerRouterID: s.PeerRouterID,
+		PeerAddr:     s.PeerAddr,
+		IBGP:         s.IBGP(),
+		RRClient:     s.IBGP() && s.Config.RouteReflectorClient,
+		ConfedEBGP:   s.ConfedEBGP(),
+	}
+}
+
+func (s *Session) exportTarget() ExportTarget {
+	return ExportTarget{
+		LocalInfo:     s.LocalInfo,
+		NextHop:       s.NetipAddr,
+		PeerAddr:      s.PeerAddr,
+		IBGP:          s.IBGP(),
+		NextHopSelf:   s.Config.NextHopSelf,
+		RRClient:      s.IBGP() && s.Config.RouteReflectorClient,
+		ConfedEBGP:    s.ConfedEBGP(),
+		LinkBandwidth: s.LinkBandwidth,
+	}
+}
+
+// セッションをまたいで保持するピアの設定とLocRibとのチャネル
+type Neighbor struct {
+	Ifi        net.Interface
+	ActiveMode bool
+	Local      LocalInfo
+	Config     PeerConfig
+	RibAdjInCh chan RibDelta
+	// LocRibからの変更はセッションが切れている間もためておき、次のセッションの最初に捨てる
+	LocRibQueue *OutQueue
+	ShutdownCh  chan string
+	ClearCh     chan struct{}
+	Status      *PeerStatus
+	// フラップダンピングを使わなければnil
+	Damper *Damper
+	// ダイナミックネイバーとして受け付けた接続. それ以外はnil
+	Conn net.Conn
+	// Graceful Restart中のピアの経路. mu で守る
+	mu       sync.Mutex
+	stale    RibAdj
+	staleGen int
+	// restart timerで取り消しを送っている間だけ開いている
+	resetting chan struct{}
+	// ピアのgoroutineが終わると閉じる. LocRibに送るときに止まらないようにする
+	done <-chan struct{}
+}
+
+func NewNeighbor(ifi net.Interface, active bool, local LocalInfo, config PeerConfig, damping *DampingConfig) *Neighbor {
+	n := &Neighbor{
+		Ifi:         ifi,
+		ActiveMode:  active,
+		Local:       local,
+		Config:      config,
+		RibAdjInCh:  make(chan RibDelta, 10),
+		LocRibQueue: NewOutQueue(0),
+		ShutdownCh:  make(chan string, 1),
+		ClearCh:     make(chan struct{}, 1),
+		Status:      &PeerStatus{State: Idle, RouterID: local.RouterID, Auth: config.Auth()},
+	}
+	if damping != nil {
+		n.Damper = NewDamper(*damping)
+	}
+	return n
+}
+
+// LocRib側から見たピア
+func (n *Neighbor) Peer(done <-chan struct{}) Peer {
+	n.done = done
+	return Peer{
+		RibAdjIn:     make(RibAdj),
+		RibAdjInCh:   n.RibAdjInCh,
+		LocRibQueue:  n.LocRibQueue,
+		ShutdownCh:   n.ShutdownCh,
+		ClearCh:      n.ClearCh,
+		Status:       n.Status,
+		Damper:       n.Damper,
+		Done:         done,
+		ImportPolicy: n.Config.ImportPolicy,
+		ExportPolicy: n.Config.ExportPolicy,
+	}
+}
+
+// 広告に使う自分のアドレス
+func (n *Neighbor) localAddr() (netip.Addr, error) {
+	if n.Config.Address.IsValid() {
+		// 接続するまで決まらないことがある
+		return update_source(n.Config.UpdateSource)
+	}
+	if n.Conn != nil {
+		addrport, err := netip.ParseAddrPort(n.Conn.LocalAddr().String())
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		return addrport.Addr().Unmap(), nil
+	}
+	return localNetipIp(n.Ifi)
+}
+
+// 表示用のピアの状態
+// セッションのgoroutineが書き込み、シグナルハンドラから読むのでmutexで守る
+type PeerStatus struct {
+	mu    sync.Mutex
+	Name  string
+	State State
+	// 自分のrouter-id
+	RouterID     netip.Addr
+	PeerAS       uint16
+	PeerRouterID netip.Addr
+	IBGP         bool
+	Auth         string
+	// End-of-RIBを受け取って最初の経路を受け取り終わったか
+	EndOfRIB    bool
+	PrefixCount int
+	// LocRibが広告した経路の数
+	Advertised int
+	QueueDepth int
+	LastError  string
+}
+
+func (p *PeerStatus) SetState(state State) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.State = state
+}
+
+func (p *PeerStatus) SetPeer(AS uint16, routerID netip.Addr, ibgp bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.PeerAS = AS
+	p.PeerRouterID = routerID
+	p.IBGP = ibgp
+}
+
+func (p *PeerStatus) SetPrefixCount(count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.PrefixCount = count
+}
+
+func (p *PeerStatus) SetAdvertised(count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Advertised = count
+}
+
+func (p *PeerStatus) SetSynced(synced bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.EndOfRIB = synced
+}
+
+func (p *PeerStatus) Synced() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.EndOfRIB
+}
+
+func (p *PeerStatus) SetQueueDepth(depth int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.QueueDepth = depth
+}
+
+func (p *PeerStatus) SetLastError(err string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.LastError = err
+}
+
+func (p *PeerStatus) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := fmt.Sprintf("%s: %s local router-id %v", p.Name, p.State, p.RouterID)
+	if p.PeerAS != 0 {
+		kind := "ebgp"
+		if p.IBGP {
+			kind = "ibgp"
+		}
+		s += fmt.Sprintf(" AS %d (%s) router-id %v", p.PeerAS, kind, p.PeerRouterID)
+	}
+	if p.Auth != "" {
+		s += fmt.Sprintf(" auth %s", p.Auth)
+	}
+	if p.EndOfRIB {
+		s += " synced"
+	}
+	s += fmt.Sprintf(" prefixes %d advertised %d queue %d", p.PrefixCount, p.Advertised, p.QueueDepth)
+	if p.LastError != "" {
+		s += fmt.Sprintf(" last error: %s", p.LastError)
+	}
+	return s
 }
 
 type Event string